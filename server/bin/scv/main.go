@@ -3,7 +3,9 @@ package main
 import (
 	"../../scv"
 	"encoding/json"
+	"flag"
 	// "fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -23,7 +25,58 @@ func main() {
 	}
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(&conf)
-	app := scv.NewApplication(conf)
 
+	// scv [-fsck] serves, scv migrate-mongo and scv fsck [-repair] [-recreate] [-forget] [-replay] are maintenance commands
+	startupFsck := flag.Bool("fsck", false, "check and repair the streams before serving")
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "":
+	case "migrate-mongo":
+		if err = scv.MigrateMongoToEmbedded(conf); err != nil {
+			panic("Migration failed: " + err.Error())
+		}
+		log.Printf("Done, set Database to \"embedded\" in scv.json to use %s", scv.EmbeddedPath(conf))
+		return
+	case "fsck":
+		commands := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := commands.Bool("repair", false, "fix what can be fixed, otherwise only report")
+		recreate := commands.Bool("recreate", false, "recreate streams missing from the database from their stream.json instead of quarantining them, the SCV writes it when it loads a stream")
+		forget := commands.Bool("forget", false, "remove streams whose data is missing on disk from the database")
+		replay := commands.Bool("replay", false, "retry the database writes that were given up on")
+		commands.Parse(flag.Args()[1:])
+		// a report leaves the data as it is, but neither may run while the SCV does
+		var app *scv.Application
+		if *repair {
+			app = scv.NewApplication(conf)
+		} else {
+			app = scv.NewReadOnlyApplication(conf)
+		}
+		if fsck(app, scv.FsckOptions{Repair: *repair, Recreate: *recreate, Forget: *forget, Replay: *replay}) == false {
+			os.Exit(1)
+		}
+		return
+	default:
+		panic("Unknown command " + flag.Arg(0))
+	}
+
+	app := scv.NewApplication(conf)
+	if *startupFsck {
+		fsck(app, scv.FsckOptions{Repair: true})
+	}
 	app.Run()
 }
+
+// Returns true if no problems are left.
+func fsck(app *scv.Application, options scv.FsckOptions) bool {
+	problems, err := app.Fsck(options)
+	if err != nil {
+		panic("Fsck failed: " + err.Error())
+	}
+	ok := true
+	for _, problem := range problems {
+		log.Println(problem.String())
+		ok = ok && problem.Fixed
+	}
+	log.Printf("Found %d problems", len(problems))
+	return ok
+}
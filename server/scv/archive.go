@@ -0,0 +1,441 @@
+package scv
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Describes the content of a stream archive, it is always the first entry of the archive.
+type ArchiveManifest struct {
+	StreamId   string           `json:"stream_id"`
+	Stream     json.RawMessage  `json:"stream"`     // the stream as returned by /streams/info
+	Partitions []int            `json:"partitions"` // partitions included in the archive
+	Files      map[string]int64 `json:"files"`      // size of every other entry, by path relative to the stream
+}
+
+// Longest a transfer of a whole stream may go without reading or writing anything.
+const TRANSFER_IDLE_TIMEOUT time.Duration = 60 * time.Second
+
+/*
+Reads from body and writes to the response of a request that transfers a whole stream, which can
+take much longer than the timeouts of the Server. These are lifted as long as data goes through:
+the deadlines of the connection are pushed back by TRANSFER_IDLE_TIMEOUT whenever the transfer is
+read from or written to.
+*/
+type transfer struct {
+	rc       *http.ResponseController
+	w        io.Writer
+	body     io.Reader
+	deadline time.Time
+}
+
+func newTransfer(w http.ResponseWriter, body io.Reader) *transfer {
+	t := &transfer{rc: http.NewResponseController(w), w: w, body: body}
+	t.extend()
+	return t
+}
+
+// Push the deadlines back, at most once a second. Responses that are not sent over a connection,
+// eg. in tests, have no deadlines.
+func (t *transfer) extend() {
+	now := time.Now()
+	if t.deadline.Sub(now) > TRANSFER_IDLE_TIMEOUT-time.Second {
+		return
+	}
+	t.deadline = now.Add(TRANSFER_IDLE_TIMEOUT)
+	t.rc.SetReadDeadline(t.deadline)
+	t.rc.SetWriteDeadline(t.deadline)
+}
+
+func (t *transfer) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	t.extend()
+	return n, err
+}
+
+func (t *transfer) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.extend()
+	return n, err
+}
+
+func parseRange(r *http.Request, key string, def int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return def, nil
+	}
+	res, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("Bad request: " + key + " must be an integer")
+	}
+	return res, nil
+}
+
+// Build the manifest of an archive of the stream with the partitions in [from, to], and list the
+// files that go in it.
+func (app *Application) listArchive(streamId, user string, from, to int) ([]byte, []StoreFile, error) {
+	manifest := ArchiveManifest{
+		StreamId:   streamId,
+		Partitions: make([]int, 0),
+		Files:      make(map[string]int64),
+	}
+	entries := make([]StoreFile, 0)
+	e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		if stream.Owner != user {
+			return errors.New("You do not own this stream.")
+		}
+		streamJSON, err := json.Marshal(stream)
+		if err != nil {
+			return err
+		}
+		manifest.Stream = streamJSON
+		dirs := []string{"files", "tags", "seeds"}
+		partitions, err := app.Store.ListPartitions(streamId)
+		if err != nil {
+			return err
+		}
+		for _, partition := range partitions {
+			if partition >= from && partition <= to {
+				manifest.Partitions = append(manifest.Partitions, partition)
+				dirs = append(dirs, strconv.Itoa(partition))
+			}
+		}
+		for _, dir := range dirs {
+			files, err := app.Store.ListFiles(streamId, dir)
+			if err != nil {
+				return errors.New("Cannot list files of stream")
+			}
+			entries = append(entries, files...)
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, nil, e
+	}
+	for _, entry := range entries {
+		manifest.Files[entry.Name] = entry.Size
+	}
+	manifestJSON, e := json.Marshal(manifest)
+	if e != nil {
+		return nil, nil, e
+	}
+	return manifestJSON, entries, nil
+}
+
+// Stream a tar archive of a stream to the client, gzipped if the gzip query parameter is set. The
+// from and to query parameters restrict the partitions included to those with from <= frames <= to,
+// the seed files and tags are always included. Entries are named {stream_id}/{path} and are preceded
+// by {stream_id}/manifest.json. The files are listed while the stream is locked but read afterwards
+// so that cores are not blocked, if a file disappears in the meantime the connection is aborted.
+// The export may outlast the timeouts of the Server, see transfer.
+func (app *Application) StreamExportHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		from, err := parseRange(r, "from", 0)
+		if err != nil {
+			return err
+		}
+		to, err := parseRange(r, "to", int(^uint(0)>>1))
+		if err != nil {
+			return err
+		}
+		compress := r.URL.Query().Get("gzip")
+		useGzip := compress != "" && compress != "0" && compress != "false"
+		manifestJSON, entries, e := app.listArchive(streamId, user, from, to)
+		if e != nil {
+			return e
+		}
+
+		filename := streamId + ".tar"
+		var out io.Writer = newTransfer(w, nil)
+		var gz *gzip.Writer
+		if useGzip {
+			filename += ".gz"
+			w.Header().Set("Content-Type", "application/gzip")
+			gz = gzip.NewWriter(out)
+			out = gz
+		} else {
+			w.Header().Set("Content-Type", "application/x-tar")
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+		tw := tar.NewWriter(out)
+		// the response has started, errors can only be reported by aborting the connection
+		err = writeArchive(tw, app.Store, streamId, manifestJSON, entries, nil)
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil && gz != nil {
+			err = gz.Close()
+		}
+		if err != nil {
+			log.Printf("Export of stream %s failed: %s", streamId, err.Error())
+			panic(http.ErrAbortHandler)
+		}
+		return nil
+	}
+}
+
+// Write the manifest and the files of an archive. If sums is not nil, the md5 of every file sent is
+// added to it by name.
+func writeArchive(tw *tar.Writer, store StreamStore, streamId string, manifestJSON []byte, entries []StoreFile, sums map[string]string) error {
+	hdr := &tar.Header{
+		Name:    streamId + "/manifest.json",
+		Mode:    0644,
+		Size:    int64(len(manifestJSON)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		file, err := store.OpenFile(streamId, entry.Name)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    streamId + "/" + entry.Name,
+			Mode:    0644,
+			Size:    entry.Size,
+			ModTime: entry.ModTime,
+		}
+		h := md5.New()
+		if err = tw.WriteHeader(hdr); err == nil {
+			_, err = io.CopyN(io.MultiWriter(tw, h), file, entry.Size)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if sums != nil {
+			sums[entry.Name] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return nil
+}
+
+// The md5 of each of the named files of a stream, as read back from the store.
+func storeChecksums(store StreamStore, streamId string, names []string) (map[string]string, error) {
+	sums := make(map[string]string)
+	for _, name := range names {
+		file, err := store.OpenFile(streamId, name)
+		if err != nil {
+			return nil, err
+		}
+		h := md5.New()
+		_, err = io.Copy(h, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// Returns the path of an archive entry relative to the stream directory, or an error if the entry
+// does not belong in a stream directory.
+func archiveEntryName(streamId, name string) (string, error) {
+	rel := strings.TrimPrefix(name, streamId+"/")
+	if rel == name || rel == "" || path.Clean(rel) != rel || strings.HasPrefix(rel, "../") {
+		return "", errors.New("Invalid archive entry " + name)
+	}
+	top := strings.SplitN(rel, "/", 2)[0]
+	if top == "files" || top == "tags" || top == "seeds" {
+		return rel, nil
+	}
+	if partition, err := strconv.Atoi(top); err == nil && partition > 0 {
+		return rel, nil
+	}
+	return "", errors.New("Invalid archive entry " + name)
+}
+
+// Unpack an archive made by StreamExportHandler, gzipped or not, and register the stream it contains
+// under the same stream id. The stream is owned by the importing manager and keeps its status, its
+// frame count is the last partition in the archive. Entries are written to the store as they arrive,
+// and removed again unless every file of the manifest has been received and the stream inserted in
+// Mongo. The reply includes the md5 of the request body, and that of every file as committed. Like
+// exports, imports may outlast the timeouts of the Server.
+func (app *Application) StreamImportHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		if err = app.disk.Refuse(DISK_NO_STREAMS); err != nil {
+			return err
+		}
+		// the md5 of the request body lets the sender verify the transfer
+		h := md5.New()
+		body := bufio.NewReader(io.TeeReader(newTransfer(w, r.Body), h))
+		var archive io.Reader = body
+		if magic, _ := body.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				return errors.New("Bad request: " + err.Error())
+			}
+			defer gz.Close()
+			archive = gz
+		}
+		tr := tar.NewReader(archive)
+		hdr, err := tr.Next()
+		if err != nil {
+			return errors.New("Bad request: cannot read archive")
+		}
+		manifest := ArchiveManifest{}
+		err = json.NewDecoder(tr).Decode(&manifest)
+		streamId := manifest.StreamId
+		if err != nil || streamId == "" || hdr.Name != streamId+"/manifest.json" {
+			return errors.New("Bad request: archive does not start with a manifest")
+		}
+		if filepath.Base(streamId) != streamId {
+			return errors.New("Bad request: invalid stream id " + streamId)
+		}
+		imported := Stream{}
+		if err = json.Unmarshal(manifest.Stream, &imported); err != nil {
+			return errors.New("Bad request: invalid stream in manifest")
+		}
+		if imported.TargetId == "" {
+			return errors.New("Bad request: stream has no target")
+		}
+		// the reservation keeps concurrent imports of the same id out until the stream is added
+		if err = app.Manager.ReserveStream(streamId); err != nil {
+			return err
+		}
+		if _, err = app.Store.Stat(streamId, ""); err == nil {
+			app.Manager.ReleaseStream(streamId)
+			return errors.New("stream " + streamId + " already exists on disk")
+		}
+		// a delete still queued for the id would remove the document of the imported stream
+		if _, ok := app.deferred.Queued(DEFERRED_STREAM_DELETE)[streamId]; ok {
+			app.Manager.ReleaseStream(streamId)
+			return errors.New("stream " + streamId + " is waiting to be deleted")
+		}
+
+		// every file of the stream was written by this import, so it can all go if the import fails.
+		// If the SCV dies instead, the files are not in Mongo and scv fsck -repair quarantines them.
+		committed := false
+		defer func() {
+			if committed == false {
+				app.Store.RemoveStream(streamId)
+				app.Manager.ReleaseStream(streamId)
+			}
+		}()
+		frames := 0
+		received := 0
+		for {
+			hdr, err = tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return errors.New("Bad request: cannot read archive")
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				continue
+			}
+			name, err := archiveEntryName(streamId, hdr.Name)
+			if err != nil {
+				return errors.New("Bad request: " + err.Error())
+			}
+			if size, ok := manifest.Files[name]; ok == false || size != hdr.Size {
+				return errors.New("Bad request: " + name + " does not match the manifest")
+			}
+			if _, err = app.Store.Stat(streamId, name); err == nil {
+				return errors.New("Bad request: " + name + " appears twice")
+			}
+			if strings.HasPrefix(name, "files/") {
+				// seeds go through WriteSeed so that they are shared with other streams
+				data, err := ioutil.ReadAll(io.LimitReader(tr, hdr.Size))
+				if err != nil || int64(len(data)) != hdr.Size {
+					return errors.New("Bad request: cannot read archive")
+				}
+				if err = app.Store.WriteSeed(streamId, strings.TrimPrefix(name, "files/"), data); err != nil {
+					return errors.New("Cannot write " + name)
+				}
+			} else {
+				file, err := app.Store.CreateFile(streamId, name)
+				if err != nil {
+					return errors.New("Cannot write " + name)
+				}
+				_, err = io.CopyN(file, tr, hdr.Size)
+				if closeErr := file.Close(); err == nil && closeErr != nil {
+					return errors.New("Cannot write " + name)
+				}
+				if err != nil {
+					return errors.New("Bad request: cannot read archive")
+				}
+			}
+			received += 1
+			if partition, err := strconv.Atoi(strings.SplitN(name, "/", 2)[0]); err == nil && partition > frames {
+				frames = partition
+			}
+		}
+		if received != len(manifest.Files) {
+			return errors.New("Bad request: archive is missing files")
+		}
+		if _, err = io.Copy(ioutil.Discard, body); err != nil {
+			return errors.New("Bad request: cannot read archive")
+		}
+		names := make([]string, 0, len(manifest.Files))
+		for name := range manifest.Files {
+			names = append(names, name)
+		}
+		sums, err := storeChecksums(app.Store, streamId, names)
+		if err != nil {
+			return errors.New("Cannot read back imported files: " + err.Error())
+		}
+
+		stream := NewStream(streamId, imported.TargetId, user, frames, imported.ErrorCount, imported.CreationDate)
+		stream.Priority = imported.Priority
+		if imported.Weight > 0 {
+			stream.Weight = imported.Weight
+		}
+		stream.MaxFrames = imported.MaxFrames
+		stream.Engines = imported.Engines
+		stream.ParentId = imported.ParentId
+		stream.ParentPartition = imported.ParentPartition
+		stream.ParentCheckpoint = imported.ParentCheckpoint
+		if imported.MongoStatus == "disabled" || imported.MongoStatus == "completed" {
+			stream.MongoStatus = imported.MongoStatus
+		}
+		// insertStream removes the files itself if it fails
+		committed = true
+		if err = app.insertStream(stream); err != nil {
+			app.Manager.ReleaseStream(streamId)
+			return err
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"stream_id": streamId,
+			"frames":    frames,
+			"md5":       hex.EncodeToString(h.Sum(nil)),
+			"files":     sums,
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
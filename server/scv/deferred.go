@@ -0,0 +1,678 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Number of failed attempts after which a deferred operation is moved to the dead letters.
+const MAX_DEFERRED_ATTEMPTS int = 20
+
+// Upper bound on the wait between two attempts of a deferred operation.
+const MAX_DEFERRED_BACKOFF time.Duration = 5 * time.Minute
+
+// Types of deferred operations.
+const (
+	DEFERRED_STATS_INSERT  = "stats_insert"
+	DEFERRED_STREAM_UPDATE = "stream_update"
+	DEFERRED_STREAM_DELETE = "stream_delete"
+	DEFERRED_CHECKPOINT    = "checkpoint"
+	DEFERRED_ORDERING      = "ordering"
+	DEFERRED_STATUS        = "status"
+	DEFERRED_FRAMES        = "frames"
+)
+
+// Statistics of a donor's session on a stream, inserted into stats.{target_id}.
+type StreamStats struct {
+	Engine    string  `json:"engine" bson:"engine"`
+	User      string  `json:"user" bson:"user"`
+	StartTime int     `json:"start_time" bson:"start_time"`
+	EndTime   int     `json:"end_time" bson:"end_time"`
+	Frames    float64 `json:"frames" bson:"frames"`
+	Stream    string  `json:"stream" bson:"stream"`
+}
+
+// Fields of a stream set by a deferred stream update.
+type StreamUpdate struct {
+	Frames     int    `json:"frames" bson:"frames"`
+	ErrorCount int    `json:"error_count" bson:"error_count"`
+	Status     string `json:"status" bson:"status"`
+}
+
+// Fields of a stream set by a deferred checkpoint.
+type StreamCheckpoint struct {
+	Frames         int `json:"frames" bson:"frames"`
+	LastCheckpoint int `json:"last_checkpoint" bson:"last_checkpoint"`
+}
+
+// Fields of a stream set by a deferred truncation.
+type StreamFrames struct {
+	Frames int `json:"frames" bson:"frames"`
+}
+
+// Fields of a stream set by a deferred ordering change.
+type StreamOrdering struct {
+	Priority int     `json:"priority" bson:"priority"`
+	Weight   float64 `json:"weight" bson:"weight"`
+}
+
+// Fields of a stream set by a deferred status change.
+type StreamStatus struct {
+	Status     string `json:"status" bson:"status"`
+	ErrorCount int    `json:"error_count" bson:"error_count"`
+}
+
+// A write to Mongo that is retried until it succeeds. Only the fields of its type are set.
+type DeferredOp struct {
+	Id         int64             `json:"id"`
+	Type       string            `json:"type"`
+	StreamId   string            `json:"stream_id"`
+	TargetId   string            `json:"target_id,omitempty"`
+	Stats      *StreamStats      `json:"stats,omitempty"`
+	Update     *StreamUpdate     `json:"update,omitempty"`
+	Checkpoint *StreamCheckpoint `json:"checkpoint,omitempty"`
+	Ordering   *StreamOrdering   `json:"ordering,omitempty"`
+	Status     *StreamStatus     `json:"status,omitempty"`
+	Frames     *StreamFrames     `json:"frames,omitempty"`
+	Attempts   int               `json:"attempts"`
+	NextTry    time.Time         `json:"next_try"`
+	LastError  string            `json:"last_error,omitempty"`
+	// Fields of the stream set by operations applied after this one was given up on.
+	Overwritten []string `json:"overwritten,omitempty"`
+	saved       bool     // written to disk, Drain leaves the operation alone until then
+}
+
+/*
+A DeferredQueue holds operations in order, each in its own file of dir, so that they are replayed
+when the SCV restarts. Operations on the same stream are applied in order, but a failing operation
+only holds back the operations on its own stream. It is retried with an exponential backoff, and
+moved to dir/dead once it failed MAX_DEFERRED_ATTEMPTS times, where it stays until an administrator
+replays it with scv fsck -repair -replay, see Revive. The fields that the operations on its stream
+set after it was given up on are recorded in it, so that replaying it does not undo them.
+
+The queue lock is never held while writing to disk, so that operations can be queued with Enqueue
+while holding the lock of the Manager. They are written to disk in batches by Flush.
+*/
+type DeferredQueue struct {
+	sync.Mutex
+	dir      string
+	ops      []*DeferredOp
+	unsaved  []*DeferredOp // queued but not written to disk yet
+	nextId   int64
+	dead     map[string]struct{} // streams that may have dead letters
+	flushing sync.Mutex          // serializes Flush
+	draining sync.Mutex          // serializes Drain
+	written  chan struct{}       // signaled by Enqueue
+}
+
+// Load the operations left in dir by a previous run, and remove the files left by interrupted writes.
+func NewDeferredQueue(dir string) (*DeferredQueue, error) {
+	q, err := loadDeferredQueue(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range []string{dir, filepath.Join(dir, "dead")} {
+		tmpFiles, _ := filepath.Glob(filepath.Join(d, "*.tmp"))
+		for _, filename := range tmpFiles {
+			os.Remove(filename)
+		}
+	}
+	return q, nil
+}
+
+// Like NewDeferredQueue, but leaves dir as it is.
+func loadDeferredQueue(dir string) (*DeferredQueue, error) {
+	q := &DeferredQueue{dir: dir, nextId: 1, dead: make(map[string]struct{}), written: make(chan struct{}, 1)}
+	ops, err := readDeferredOps(dir)
+	if err != nil {
+		return nil, err
+	}
+	q.ops = ops
+	for _, op := range ops {
+		if op.Id >= q.nextId {
+			q.nextId = op.Id + 1
+		}
+	}
+	dead, err := readDeferredOps(filepath.Join(dir, "dead"))
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range dead {
+		q.dead[op.StreamId] = struct{}{}
+		if op.Id >= q.nextId {
+			q.nextId = op.Id + 1
+		}
+	}
+	return q, nil
+}
+
+// Read the operations saved in dir, sorted by id.
+func readDeferredOps(dir string) ([]*DeferredOp, error) {
+	ops := make([]*DeferredOp, 0)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return ops, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		filename := filepath.Join(dir, file.Name())
+		if file.IsDir() || strings.HasSuffix(file.Name(), ".json") == false {
+			continue
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		op := &DeferredOp{}
+		if err = json.Unmarshal(data, op); err != nil {
+			return nil, errors.New("Corrupt deferred operation " + filename + ": " + err.Error())
+		}
+		op.saved = true
+		ops = append(ops, op)
+	}
+	sort.Sort(deferredOpsById(ops))
+	return ops, nil
+}
+
+type deferredOpsById []*DeferredOp
+
+func (o deferredOpsById) Len() int           { return len(o) }
+func (o deferredOpsById) Less(i, j int) bool { return o[i].Id < o[j].Id }
+func (o deferredOpsById) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+func (q *DeferredQueue) filename(dir string, op *DeferredOp) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.json", op.Id))
+}
+
+// Write the operation to its file, replacing it atomically, without syncing dir.
+func (q *DeferredQueue) write(dir string, op *DeferredOp) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if err = makeDir(dir); err != nil {
+		return err
+	}
+	filename := q.filename(dir, op)
+	file, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+	}
+	return err
+}
+
+// Write the operation to its file and sync dir.
+func (q *DeferredQueue) save(dir string, op *DeferredOp) error {
+	if err := q.write(dir, op); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Remove the file of the operation, without syncing dir, see Drain.
+func (q *DeferredQueue) remove(op *DeferredOp) error {
+	if err := os.Remove(q.filename(q.dir, op)); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return nil
+}
+
+// Id of an operation added to the end of the queue, the lock must be held. Ids are timestamps so that
+// they keep increasing across restarts, and dead letters of different runs do not collide.
+func (q *DeferredQueue) newId() int64 {
+	id := time.Now().UnixNano()
+	if id < q.nextId {
+		id = q.nextId
+	}
+	q.nextId = id + 1
+	return id
+}
+
+// Add an operation to the end of the queue without writing it to disk, see Flush.
+func (q *DeferredQueue) Enqueue(op DeferredOp) {
+	q.Lock()
+	op.Id = q.newId()
+	op.saved = false
+	q.ops = append(q.ops, &op)
+	q.unsaved = append(q.unsaved, &op)
+	q.Unlock()
+	select {
+	case q.written <- struct{}{}:
+	default:
+	}
+}
+
+// Add an operation to the end of the queue and write it to disk. The operation is queued even if it
+// could not be written, the error then only means it would not survive a restart.
+func (q *DeferredQueue) Push(op DeferredOp) error {
+	q.Enqueue(op)
+	return q.Flush()
+}
+
+// Write the operations queued by Enqueue to disk, syncing dir once for all of them. Operations that
+// could not be written are kept in memory only, and the last error is returned.
+func (q *DeferredQueue) Flush() error {
+	q.flushing.Lock()
+	defer q.flushing.Unlock()
+	q.Lock()
+	unsaved := q.unsaved
+	q.unsaved = nil
+	q.Unlock()
+	if len(unsaved) == 0 {
+		return nil
+	}
+	var err error
+	for _, op := range unsaved {
+		if e := q.write(q.dir, op); e != nil {
+			err = e
+		}
+	}
+	if e := syncDir(q.dir); e != nil {
+		err = e
+	}
+	q.Lock()
+	for _, op := range unsaved {
+		op.saved = true
+	}
+	q.Unlock()
+	return err
+}
+
+// Flush the operations as they are queued, until finish is closed.
+func (q *DeferredQueue) FlushUntil(finish chan struct{}) {
+	for {
+		select {
+		case <-finish:
+			q.logFlush()
+			return
+		case <-q.written:
+			q.logFlush()
+		}
+	}
+}
+
+func (q *DeferredQueue) logFlush() {
+	if err := q.Flush(); err != nil {
+		log.Printf("Warning: deferred writes will not survive a restart: %s", err.Error())
+	}
+}
+
+// Number of operations waiting to be applied.
+func (q *DeferredQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.ops)
+}
+
+// Apply every operation that is due at now, in order, skipping the streams that have an earlier
+// operation still pending. Failed operations are scheduled again or moved to the dead letters.
+// Operations are applied and their files written without holding the lock, so that Enqueue never
+// waits on Mongo or on the disk. Concurrent calls wait for each other instead. dir is synced once
+// for all the files removed or rewritten, at worst operations that were applied are applied again
+// after a crash.
+func (q *DeferredQueue) Drain(apply func(*DeferredOp) error, now time.Time) {
+	q.draining.Lock()
+	defer q.draining.Unlock()
+	q.logFlush()
+	q.Lock()
+	ops := make([]*DeferredOp, 0, len(q.ops))
+	unsaved := make(map[*DeferredOp]struct{})
+	for _, op := range q.ops {
+		ops = append(ops, op)
+		if op.saved == false {
+			unsaved[op] = struct{}{}
+		}
+	}
+	q.Unlock()
+	blocked := make(map[string]struct{})
+	done := make(map[*DeferredOp]struct{})
+	changed := false
+	for _, op := range ops {
+		// operations queued since the flush are left for the next drain, with those after them
+		_, isUnsaved := unsaved[op]
+		if _, ok := blocked[op.StreamId]; ok || isUnsaved || op.NextTry.After(now) {
+			blocked[op.StreamId] = struct{}{}
+			continue
+		}
+		err := apply(op)
+		changed = true
+		if err == nil {
+			done[op] = struct{}{}
+			if err = q.remove(op); err != nil {
+				log.Printf("Warning: cannot remove deferred operation %d: %s", op.Id, err.Error())
+			}
+			if err = q.overwrite(op); err != nil {
+				log.Printf("Warning: cannot update the dead letters of stream %s: %s", op.StreamId, err.Error())
+			}
+			continue
+		}
+		op.Attempts += 1
+		op.LastError = err.Error()
+		if op.Attempts >= MAX_DEFERRED_ATTEMPTS {
+			log.Printf("Deferred %s of stream %s failed %d times, giving up: %s", op.Type, op.StreamId, op.Attempts, op.LastError)
+			done[op] = struct{}{}
+			if err = q.save(filepath.Join(q.dir, "dead"), op); err == nil {
+				err = q.remove(op)
+			}
+			if err != nil {
+				log.Printf("Warning: cannot move deferred operation %d to the dead letters: %s", op.Id, err.Error())
+			}
+			q.Lock()
+			q.dead[op.StreamId] = struct{}{}
+			q.Unlock()
+			continue
+		}
+		backoff := MAX_DEFERRED_BACKOFF
+		if op.Attempts < 16 && time.Second<<uint(op.Attempts-1) < backoff {
+			backoff = time.Second << uint(op.Attempts-1)
+		}
+		op.NextTry = now.Add(backoff)
+		if err = q.write(q.dir, op); err != nil {
+			log.Printf("Warning: cannot save deferred operation %d: %s", op.Id, err.Error())
+		}
+		blocked[op.StreamId] = struct{}{}
+	}
+	if changed {
+		if err := syncDir(q.dir); err != nil {
+			log.Printf("Warning: cannot sync deferred operations: %s", err.Error())
+		}
+	}
+	q.Lock()
+	pending := make([]*DeferredOp, 0, len(q.ops))
+	for _, op := range q.ops {
+		if _, ok := done[op]; ok == false {
+			pending = append(pending, op)
+		}
+	}
+	q.ops = pending
+	q.Unlock()
+}
+
+// Ids of the streams that have an operation of the given type waiting to be applied.
+func (q *DeferredQueue) Queued(opType string) map[string]struct{} {
+	q.Lock()
+	defer q.Unlock()
+	res := make(map[string]struct{})
+	for _, op := range q.ops {
+		if op.Type == opType {
+			res[op.StreamId] = struct{}{}
+		}
+	}
+	return res
+}
+
+// Fields of a stream that an operation of the given type sets, none if it does not set any.
+func deferredFields(opType string) []string {
+	switch opType {
+	case DEFERRED_STREAM_UPDATE:
+		return []string{"frames", "error_count", "status"}
+	case DEFERRED_CHECKPOINT:
+		return []string{"frames", "last_checkpoint"}
+	case DEFERRED_FRAMES:
+		return []string{"frames"}
+	case DEFERRED_ORDERING:
+		return []string{"priority", "weight"}
+	case DEFERRED_STATUS:
+		return []string{"status", "error_count"}
+	}
+	return nil
+}
+
+// Whether the operations applied after this one was given up on set every field it sets, so that
+// replaying it could only bring back older values.
+func (op *DeferredOp) Superseded() bool {
+	fields := deferredFields(op.Type)
+	overwritten := make(map[string]struct{})
+	for _, field := range op.Overwritten {
+		overwritten[field] = struct{}{}
+	}
+	for _, field := range fields {
+		if _, ok := overwritten[field]; ok == false {
+			return false
+		}
+	}
+	return len(fields) > 0
+}
+
+// Record the fields set by an applied operation in the dead letters of its stream that precede it.
+func (q *DeferredQueue) overwrite(applied *DeferredOp) error {
+	fields := deferredFields(applied.Type)
+	q.Lock()
+	_, ok := q.dead[applied.StreamId]
+	q.Unlock()
+	if ok == false || len(fields) == 0 {
+		return nil
+	}
+	deadDir := filepath.Join(q.dir, "dead")
+	dead, err := readDeferredOps(deadDir)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, op := range dead {
+		if op.StreamId != applied.StreamId || op.Id > applied.Id {
+			continue
+		}
+		found = true
+		overwritten := make(map[string]struct{})
+		for _, field := range op.Overwritten {
+			overwritten[field] = struct{}{}
+		}
+		for _, field := range fields {
+			if _, ok := overwritten[field]; ok == false {
+				op.Overwritten = append(op.Overwritten, field)
+			}
+		}
+		if err = q.write(deadDir, op); err != nil {
+			return err
+		}
+	}
+	if found == false {
+		q.Lock()
+		delete(q.dead, applied.StreamId)
+		q.Unlock()
+		return nil
+	}
+	return syncDir(deadDir)
+}
+
+// Operations that were given up on, in order.
+func (q *DeferredQueue) DeadLetters() ([]DeferredOp, error) {
+	q.Lock()
+	defer q.Unlock()
+	dead, err := readDeferredOps(filepath.Join(q.dir, "dead"))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]DeferredOp, 0, len(dead))
+	for _, op := range dead {
+		res = append(res, *op)
+	}
+	return res, nil
+}
+
+// Move a dead letter back to the end of the queue with its attempts reset. It gets a new id, since the
+// operations on its stream that were queued after it have been applied in the meantime, which means
+// that its fields must be brought up to date first, see Application.refreshDeferred.
+func (q *DeferredQueue) Revive(op DeferredOp) error {
+	dead := op
+	q.Lock()
+	op.Id = q.newId()
+	q.Unlock()
+	op.Attempts = 0
+	op.NextTry = time.Time{}
+	op.LastError = ""
+	op.Overwritten = nil
+	if err := q.save(q.dir, &op); err != nil {
+		return err
+	}
+	if err := q.Discard(dead); err != nil {
+		return err
+	}
+	op.saved = true
+	q.Lock()
+	defer q.Unlock()
+	q.ops = append(q.ops, &op)
+	return nil
+}
+
+// Remove a dead letter without applying it.
+func (q *DeferredQueue) Discard(op DeferredOp) error {
+	deadDir := filepath.Join(q.dir, "dead")
+	if err := os.Remove(q.filename(deadDir, &op)); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return syncDir(deadDir)
+}
+
+// Queue a write to Mongo, it is written to disk and applied by RecordDeferredDocs. Does not touch the
+// disk, so it may be called while holding the lock of the Manager.
+func (app *Application) deferWrite(op DeferredOp) {
+	app.deferred.Enqueue(op)
+}
+
+func (app *Application) applyDeferred(op *DeferredOp) error {
+	switch op.Type {
+	case DEFERRED_STATS_INSERT:
+		return app.DB.Stats.Insert(op.TargetId, *op.Stats)
+	case DEFERRED_STREAM_UPDATE:
+		return app.updateFrames(op.StreamId, op.Update, op.Update.Frames)
+	case DEFERRED_CHECKPOINT:
+		return app.updateFrames(op.StreamId, op.Checkpoint, op.Checkpoint.Frames)
+	case DEFERRED_FRAMES:
+		return app.updateFrames(op.StreamId, op.Frames, op.Frames.Frames)
+	case DEFERRED_ORDERING, DEFERRED_STATUS:
+		var fields interface{} = op.Ordering
+		if op.Type == DEFERRED_STATUS {
+			fields = op.Status
+		}
+		err := app.DB.Streams.Update(op.StreamId, fields)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	case DEFERRED_STREAM_DELETE:
+		err := app.DB.Streams.Remove(op.StreamId)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		// the files go once the stream is gone from Mongo, unless it was imported again since. The
+		// reservation keeps a concurrent import of the same id from writing while they are removed.
+		if app.Manager.ReserveStream(op.StreamId) == nil {
+			if err = app.Store.RemoveStream(op.StreamId); err != nil {
+				log.Printf("Warning: cannot remove files of deleted stream %s: %s", op.StreamId, err.Error())
+			}
+			app.Manager.ReleaseStream(op.StreamId)
+		}
+		return nil
+	}
+	return errors.New("Unknown deferred operation " + op.Type)
+}
+
+// Set the fields of a stream that include its frame count, and remember the count as persisted.
+func (app *Application) updateFrames(streamId string, fields interface{}, frames int) error {
+	err := app.DB.Streams.Update(streamId, fields)
+	// the stream may have been deleted in the meantime
+	if err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+		stream.PersistedFrames = frames
+		return nil
+	})
+	return nil
+}
+
+/*
+Bring a dead letter up to date before it is revived. The fields that operations applied after it
+set are replaced by their current value in Mongo, so that replaying it cannot overwrite them with
+older ones. Returns false if there is nothing left to replay: every field it sets was set again
+since, or its stream is gone.
+*/
+func (app *Application) refreshDeferred(op *DeferredOp) (bool, error) {
+	if len(op.Overwritten) == 0 {
+		return true, nil
+	}
+	if op.Superseded() {
+		return false, nil
+	}
+	current := Stream{}
+	if err := app.DB.Streams.Find(op.StreamId, &current); err == mgo.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	overwritten := make(map[string]bool)
+	for _, field := range op.Overwritten {
+		overwritten[field] = true
+	}
+	switch op.Type {
+	case DEFERRED_STREAM_UPDATE:
+		update := *op.Update
+		if overwritten["frames"] {
+			update.Frames = current.Frames
+		}
+		if overwritten["error_count"] {
+			update.ErrorCount = current.ErrorCount
+		}
+		if overwritten["status"] {
+			update.Status = current.MongoStatus
+		}
+		op.Update = &update
+	case DEFERRED_CHECKPOINT:
+		checkpoint := *op.Checkpoint
+		if overwritten["frames"] {
+			checkpoint.Frames = current.Frames
+		}
+		if overwritten["last_checkpoint"] {
+			checkpoint.LastCheckpoint = current.LastCheckpoint
+		}
+		op.Checkpoint = &checkpoint
+	case DEFERRED_ORDERING:
+		ordering := *op.Ordering
+		if overwritten["priority"] {
+			ordering.Priority = current.Priority
+		}
+		if overwritten["weight"] {
+			ordering.Weight = current.Weight
+		}
+		op.Ordering = &ordering
+	case DEFERRED_STATUS:
+		status := *op.Status
+		if overwritten["status"] {
+			status.Status = current.MongoStatus
+		}
+		if overwritten["error_count"] {
+			status.ErrorCount = current.ErrorCount
+		}
+		op.Status = &status
+	}
+	return true, nil
+}
@@ -0,0 +1,234 @@
+package scv
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeferredQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deferred_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewDeferredQueue(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, q.Push(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: "a", Update: &StreamUpdate{Frames: 5, Status: "enabled"}}))
+	assert.Nil(t, q.Push(DeferredOp{Type: DEFERRED_STATS_INSERT, StreamId: "a", TargetId: "t", Stats: &StreamStats{Frames: 0.5}}))
+	assert.Nil(t, q.Push(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: "b"}))
+	assert.Equal(t, q.Len(), 3)
+
+	// as if the SCV restarted before Mongo came back
+	q, err = NewDeferredQueue(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, q.Len(), 3)
+	applied := make([]DeferredOp, 0)
+	q.Drain(func(op *DeferredOp) error {
+		applied = append(applied, *op)
+		return nil
+	}, time.Now())
+	assert.Equal(t, len(applied), 3)
+	assert.Equal(t, applied[0].Type, DEFERRED_STREAM_UPDATE)
+	assert.Equal(t, *applied[0].Update, StreamUpdate{Frames: 5, Status: "enabled"})
+	assert.Equal(t, applied[1].TargetId, "t")
+	assert.Equal(t, applied[1].Stats.Frames, 0.5)
+	assert.Equal(t, applied[2].StreamId, "b")
+	assert.Equal(t, q.Len(), 0)
+
+	// ids keep increasing across restarts
+	q, err = NewDeferredQueue(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, q.Len(), 0)
+	assert.Nil(t, q.Push(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: "c"}))
+	q, _ = NewDeferredQueue(dir)
+	q.Drain(func(op *DeferredOp) error {
+		assert.True(t, op.Id > applied[2].Id)
+		return nil
+	}, time.Now())
+}
+
+func TestDeferredQueueBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deferred_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, _ := NewDeferredQueue(dir)
+	q.Push(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: "a", Update: &StreamUpdate{Frames: 1}})
+	q.Push(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: "a", Update: &StreamUpdate{Frames: 2}})
+	q.Push(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: "b", Update: &StreamUpdate{Frames: 3}})
+	failing := true
+	applied := make([]int, 0)
+	apply := func(op *DeferredOp) error {
+		if op.StreamId == "a" && failing {
+			return errors.New("no mongo")
+		}
+		applied = append(applied, op.Update.Frames)
+		return nil
+	}
+
+	// a failure holds back the stream's later operations, but not those of other streams
+	now := time.Now()
+	q.Drain(apply, now)
+	assert.Equal(t, applied, []int{3})
+	assert.Equal(t, q.Len(), 2)
+
+	// the failed operation waits for its backoff, which doubles with every attempt
+	failing = false
+	q.Drain(apply, now.Add(time.Second/2))
+	assert.Equal(t, applied, []int{3})
+	failing = true
+	q.Drain(apply, now.Add(time.Second))
+	q, _ = NewDeferredQueue(dir)
+	q.Drain(apply, now.Add(2*time.Second))
+	assert.Equal(t, applied, []int{3})
+	failing = false
+	q.Drain(apply, now.Add(3*time.Second))
+	assert.Equal(t, applied, []int{3, 1, 2})
+	assert.Equal(t, q.Len(), 0)
+}
+
+func TestDeferredQueueDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deferred_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, _ := NewDeferredQueue(dir)
+	q.Push(DeferredOp{Type: "unknown", StreamId: "a"})
+	q.Push(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: "a"})
+	attempts := 0
+	apply := func(op *DeferredOp) error {
+		if op.Type == "unknown" {
+			attempts += 1
+			return errors.New("Unknown deferred operation")
+		}
+		return nil
+	}
+	now := time.Now()
+	for i := 0; i < MAX_DEFERRED_ATTEMPTS; i++ {
+		q.Drain(apply, now)
+		now = now.Add(MAX_DEFERRED_BACKOFF)
+	}
+	assert.Equal(t, attempts, MAX_DEFERRED_ATTEMPTS)
+	// the stream is no longer held back once the operation is given up on
+	q.Drain(apply, now)
+	assert.Equal(t, q.Len(), 0)
+	dead, err := q.DeadLetters()
+	assert.Nil(t, err)
+	assert.Equal(t, len(dead), 1)
+	assert.Equal(t, dead[0].Type, "unknown")
+	assert.Equal(t, dead[0].Attempts, MAX_DEFERRED_ATTEMPTS)
+	assert.Equal(t, dead[0].LastError, "Unknown deferred operation")
+	q, _ = NewDeferredQueue(dir)
+	assert.Equal(t, q.Len(), 0)
+
+	// revived operations are applied again, after those already queued
+	q.Push(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: "a"})
+	assert.Nil(t, q.Revive(dead[0]))
+	dead, _ = q.DeadLetters()
+	assert.Empty(t, dead)
+	q, _ = NewDeferredQueue(dir)
+	assert.Equal(t, q.Len(), 2)
+	types := make([]string, 0)
+	q.Drain(func(op *DeferredOp) error {
+		types = append(types, op.Type)
+		return nil
+	}, now)
+	assert.Equal(t, types, []string{DEFERRED_STREAM_DELETE, "unknown"})
+}
+
+func TestDeferredQueueOverwritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deferred_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, _ := NewDeferredQueue(dir)
+	q.Push(DeferredOp{Type: DEFERRED_STATUS, StreamId: "a", Status: &StreamStatus{"disabled", 3}})
+	q.Push(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: "a", Update: &StreamUpdate{Frames: 5, ErrorCount: 3, Status: "disabled"}})
+	failing := true
+	apply := func(op *DeferredOp) error {
+		if failing {
+			return errors.New("no mongo")
+		}
+		return nil
+	}
+	now := time.Now()
+	for i := 0; i < 2*MAX_DEFERRED_ATTEMPTS; i++ {
+		q.Drain(apply, now)
+		now = now.Add(MAX_DEFERRED_BACKOFF)
+	}
+	dead, _ := q.DeadLetters()
+	assert.Equal(t, len(dead), 2)
+
+	// the stream was enabled again once Mongo came back, which replaying the dead letters would undo
+	failing = false
+	q, _ = NewDeferredQueue(dir)
+	q.Push(DeferredOp{Type: DEFERRED_STATUS, StreamId: "a", Status: &StreamStatus{"enabled", 0}})
+	q.Push(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: "b", Update: &StreamUpdate{Frames: 1}})
+	q.Drain(apply, now)
+	assert.Equal(t, q.Len(), 0)
+	dead, _ = q.DeadLetters()
+	assert.Equal(t, dead[0].Type, DEFERRED_STATUS)
+	assert.Equal(t, dead[0].Overwritten, []string{"status", "error_count"})
+	assert.True(t, dead[0].Superseded())
+	assert.Equal(t, dead[1].Type, DEFERRED_STREAM_UPDATE)
+	assert.Equal(t, dead[1].Overwritten, []string{"status", "error_count"})
+	assert.False(t, dead[1].Superseded())
+
+	// revived operations start over
+	assert.Nil(t, q.Revive(dead[1]))
+	q, _ = NewDeferredQueue(dir)
+	q.Drain(func(op *DeferredOp) error {
+		assert.Empty(t, op.Overwritten)
+		assert.True(t, op.Id > dead[1].Id)
+		return nil
+	}, now)
+	assert.Nil(t, q.Discard(dead[0]))
+	dead, _ = q.DeadLetters()
+	assert.Empty(t, dead)
+}
+
+func TestDeferredQueueFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deferred_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, _ := NewDeferredQueue(dir)
+	q.Enqueue(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: "a", Update: &StreamUpdate{Frames: 1}})
+	q.Enqueue(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: "a", Update: &StreamUpdate{Frames: 2}})
+	assert.Equal(t, q.Len(), 2)
+	// nothing is written until the queue is flushed
+	other, _ := NewDeferredQueue(dir)
+	assert.Equal(t, other.Len(), 0)
+	assert.Nil(t, q.Flush())
+	other, _ = NewDeferredQueue(dir)
+	assert.Equal(t, other.Len(), 2)
+
+	// operations are flushed in the background as they are queued
+	finish := make(chan struct{})
+	flushed := make(chan struct{})
+	go func() {
+		q.FlushUntil(finish)
+		close(flushed)
+	}()
+	q.Enqueue(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: "b"})
+	close(finish)
+	<-flushed
+	other, _ = NewDeferredQueue(dir)
+	assert.Equal(t, other.Len(), 3)
+
+	// and before they are applied
+	q.Enqueue(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: "c"})
+	applied := make([]string, 0)
+	q.Drain(func(op *DeferredOp) error {
+		applied = append(applied, op.StreamId)
+		return nil
+	}, time.Now())
+	assert.Equal(t, applied, []string{"a", "a", "b", "c"})
+	assert.Equal(t, q.Len(), 0)
+	other, _ = NewDeferredQueue(dir)
+	assert.Equal(t, other.Len(), 0)
+}
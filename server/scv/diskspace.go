@@ -0,0 +1,164 @@
+package scv
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Time between two measures of the free disk space.
+const DISK_WATCHDOG_INTERVAL time.Duration = 10 * time.Second
+
+// Free disk space, in bytes, below which the SCV stops accepting work, part of the configuration.
+// Activations should be refused first, so that cores already running can finish their frames and
+// checkpoints. 0 disables a threshold.
+type DiskThresholds struct {
+	Activations uint64 `json:"Activations"` // no new activations
+	Streams     uint64 `json:"Streams"`     // no new streams, forks or imports
+	Frames      uint64 `json:"Frames"`      // no new frames
+}
+
+// What the SCV still accepts given the free disk space, from least to most restricted.
+type DiskLevel int
+
+const (
+	DISK_OK DiskLevel = iota
+	DISK_NO_ACTIVATIONS
+	DISK_NO_STREAMS
+	DISK_NO_FRAMES
+)
+
+func (l DiskLevel) String() string {
+	switch l {
+	case DISK_NO_ACTIVATIONS:
+		return "no_activations"
+	case DISK_NO_STREAMS:
+		return "no_streams"
+	case DISK_NO_FRAMES:
+		return "no_frames"
+	}
+	return "ok"
+}
+
+// Returned instead of writing to a disk that is almost full.
+type DiskSpaceError struct {
+	Level DiskLevel
+	Free  uint64
+}
+
+func (e *DiskSpaceError) Error() string {
+	return fmt.Sprintf("Low disk space: %d bytes free, status %s", e.Free, e.Level)
+}
+
+func (e *DiskSpaceError) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// Free space in bytes of the file system containing path.
+func diskFree(path string) (uint64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+/*
+DiskWatchdog measures the free space of the data directory periodically, so that handlers can refuse
+work cheaply before the disk fills up and leaves partitions half written. The level only changes
+when the space is measured, by Check.
+*/
+type DiskWatchdog struct {
+	sync.Mutex
+	path       string
+	thresholds DiskThresholds
+	freeSpace  func(path string) (uint64, error) // diskFree, replaced in tests
+	free       uint64
+	level      DiskLevel
+}
+
+func NewDiskWatchdog(path string, thresholds DiskThresholds) *DiskWatchdog {
+	return &DiskWatchdog{
+		path:       path,
+		thresholds: thresholds,
+		freeSpace:  diskFree,
+	}
+}
+
+func (t DiskThresholds) level(free uint64) DiskLevel {
+	switch {
+	case free < t.Frames:
+		return DISK_NO_FRAMES
+	case free < t.Streams:
+		return DISK_NO_STREAMS
+	case free < t.Activations:
+		return DISK_NO_ACTIVATIONS
+	}
+	return DISK_OK
+}
+
+// Measure the free space and update the level. The level is left unchanged if the space cannot be
+// measured, eg. before the data directory is created.
+func (d *DiskWatchdog) Check() DiskLevel {
+	free, err := d.freeSpace(d.path)
+	d.Lock()
+	defer d.Unlock()
+	if err != nil {
+		return d.level
+	}
+	level := d.thresholds.level(free)
+	if level != d.level {
+		log.Printf("Disk space status changed from %s to %s, %d bytes free", d.level, level, free)
+	}
+	d.free, d.level = free, level
+	return level
+}
+
+// Free space when it was last measured, and the resulting level.
+func (d *DiskWatchdog) Status() (uint64, DiskLevel) {
+	d.Lock()
+	defer d.Unlock()
+	return d.free, d.level
+}
+
+// Returns a DiskSpaceError if the current level is level or worse.
+func (d *DiskWatchdog) Refuse(level DiskLevel) error {
+	free, current := d.Status()
+	if current >= level {
+		return &DiskSpaceError{current, free}
+	}
+	return nil
+}
+
+// Bytes that can be written before the free space falls below the Frames threshold, measured now
+// rather than by the last Check since a single upload may take them all. Negative if the space cannot
+// be measured.
+func (d *DiskWatchdog) FrameSpace() int64 {
+	free, err := d.freeSpace(d.path)
+	if err != nil {
+		return -1
+	}
+	if free < d.thresholds.Frames {
+		return 0
+	}
+	return int64(free - d.thresholds.Frames)
+}
+
+// Measure the free disk space every DISK_WATCHDOG_INTERVAL until the application finishes.
+func (app *Application) WatchDiskSpace() {
+	defer app.statsWG.Done()
+	ticker := time.NewTicker(DISK_WATCHDOG_INTERVAL)
+	defer ticker.Stop()
+	app.disk.Check()
+	for {
+		select {
+		case <-app.finish:
+			return
+		case <-ticker.C:
+			app.disk.Check()
+		}
+	}
+}
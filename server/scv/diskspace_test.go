@@ -0,0 +1,93 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskThresholds(t *testing.T) {
+	thresholds := DiskThresholds{Activations: 300, Streams: 200, Frames: 100}
+	assert.Equal(t, thresholds.level(300), DISK_OK)
+	assert.Equal(t, thresholds.level(299), DISK_NO_ACTIVATIONS)
+	assert.Equal(t, thresholds.level(150), DISK_NO_STREAMS)
+	assert.Equal(t, thresholds.level(0), DISK_NO_FRAMES)
+	assert.Equal(t, DiskThresholds{}.level(0), DISK_OK)
+
+	free := uint64(1000)
+	d := NewDiskWatchdog("", thresholds)
+	d.freeSpace = func(string) (uint64, error) { return free, nil }
+	assert.Equal(t, d.Check(), DISK_OK)
+	assert.Nil(t, d.Refuse(DISK_NO_ACTIVATIONS))
+	free = 150
+	assert.Equal(t, d.Check(), DISK_NO_STREAMS)
+	assert.NotNil(t, d.Refuse(DISK_NO_ACTIVATIONS))
+	assert.Equal(t, d.Refuse(DISK_NO_STREAMS).Error(), "Low disk space: 150 bytes free, status no_streams")
+	assert.Nil(t, d.Refuse(DISK_NO_FRAMES))
+	// the last level is kept if the disk cannot be measured
+	d.freeSpace = func(string) (uint64, error) { return 0, errors.New("gone") }
+	assert.Equal(t, d.Check(), DISK_NO_STREAMS)
+}
+
+func (f *Fixture) setFreeSpace(free uint64) {
+	f.app.disk.freeSpace = func(string) (uint64, error) { return free, nil }
+	f.app.disk.Check()
+}
+
+func (f *Fixture) alive() (status map[string]interface{}) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &status)
+	return
+}
+
+func TestLowDiskSpace(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	f.app.disk.thresholds = DiskThresholds{Activations: 3000, Streams: 2000, Frames: 1000}
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	jsonData := `{"target_id":"` + target_id + `", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	f.setFreeSpace(5000)
+	assert.Equal(t, f.alive()["disk_status"], "ok")
+	streamId, code := f.postStream(auth_token, jsonData)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+
+	// running cores keep going
+	f.setFreeSpace(2500)
+	assert.Equal(t, f.alive()["disk_status"], "no_activations")
+	assert.Equal(t, f.alive()["disk_free"], float64(2500))
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "12345"}}`), 200)
+	_, code = f.postStream(auth_token, jsonData)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	_, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 503)
+
+	f.setFreeSpace(1500)
+	_, code = f.postStream(auth_token, jsonData)
+	assert.Equal(t, code, 503)
+	_, code = f.forkStream(auth_token, streamId, `{"partition": 0}`)
+	assert.Equal(t, code, 503)
+
+	f.setFreeSpace(500)
+	assert.Equal(t, f.alive()["disk_status"], "no_frames")
+	f.setFreeSpace(5000)
+	token, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	f.setFreeSpace(500)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "67890"}}`), 503)
+	// checkpoints are still accepted so that the core can stop cleanly
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.1}`), 200)
+
+	f.setFreeSpace(5000)
+	assert.Equal(t, f.alive()["disk_status"], "ok")
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "67890"}}`), 200)
+}
@@ -0,0 +1,330 @@
+package scv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// One change to a document of an EmbeddedMongo, Doc is nil if the document was removed.
+type embeddedRecord struct {
+	Collection string      `bson:"c"`
+	Id         interface{} `bson:"i"`
+	Doc        bson.M      `bson:"d,omitempty"`
+}
+
+// The log of an EmbeddedMongo is compacted once it is EMBEDDED_COMPACT_RATIO times as large as the
+// records it needs, unless it is smaller than EMBEDDED_COMPACT_MIN_SIZE.
+const EMBEDDED_COMPACT_RATIO int64 = 4
+const EMBEDDED_COMPACT_MIN_SIZE int64 = 1 << 20
+
+/*
+An EmbeddedMongo keeps the collections of a MemoryMongo in a single file, so that an SCV can run
+without a MongoDB server. The file is a log of bson records, one per change, and each record is
+synced before the change is made. The log is replayed when the file is opened, and compacted then
+and whenever it grows too large compared to the data it holds, so that it holds a single record per
+document again. A record that was only partly written when the SCV died is discarded.
+
+The last record of every document is kept in memory, so that the log can be compacted without
+taking the locks of the collections, which are held while their changes are written.
+
+Since the SCV is the only one using the file, it cannot find other SCVs to migrate streams to.
+*/
+type EmbeddedMongo struct {
+	*MemoryMongo
+	sync.Mutex
+	path       string
+	file       *os.File
+	size       int64                  // of the records that were completely written
+	records    map[embeddedKey][]byte // last record of every document
+	liveSize   int64                  // of records, the size of the log once compacted
+	minCompact int64                  // EMBEDDED_COMPACT_MIN_SIZE, except in tests
+}
+
+type embeddedKey struct {
+	collection string
+	id         interface{}
+}
+
+type embeddedKeys []embeddedKey
+
+func (k embeddedKeys) Len() int      { return len(k) }
+func (k embeddedKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k embeddedKeys) Less(i, j int) bool {
+	if k[i].collection != k[j].collection {
+		return k[i].collection < k[j].collection
+	}
+	return fmt.Sprint(k[i].id) < fmt.Sprint(k[j].id)
+}
+
+func OpenEmbeddedMongo(path string) (*EmbeddedMongo, error) {
+	e, err := ReadEmbeddedMongo(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := makeDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	e.Lock()
+	defer e.Unlock()
+	if err := e.compact(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Load the file without compacting it nor opening it for writing, every change then fails.
+func ReadEmbeddedMongo(path string) (*EmbeddedMongo, error) {
+	e := &EmbeddedMongo{
+		MemoryMongo: NewMemoryMongo(),
+		path:        path,
+		records:     make(map[embeddedKey][]byte),
+		minCompact:  EMBEDDED_COMPACT_MIN_SIZE,
+	}
+	e.MemoryMongo.persist = e.write
+	if err := e.replay(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Read the next record, io.EOF if there are none left and io.ErrUnexpectedEOF if the last one is
+// incomplete.
+func readEmbeddedRecord(r io.Reader) (embeddedRecord, error) {
+	record := embeddedRecord{}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return record, err
+	}
+	// a bson document starts with its own length
+	length := binary.LittleEndian.Uint32(header)
+	if length < 5 || length > 16*1024*1024 {
+		return record, errors.New("Invalid record length")
+	}
+	data := make([]byte, length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record, err
+	}
+	err := bson.Unmarshal(data, &record)
+	return record, err
+}
+
+func (e *EmbeddedMongo) replay() error {
+	file, err := os.Open(e.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for count := 1; ; count++ {
+		record, err := readEmbeddedRecord(r)
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			log.Printf("Discarding incomplete record %d of %s", count, e.path)
+			return nil
+		} else if err != nil {
+			return errors.New("Corrupt record " + strconv.Itoa(count) + " of " + e.path + ": " + err.Error())
+		}
+		names := strings.SplitN(record.Collection, ".", 2)
+		if len(names) != 2 {
+			return errors.New("Corrupt record " + strconv.Itoa(count) + " of " + e.path + ": invalid collection")
+		}
+		c := e.MemoryMongo.C(names[0], names[1])
+		c.Lock()
+		c.load(record.Id, record.Doc)
+		c.Unlock()
+		data, err := bson.Marshal(record)
+		if err != nil {
+			return err
+		}
+		e.track(record, data)
+	}
+}
+
+// Remember the last record of a document. Assumes e is locked, or not shared yet.
+func (e *EmbeddedMongo) track(record embeddedRecord, data []byte) {
+	key := embeddedKey{record.Collection, record.Id}
+	e.liveSize -= int64(len(e.records[key]))
+	if record.Doc == nil {
+		delete(e.records, key)
+		return
+	}
+	e.records[key] = data
+	e.liveSize += int64(len(data))
+}
+
+// Replace the file with one that holds the last record of every document, and append to it from
+// then on. Assumes e is locked.
+func (e *EmbeddedMongo) compact() error {
+	keys := make([]embeddedKey, 0, len(e.records))
+	for key := range e.records {
+		keys = append(keys, key)
+	}
+	sort.Sort(embeddedKeys(keys))
+
+	// the file is renamed into place once written, and appended to through the same descriptor
+	tmp := e.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, key := range keys {
+		if _, err = w.Write(e.records[key]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, e.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if e.file != nil {
+		e.file.Close()
+	}
+	e.file = file
+	e.size = e.liveSize
+	return syncDir(filepath.Dir(e.path))
+}
+
+// Append the record of a change and sync it. A record that could not be written completely is
+// truncated, so that it does not hide the records that follow.
+func (e *EmbeddedMongo) write(collection string, id interface{}, doc bson.M) error {
+	data, err := bson.Marshal(embeddedRecord{collection, id, doc})
+	if err != nil {
+		return err
+	}
+	e.Lock()
+	defer e.Unlock()
+	if e.file == nil {
+		return errors.New("Metadata store is closed or read-only")
+	}
+	_, err = e.file.Write(data)
+	if err == nil {
+		err = e.file.Sync()
+	}
+	if err != nil {
+		if truncErr := e.file.Truncate(e.size); truncErr != nil {
+			// the end of the log is unknown, so it cannot be appended to anymore
+			e.file.Close()
+			e.file = nil
+		}
+		return err
+	}
+	e.size += int64(len(data))
+	e.track(embeddedRecord{collection, id, doc}, data)
+	if e.size >= e.minCompact && e.size > EMBEDDED_COMPACT_RATIO*e.liveSize {
+		// the change is already safe in the log, which is kept as is if it cannot be compacted
+		if err = e.compact(); err != nil {
+			log.Printf("Warning: cannot compact %s: %s", e.path, err.Error())
+		}
+	}
+	return nil
+}
+
+func (e *EmbeddedMongo) Close() error {
+	e.Lock()
+	defer e.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
+
+// Path of the file of the embedded metadata store of an SCV.
+func EmbeddedPath(config Configuration) string {
+	return filepath.Join(config.Name+"_data", "metadata.db")
+}
+
+/*
+Copy the collections used by the SCV from its MongoDB server to its embedded metadata store: the
+users, the targets, the SCV's streams, the statistics and the registered SCVs. The embedded store
+must not exist yet, so that it is never mixed with older data.
+*/
+func MigrateMongoToEmbedded(config Configuration) (err error) {
+	path := EmbeddedPath(config)
+	if _, err := os.Stat(path); err == nil {
+		return errors.New(path + " already exists")
+	}
+	session, err := mgo.Dial(config.MongoURI)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	collections := [][2]string{
+		{"users", "all"},
+		{"users", "managers"},
+		{"data", "targets"},
+		{"streams", config.Name},
+		{"servers", "scvs"},
+	}
+	stats, err := session.DB("stats").CollectionNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range stats {
+		if strings.HasPrefix(name, "system.") == false {
+			collections = append(collections, [2]string{"stats", name})
+		}
+	}
+	embedded, err := OpenEmbeddedMongo(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		embedded.Close()
+		// a partial copy would keep the migration from being run again
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	for _, names := range collections {
+		iter := session.DB(names[0]).C(names[1]).Find(nil).Iter()
+		dst := embedded.C(names[0], names[1])
+		doc := bson.M{}
+		count := 0
+		for iter.Next(&doc) {
+			if err = dst.UpsertId(doc["_id"], doc); err != nil {
+				iter.Close()
+				return err
+			}
+			doc = bson.M{}
+			count += 1
+		}
+		if err = iter.Close(); err != nil {
+			return err
+		}
+		log.Printf("Copied %d documents of %s.%s", count, names[0], names[1])
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package scv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEmbeddedMongoReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "embedded")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data", "metadata.db")
+	e, err := OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	db := NewMemoryDatabase(e.MemoryMongo, "scv1")
+	e.C("users", "all").Insert(bson.M{"_id": "yutong", "token": "abc"})
+	assert.Nil(t, db.Streams.Insert(NewStream("s1", "t1", "yutong", 0, 0, 1000)))
+	assert.Nil(t, db.Streams.Insert(NewStream("s2", "t1", "yutong", 0, 0, 1000)))
+	assert.Nil(t, db.Streams.Update("s1", bson.M{"frames": 7}))
+	assert.Nil(t, db.Streams.Remove("s2"))
+	assert.Nil(t, db.Stats.Insert("t1", StreamStats{Engine: "openmm", User: "yutong", Stream: "s1"}))
+	assert.Nil(t, e.Close())
+	assert.NotNil(t, db.Streams.Update("s1", bson.M{"frames": 8}))
+
+	e, err = OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	defer e.Close()
+	db = NewMemoryDatabase(e.MemoryMongo, "scv1")
+	user, err := db.Users.FindByToken("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, user, "yutong")
+	streams, err := db.Streams.All()
+	assert.Nil(t, err)
+	assert.Equal(t, len(streams), 1)
+	assert.Equal(t, streams[0].StreamId, "s1")
+	assert.Equal(t, streams[0].Frames, 7)
+	stats := StreamStats{}
+	assert.Nil(t, db.Stats.FindByStream("t1", "s1", &stats))
+	assert.Equal(t, stats.Engine, "openmm")
+}
+
+func TestEmbeddedMongoCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "embedded")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.db")
+	e, err := OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	db := NewMemoryDatabase(e.MemoryMongo, "scv1")
+	assert.Nil(t, db.Streams.Insert(NewStream("s1", "t1", "yutong", 0, 0, 1000)))
+	for i := 1; i <= 20; i++ {
+		assert.Nil(t, db.Streams.Update("s1", bson.M{"frames": i}))
+	}
+	e.Close()
+	before, _ := os.Stat(path)
+
+	e, err = OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	after, _ := os.Stat(path)
+	assert.True(t, after.Size()*10 < before.Size())
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+	result := make(map[string]interface{})
+	assert.Nil(t, NewMemoryDatabase(e.MemoryMongo, "scv1").Streams.Find("s1", &result))
+	assert.Equal(t, result["frames"], 20)
+	e.Close()
+}
+
+func TestEmbeddedMongoCompactionWhileOpen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "embedded")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.db")
+	e, err := OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	e.minCompact = 0
+	db := NewMemoryDatabase(e.MemoryMongo, "scv1")
+	assert.Nil(t, db.Streams.Insert(NewStream("s1", "t1", "yutong", 0, 0, 1000)))
+	assert.Nil(t, db.Streams.Insert(NewStream("s2", "t1", "yutong", 0, 0, 1000)))
+	info, _ := os.Stat(path)
+	live := info.Size()
+	// every checkpoint appends a whole document, the log never grows past a few times the data
+	for i := 1; i <= 100; i++ {
+		assert.Nil(t, db.Streams.Update("s1", bson.M{"frames": i}))
+		info, _ = os.Stat(path)
+		assert.True(t, info.Size() <= (EMBEDDED_COMPACT_RATIO+1)*live)
+	}
+	assert.Nil(t, db.Streams.Remove("s2"))
+	assert.Nil(t, e.Close())
+
+	e, err = OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	defer e.Close()
+	db = NewMemoryDatabase(e.MemoryMongo, "scv1")
+	streams, err := db.Streams.All()
+	assert.Nil(t, err)
+	assert.Equal(t, len(streams), 1)
+	assert.Equal(t, streams[0].Frames, 100)
+}
+
+func TestEmbeddedMongoTruncatedRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "embedded")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.db")
+	e, err := OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	c := e.C("users", "managers")
+	assert.Nil(t, c.Insert(bson.M{"_id": "yutong", "weight": 1}))
+	assert.Nil(t, c.Insert(bson.M{"_id": "joe", "weight": 2}))
+	e.Close()
+
+	// the SCV died while writing the last record
+	info, _ := os.Stat(path)
+	assert.Nil(t, os.Truncate(path, info.Size()-3))
+	e, err = OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	db := NewMemoryDatabase(e.MemoryMongo, "scv1")
+	assert.True(t, db.Users.IsManager("yutong"))
+	assert.False(t, db.Users.IsManager("joe"))
+	assert.Nil(t, e.C("users", "managers").Insert(bson.M{"_id": "joe", "weight": 3}))
+	e.Close()
+
+	e, err = OpenEmbeddedMongo(path)
+	assert.Nil(t, err)
+	db = NewMemoryDatabase(e.MemoryMongo, "scv1")
+	weight, err := db.Users.ManagerWeight("joe")
+	assert.Nil(t, err)
+	assert.Equal(t, weight, 3.0)
+	_, err = db.Users.ManagerWeight("bob")
+	assert.Equal(t, err, mgo.ErrNotFound)
+	e.Close()
+
+	// a record that is complete but unreadable is not silently dropped
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0664)
+	file.Write([]byte{9, 0, 0, 0, 1, 2, 3, 4, 5})
+	file.Close()
+	_, err = OpenEmbeddedMongo(path)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,240 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// File of a stream's directory that records what is needed to recreate its document in Mongo.
+const STREAM_METADATA = "stream.json"
+
+type streamMetadata struct {
+	TargetId     string `json:"target_id"`
+	CreationDate int    `json:"creation_date"`
+}
+
+func (app *Application) writeStreamMetadata(stream *Stream) error {
+	data, err := json.Marshal(streamMetadata{stream.TargetId, stream.CreationDate})
+	if err != nil {
+		return err
+	}
+	return app.Store.WriteFile(stream.StreamId, STREAM_METADATA, data)
+}
+
+type FsckOptions struct {
+	Repair   bool // fix the problems that can be fixed, otherwise only report them
+	Recreate bool // recreate the documents of streams that are missing from Mongo, if they have metadata
+	Forget   bool // remove the documents of streams that have no data on disk
+	Replay   bool // queue the deferred writes that were given up on again
+}
+
+type FsckProblem struct {
+	StreamId string `json:"stream_id"`
+	Problem  string `json:"problem"`
+	Fixed    bool   `json:"fixed"`
+}
+
+func (p FsckProblem) String() string {
+	if p.Fixed {
+		return fmt.Sprintf("stream %s %s (fixed)", p.StreamId, p.Problem)
+	}
+	return fmt.Sprintf("stream %s %s", p.StreamId, p.Problem)
+}
+
+/*
+Compare the streams in Mongo with those on disk and report every inconsistency. Nothing is modified
+unless options.Repair is set, in which case:
+
+  - pending deferred writes are applied first, with options.Replay along with those that were
+    given up on. Those are applied after the writes that followed them, with the fields that these
+    set taken from Mongo, and dropped if they have nothing left to set.
+  - interrupted writes are rolled back, as LoadStreams would
+  - frame counts in Mongo are set to those on disk, and unknown statuses to "disabled"
+  - missing metadata files are written from Mongo
+  - streams that are on disk but not in Mongo are quarantined, or with options.Recreate
+    reinserted as disabled streams if they have metadata. LoadStreams writes it for the streams
+    created before it existed, so streams lost before an SCV loaded them cannot be recreated.
+  - with options.Forget, streams that are in Mongo but not on disk are removed from Mongo
+
+Without options.Forget, streams that are in Mongo but not on disk are only reported, since their
+data may just be unreachable (eg. an unmounted disk). LoadStreams skips them. Fsck must run before
+the streams are loaded. Reports can be made with a NewReadOnlyApplication, while no SCV is running.
+*/
+func (app *Application) Fsck(options FsckOptions) ([]FsckProblem, error) {
+	if options.Repair && app.readOnly {
+		return nil, errors.New("Cannot repair with a read-only application")
+	}
+	problems := make([]FsckProblem, 0)
+	report := func(streamId, problem string, fix func() error) {
+		p := FsckProblem{StreamId: streamId, Problem: problem}
+		if options.Repair && fix != nil {
+			if err := fix(); err != nil {
+				p.Problem += ", cannot fix: " + err.Error()
+			} else {
+				p.Fixed = true
+			}
+		}
+		problems = append(problems, p)
+	}
+	dead, err := app.deferred.DeadLetters()
+	if err != nil {
+		return nil, errors.New("Cannot read deferred writes: " + err.Error())
+	}
+	for _, op := range dead {
+		var fix func() error
+		if options.Replay {
+			op := op
+			fix = func() error {
+				replay, err := app.refreshDeferred(&op)
+				if err != nil {
+					return err
+				} else if replay == false {
+					return app.deferred.Discard(op)
+				}
+				return app.deferred.Revive(op)
+			}
+		}
+		problem := "has a deferred " + op.Type + " that was given up on: " + op.LastError
+		if op.Superseded() {
+			problem += ", superseded by later writes"
+		}
+		report(op.StreamId, problem, fix)
+	}
+	if options.Repair {
+		app.drainStats()
+	}
+
+	mongoStreams, err := app.DB.Streams.All()
+	if err != nil {
+		return nil, errors.New("Cannot list streams in Mongo: " + err.Error())
+	}
+	streams := make(map[string]*Stream)
+	for i := range mongoStreams {
+		streams[mongoStreams[i].StreamId] = &mongoStreams[i]
+	}
+	storedIds, err := app.Store.ListStreams()
+	if err != nil {
+		return nil, errors.New("Cannot list streams on disk: " + err.Error())
+	}
+	stored := make(map[string]struct{})
+	for _, streamId := range storedIds {
+		stored[streamId] = struct{}{}
+	}
+	ids := make([]string, 0, len(streams))
+	for streamId := range streams {
+		ids = append(ids, streamId)
+	}
+	sort.Strings(ids)
+
+	for _, streamId := range ids {
+		stream := streams[streamId]
+		if stream.MongoStatus != "enabled" && stream.MongoStatus != "disabled" && stream.MongoStatus != "completed" {
+			report(streamId, "has unknown status \""+stream.MongoStatus+"\"", func() error {
+				return app.DB.Streams.Update(streamId, bson.M{"status": "disabled"})
+			})
+		}
+		if _, ok := stored[streamId]; ok == false {
+			var forget func() error
+			if options.Forget {
+				forget = func() error {
+					return app.DB.Streams.Remove(streamId)
+				}
+			}
+			report(streamId, "has no data on disk", forget)
+			continue
+		}
+		_, journalErr := app.Store.Stat(streamId, "journal")
+		tmpFiles, _ := app.Store.ListDir(streamId, "tmp")
+		if journalErr == nil || len(tmpFiles) > 0 {
+			report(streamId, "has an interrupted write", func() error {
+				changes, err := app.Store.Recover(streamId)
+				for _, change := range changes {
+					log.Printf("Recovering stream %s, %s", streamId, change)
+				}
+				return err
+			})
+		}
+		if _, err := app.Store.Stat(streamId, STREAM_METADATA); err != nil {
+			report(streamId, "has no "+STREAM_METADATA, func() error {
+				return app.writeStreamMetadata(stream)
+			})
+		}
+		partitions, err := app.Store.ListPartitions(streamId)
+		if err != nil {
+			report(streamId, "cannot list partitions: "+err.Error(), nil)
+			continue
+		}
+		frames := 0
+		if len(partitions) > 0 {
+			frames = partitions[len(partitions)-1]
+		}
+		if frames != stream.Frames {
+			report(streamId, fmt.Sprintf("has %d frames in Mongo but %d on disk", stream.Frames, frames), func() error {
+				return app.DB.Streams.Update(streamId, bson.M{"frames": frames})
+			})
+		}
+	}
+
+	sort.Strings(storedIds)
+	for _, streamId := range storedIds {
+		if _, ok := streams[streamId]; ok {
+			continue
+		}
+		if options.Recreate {
+			stream, err := app.recreateStream(streamId)
+			if err == nil {
+				report(streamId, "is not in Mongo", func() error {
+					return app.DB.Streams.Insert(stream)
+				})
+				continue
+			}
+			if os.IsNotExist(err) {
+				log.Printf("Cannot recreate stream %s: it has no %s, it was lost before an SCV loaded it", streamId, STREAM_METADATA)
+			} else {
+				log.Printf("Cannot recreate stream %s: %s", streamId, err.Error())
+			}
+		}
+		report(streamId, "is not in Mongo", func() error {
+			dst, err := app.Store.QuarantineStream(streamId)
+			if err == nil {
+				log.Printf("Quarantined stream %s to %s", streamId, dst)
+			}
+			return err
+		})
+	}
+	return problems, nil
+}
+
+// Rebuild the document of a stream from its metadata file and partitions. The stream is disabled so
+// that it is only scheduled once someone checked it.
+func (app *Application) recreateStream(streamId string) (*Stream, error) {
+	file, err := app.Store.OpenFile(streamId, STREAM_METADATA)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	metadata := streamMetadata{}
+	if err = json.NewDecoder(file).Decode(&metadata); err != nil {
+		return nil, err
+	}
+	if metadata.TargetId == "" {
+		return nil, errors.New(STREAM_METADATA + " has no target")
+	}
+	partitions, err := app.Store.ListPartitions(streamId)
+	if err != nil {
+		return nil, err
+	}
+	frames := 0
+	if len(partitions) > 0 {
+		frames = partitions[len(partitions)-1]
+	}
+	stream := NewStream(streamId, metadata.TargetId, "", frames, 0, metadata.CreationDate)
+	stream.MongoStatus = "disabled"
+	return stream, nil
+}
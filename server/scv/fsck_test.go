@@ -0,0 +1,204 @@
+package scv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (f *Fixture) fsckStreams(options FsckOptions) map[string][]FsckProblem {
+	problems, err := f.app.Fsck(options)
+	if err != nil {
+		panic(err)
+	}
+	res := make(map[string][]FsckProblem)
+	for _, problem := range problems {
+		res[problem.StreamId] = append(res[problem.StreamId], problem)
+	}
+	return res
+}
+
+func TestFsckReport(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	token := f.addManager("yutong", 1)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+		"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	good, _ := f.postStream(token, jsonData)
+	lost, _ := f.postStream(token, jsonData)
+	drifted, _ := f.postStream(token, jsonData)
+	assert.Nil(t, f.app.Store.RemoveStream(lost))
+	assert.Nil(t, f.app.DB.Streams.Update(drifted, bson.M{"frames": 5}))
+	assert.Nil(t, f.app.Store.WriteSeed("orphan", "openmm", []byte("data")))
+
+	problems := f.fsckStreams(FsckOptions{})
+	assert.Equal(t, len(problems), 3)
+	assert.Equal(t, len(problems[good]), 0)
+	assert.Equal(t, problems[lost][0].Problem, "has no data on disk")
+	assert.Equal(t, problems[drifted][0].Problem, "has 5 frames in Mongo but 0 on disk")
+	assert.Equal(t, problems["orphan"][0].Problem, "is not in Mongo")
+	assert.False(t, problems["orphan"][0].Fixed)
+
+	// nothing was modified
+	assert.Equal(t, f.loadMongoStream(drifted)["frames"], 5)
+	_, err := f.app.Store.Stat("orphan", "files/openmm")
+	assert.Nil(t, err)
+
+	problems = f.fsckStreams(FsckOptions{Repair: true})
+	assert.Equal(t, len(problems), 3)
+	assert.False(t, problems[lost][0].Fixed)
+	assert.True(t, problems[drifted][0].Fixed)
+	assert.True(t, problems["orphan"][0].Fixed)
+	assert.Equal(t, f.loadMongoStream(drifted)["frames"], 0)
+	_, err = f.app.Store.Stat("orphan", "")
+	assert.NotNil(t, err)
+
+	problems = f.fsckStreams(FsckOptions{Repair: true})
+	assert.Equal(t, len(problems), 1)
+	assert.Equal(t, len(problems[lost]), 1)
+
+	problems = f.fsckStreams(FsckOptions{Repair: true, Forget: true})
+	assert.True(t, problems[lost][0].Fixed)
+	assert.Equal(t, len(f.loadMongoStream(lost)), 0)
+	assert.Equal(t, len(f.fsckStreams(FsckOptions{})), 0)
+
+	// deferred writes that were given up on are reported, and replayed with options.Replay
+	op := DeferredOp{Id: 1, Type: DEFERRED_STATUS, StreamId: good, Status: &StreamStatus{"disabled", 0},
+		Attempts: MAX_DEFERRED_ATTEMPTS, LastError: "no mongo"}
+	assert.Nil(t, f.app.deferred.save(filepath.Join(f.app.deferred.dir, "dead"), &op))
+	problems = f.fsckStreams(FsckOptions{Repair: true})
+	assert.Equal(t, problems[good][0].Problem, "has a deferred status that was given up on: no mongo")
+	assert.False(t, problems[good][0].Fixed)
+	assert.Equal(t, f.loadMongoStream(good)["status"], "enabled")
+	problems = f.fsckStreams(FsckOptions{Repair: true, Replay: true})
+	assert.True(t, problems[good][0].Fixed)
+	assert.Equal(t, f.loadMongoStream(good)["status"], "disabled")
+	assert.Equal(t, len(f.fsckStreams(FsckOptions{})), 0)
+}
+
+func TestFsckReplayOverwritten(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	token := f.addManager("yutong", 1)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+		"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	streamId, _ := f.postStream(token, jsonData)
+	// the stream was disabled and its errors counted while Mongo was down, then enabled again
+	// once it came back
+	dead := filepath.Join(f.app.deferred.dir, "dead")
+	status := DeferredOp{Id: 1, Type: DEFERRED_STATUS, StreamId: streamId, Status: &StreamStatus{"disabled", 3},
+		Attempts: MAX_DEFERRED_ATTEMPTS, LastError: "no mongo", Overwritten: []string{"status", "error_count"}}
+	update := DeferredOp{Id: 2, Type: DEFERRED_STREAM_UPDATE, StreamId: streamId,
+		Update:   &StreamUpdate{Frames: 0, ErrorCount: 3, Status: "disabled"},
+		Attempts: MAX_DEFERRED_ATTEMPTS, LastError: "no mongo", Overwritten: []string{"status", "error_count"}}
+	assert.Nil(t, f.app.deferred.save(dead, &status))
+	assert.Nil(t, f.app.deferred.save(dead, &update))
+	assert.Nil(t, f.app.DB.Streams.Update(streamId, bson.M{"status": "enabled", "error_count": 0, "frames": 0}))
+
+	problems := f.fsckStreams(FsckOptions{Repair: true, Replay: true})
+	assert.Equal(t, len(problems[streamId]), 2)
+	assert.Equal(t, problems[streamId][0].Problem, "has a deferred status that was given up on: no mongo, superseded by later writes")
+	assert.True(t, problems[streamId][0].Fixed)
+	assert.Equal(t, problems[streamId][1].Problem, "has a deferred stream_update that was given up on: no mongo")
+	assert.True(t, problems[streamId][1].Fixed)
+	// only the fields that nothing set since are replayed
+	mongoStream := f.loadMongoStream(streamId)
+	assert.Equal(t, mongoStream["status"], "enabled")
+	assert.Equal(t, mongoStream["error_count"], 0)
+	assert.Equal(t, len(f.fsckStreams(FsckOptions{})), 0)
+}
+
+func TestFsckRecreate(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	token := f.addManager("yutong", 1)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+		"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	streamId, _ := f.postStream(token, jsonData)
+	// a stream that was created before metadata files existed
+	oldId, _ := f.postStream(token, jsonData)
+	assert.Nil(t, f.app.Store.Remove(oldId, STREAM_METADATA))
+	assert.Nil(t, f.app.DB.Streams.Remove(streamId))
+	assert.Nil(t, f.app.DB.Streams.Remove(oldId))
+
+	problems := f.fsckStreams(FsckOptions{Repair: true, Recreate: true})
+	assert.Equal(t, len(problems), 2)
+	assert.True(t, problems[streamId][0].Fixed)
+	assert.True(t, problems[oldId][0].Fixed)
+	mongoStream := f.loadMongoStream(streamId)
+	assert.Equal(t, mongoStream["target_id"], "12345")
+	assert.Equal(t, mongoStream["status"], "disabled")
+	// without metadata the stream can only be quarantined
+	_, err := f.app.Store.Stat(oldId, "")
+	assert.NotNil(t, err)
+
+	count, _ := f.app.DB.Streams.Count()
+	assert.Equal(t, count, 1)
+	assert.Equal(t, len(f.fsckStreams(FsckOptions{})), 0)
+
+	// streams created before metadata files existed get one once they are loaded
+	assert.Nil(t, f.app.Store.Remove(streamId, STREAM_METADATA))
+	f.resetManager()
+	f.app.LoadStreams()
+	assert.Nil(t, f.app.DB.Streams.Remove(streamId))
+	problems = f.fsckStreams(FsckOptions{Repair: true, Recreate: true})
+	assert.True(t, problems[streamId][0].Fixed)
+	assert.Equal(t, f.loadMongoStream(streamId)["target_id"], "12345")
+}
+
+func TestFsckReadOnly(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fsck")
+	defer os.RemoveAll(dir)
+	config := Configuration{Name: filepath.Join(dir, "scv"), Database: "embedded"}
+	app := NewApplication(config)
+	go app.RecordDeferredDocs()
+	assert.Nil(t, app.DB.Streams.Insert(NewStream("s1", "12345", "yutong", 0, 0, 0)))
+	assert.Nil(t, app.Store.WriteFile("orphan", "output.txt", []byte("blah")))
+	// left by a previous run
+	upload := filepath.Join(app.uploadDir(), "upload1", "part1")
+	assert.Nil(t, makeDir(filepath.Dir(upload)))
+	assert.Nil(t, ioutil.WriteFile(upload, []byte("part"), 0644))
+	tmp := filepath.Join(config.Name+"_data", "deferred", "1.json.tmp")
+	assert.Nil(t, makeDir(filepath.Dir(tmp)))
+	assert.Nil(t, ioutil.WriteFile(tmp, []byte("{"), 0644))
+	// nothing else may use the data while the SCV does
+	assert.Panics(t, func() { NewReadOnlyApplication(config) })
+	assert.Panics(t, func() { NewApplication(config) })
+	app.Shutdown()
+	metadata, err := ioutil.ReadFile(EmbeddedPath(config))
+	assert.Nil(t, err)
+
+	ro := NewReadOnlyApplication(config)
+	defer ro.Shutdown()
+	assert.Panics(t, func() { NewApplication(config) })
+	// several reports may run at once
+	other := NewReadOnlyApplication(config)
+	other.Shutdown()
+	problems, err := ro.Fsck(FsckOptions{})
+	assert.Nil(t, err)
+	reported := make(map[string]bool)
+	for _, problem := range problems {
+		reported[problem.StreamId] = true
+	}
+	assert.True(t, reported["s1"])
+	assert.True(t, reported["orphan"])
+	_, err = ro.Fsck(FsckOptions{Repair: true})
+	assert.NotNil(t, err)
+
+	_, err = ro.Store.Stat("orphan", "output.txt")
+	assert.Nil(t, err)
+	_, err = os.Stat(upload)
+	assert.Nil(t, err)
+	_, err = os.Stat(tmp)
+	assert.Nil(t, err)
+	after, err := ioutil.ReadFile(EmbeddedPath(config))
+	assert.Nil(t, err)
+	assert.Equal(t, after, metadata)
+}
@@ -15,10 +15,14 @@ var _ = fmt.Printf
 const MAX_STREAM_FAILS int = 50
 const STREAM_EXPIRATION_TIME int = 1200
 
+// Returned by ActivateStream when the target has streams, but none that the requesting engine may run.
+var ErrNoCompatibleStreams = errors.New("no compatible streams")
+
 type Injector interface {
 	DeactivateStreamService(*Stream) error // need to finish fast
 	DisableStreamService(*Stream) error    // need to finish fast
 	EnableStreamService(*Stream) error
+	TargetOptionsService(targetId string) (TargetOptions, error) // called when a target is created or reloaded
 }
 
 // The mutex in Manager makes guarantees about the state of the system:
@@ -28,9 +32,10 @@ type Injector interface {
 // 4. A target exists in the target map if and only if one or more of its streams exists in the streams map.
 type Manager struct {
 	sync.RWMutex
-	targets        map[string]*Target // map of targetId to Target
-	streams        map[string]*Stream // map of streamId to Stream
-	tokens         map[string]*Stream // map of tokens to Stream
+	targets        map[string]*Target  // map of targetId to Target
+	streams        map[string]*Stream  // map of streamId to Stream
+	tokens         map[string]*Stream  // map of tokens to Stream
+	reserved       map[string]struct{} // ids of streams whose files are being written or removed
 	injector       Injector
 	expirationTime int
 }
@@ -40,6 +45,7 @@ func NewManager(inj Injector) *Manager {
 		targets:        make(map[string]*Target),
 		streams:        make(map[string]*Stream),
 		tokens:         make(map[string]*Stream),
+		reserved:       make(map[string]struct{}),
 		injector:       inj,
 		expirationTime: STREAM_EXPIRATION_TIME,
 	}
@@ -61,9 +67,10 @@ func parseToken(token string) string {
 
 /*
 Add a stream to the manager. If the stream exists, then nothing happens. Otherwise, if the target does not exist, a target
-is created for this stream. It is assumed that the respective persistent structures (dbs, files) for this
+is created for this stream with the options given by the injector, and the stream is not added if they can not be loaded.
+Streams whose MongoStatus is "completed" are added as completed regardless of enabled. It is assumed that the respective persistent structures (dbs, files) for this
 stream has already been created and ready to go. It is assumed that while AddStream is called, no other goroutine is manipulating
-this particular stream pointer.
+this particular stream pointer. A reservation of the stream id made with ReserveStream is released.
 */
 func (m *Manager) AddStream(stream *Stream, targetId string, enabled bool) error {
 	m.Lock()
@@ -72,14 +79,40 @@ func (m *Manager) AddStream(stream *Stream, targetId string, enabled bool) error
 	if ok == true {
 		return errors.New("stream " + stream.StreamId + " already exists")
 	}
-	m.streams[stream.StreamId] = stream
 	_, ok = m.targets[targetId]
 	if ok == false {
-		m.targets[targetId] = NewTarget()
+		// the injector may have to query Mongo, so the manager is not locked in the meantime
+		m.Unlock()
+		options, err := m.injector.TargetOptionsService(targetId)
+		m.Lock()
+		if err != nil {
+			return errors.New("cannot load options of target " + targetId + ": " + err.Error())
+		}
+		if _, ok = m.streams[stream.StreamId]; ok == true {
+			return errors.New("stream " + stream.StreamId + " already exists")
+		}
+		// another stream may have created the target in the meantime
+		if _, ok = m.targets[targetId]; ok == false {
+			if options.Owner == "" {
+				options.Owner = stream.Owner
+			}
+			m.targets[targetId] = NewTarget(targetId, options)
+		}
 	}
+	delete(m.reserved, stream.StreamId)
+	m.streams[stream.StreamId] = stream
 	t := m.targets[targetId]
-	if enabled {
+	if len(stream.Engines) > 0 {
+		t.restrictedStreams++
+	}
+	if stream.idleSince == 0 {
+		stream.idleSince = time.Now().UnixNano()
+	}
+	if stream.MongoStatus == "completed" {
+		t.completedStreams[stream] = struct{}{}
+	} else if enabled {
 		t.inactiveStreams.Add(stream)
+		m.notifyWaiters(t)
 	} else {
 		t.disabledStreams[stream] = struct{}{}
 	}
@@ -102,21 +135,142 @@ func (m *Manager) RemoveStream(streamId, user string) error {
 		return errors.New(user + " does not own stream " + streamId)
 	}
 	t := m.targets[stream.TargetId]
+	if err := m.checkBusy(stream, t); err != nil {
+		return err
+	}
 	stream.Lock()
 	defer stream.Unlock()
-	delete(m.streams, streamId)
+	m.removeStreamImpl(stream, t)
+	return nil
+}
+
+// Assumes that the manager and the stream are locked.
+func (m *Manager) removeStreamImpl(stream *Stream, t *Target) {
+	delete(m.streams, stream.StreamId)
 	if stream.activeStream != nil {
 		m.deactivateStreamImpl(stream, t)
 	}
 	// this is no longer a state transfer but a complete deletion
 	t.inactiveStreams.Remove(stream)
 	delete(t.disabledStreams, stream)
-	if len(t.activeStreams) == 0 && t.inactiveStreams.Len() == 0 && len(t.disabledStreams) == 0 {
+	delete(t.completedStreams, stream)
+	delete(t.busyStreams, stream)
+	if len(stream.Engines) > 0 {
+		t.restrictedStreams--
+	}
+	if len(t.activeStreams) == 0 && t.inactiveStreams.Len() == 0 && len(t.disabledStreams) == 0 && len(t.completedStreams) == 0 && len(t.busyStreams) == 0 {
+		m.dropWaiters(t)
 		delete(m.targets, stream.TargetId)
 	}
+}
+
+// A stream marked busy by HoldStream.
+type HeldStream struct {
+	stream *Stream
+	t      *Target
+	state  idleState
+}
+
+// Mark a stream of user that is not active busy until it is released with Unhold or removed with
+// RemoveHeldStream, so that it is neither activated nor changed by other handlers while the caller
+// works on it without holding its lock, eg. while it is sent to another SCV. Unlike
+// ModifyInactiveStream, the caller may read the stream with ReadStream in the meantime.
+func (m *Manager) HoldStream(streamId, user string) (*HeldStream, error) {
+	m.Lock()
+	defer m.Unlock()
+	stream, t, state, err := m.markBusy(streamId, user)
+	if err != nil {
+		return nil, err
+	}
+	return &HeldStream{stream, t, state}, nil
+}
+
+// Move a held stream back into the state it was held in.
+func (m *Manager) Unhold(held *HeldStream) {
+	m.Lock()
+	defer m.Unlock()
+	held.stream.Lock()
+	defer held.stream.Unlock()
+	m.unmarkBusy(held.stream, held.t, held.state)
+}
+
+// Like RemoveStream, for a held stream.
+func (m *Manager) RemoveHeldStream(held *HeldStream) {
+	m.Lock()
+	defer m.Unlock()
+	held.stream.Lock()
+	defer held.stream.Unlock()
+	m.removeStreamImpl(held.stream, held.t)
+}
+
+// The options of a target, as loaded when it was created or last reloaded.
+func (m *Manager) TargetOptions(targetId string) (TargetOptions, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	t, ok := m.targets[targetId]
+	if ok == false {
+		return TargetOptions{}, false
+	}
+	return t.options, true
+}
+
+// Load the options of every target again, so that changes apply without a restart. The manager is
+// not locked while they are loaded, and targets whose options can not be loaded keep their current
+// ones. Returns the options of the targets that were reloaded.
+func (m *Manager) ReloadTargetOptions() map[string]TargetOptions {
+	m.RLock()
+	targetIds := make([]string, 0, len(m.targets))
+	for targetId := range m.targets {
+		targetIds = append(targetIds, targetId)
+	}
+	m.RUnlock()
+	loaded := make(map[string]TargetOptions)
+	for _, targetId := range targetIds {
+		if options, err := m.injector.TargetOptionsService(targetId); err == nil {
+			loaded[targetId] = options
+		}
+	}
+	m.Lock()
+	defer m.Unlock()
+	for targetId, options := range loaded {
+		t, ok := m.targets[targetId]
+		if ok == false {
+			delete(loaded, targetId)
+			continue
+		}
+		if options.Owner == "" {
+			options.Owner = t.options.Owner
+		}
+		t.setOptions(options)
+		loaded[targetId] = options
+	}
+	return loaded
+}
+
+/*
+Reserve the id of a stream that is not in the manager, so that its files can be written or removed
+without holding the manager lock. Fails if the stream exists or is already reserved. The reservation
+ends with AddStream or ReleaseStream.
+*/
+func (m *Manager) ReserveStream(streamId string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.streams[streamId]; ok {
+		return errors.New("stream " + streamId + " already exists")
+	}
+	if _, ok := m.reserved[streamId]; ok {
+		return errors.New("stream " + streamId + " is in use")
+	}
+	m.reserved[streamId] = struct{}{}
 	return nil
 }
 
+func (m *Manager) ReleaseStream(streamId string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.reserved, streamId)
+}
+
 func (m *Manager) stateTransfer(s *Stream, src interface{}, dst interface{}) {
 
 	// invariant:
@@ -124,10 +278,18 @@ func (m *Manager) stateTransfer(s *Stream, src interface{}, dst interface{}) {
 	a := m.targets[s.TargetId].inactiveStreams.Contains(s)
 	_, b := m.targets[s.TargetId].activeStreams[s]
 	_, c := m.targets[s.TargetId].disabledStreams[s]
+	_, d := m.targets[s.TargetId].completedStreams[s]
+	_, e := m.targets[s.TargetId].busyStreams[s]
 
-	// ensure that the stream must be in one of these states
-	if ((a != b != c) && !(a && b && c)) == false {
-		panic(fmt.Sprintf("stream state machine failed! a:%v, b:%v, c:%v", a, b, c))
+	// ensure that the stream must be in exactly one of these states
+	count := 0
+	for _, state := range []bool{a, b, c, d, e} {
+		if state {
+			count += 1
+		}
+	}
+	if count != 1 {
+		panic(fmt.Sprintf("stream state machine failed! a:%v, b:%v, c:%v, d:%v, e:%v", a, b, c, d, e))
 	}
 
 	switch v := src.(type) {
@@ -144,6 +306,69 @@ func (m *Manager) stateTransfer(s *Stream, src interface{}, dst interface{}) {
 	}
 }
 
+// Operations that change the state of an inactive stream are refused while TruncateStream or
+// ModifyInactiveStream work on it, rather than waiting for its lock with the manager locked. Assumes
+// that the manager is locked.
+func (m *Manager) checkBusy(stream *Stream, t *Target) error {
+	if _, ok := t.busyStreams[stream]; ok {
+		return errors.New("stream " + stream.StreamId + " is busy")
+	}
+	return nil
+}
+
+// States a stream that is not active can be in, see markBusy.
+type idleState int
+
+const (
+	idleInactive idleState = iota
+	idleDisabled
+	idleCompleted
+)
+
+// Move a stream of user that is not active into the busy state, so that its lock can be held without
+// the manager's. Returns the state to move it back to with unmarkBusy. Assumes that the manager is
+// locked.
+func (m *Manager) markBusy(streamId, user string) (*Stream, *Target, idleState, error) {
+	stream, ok := m.streams[streamId]
+	if ok == false {
+		return nil, nil, idleInactive, errors.New("stream " + streamId + " does not exist")
+	}
+	if user != stream.Owner {
+		return nil, nil, idleInactive, errors.New("you do not own this stream.")
+	}
+	t := m.targets[stream.TargetId]
+	if err := m.checkBusy(stream, t); err != nil {
+		return nil, nil, idleInactive, err
+	}
+	// the stream is not locked, but it can only be activated with the manager locked
+	if stream.activeStream != nil {
+		return nil, nil, idleInactive, errors.New("stream " + streamId + " is active")
+	}
+	if _, isDisabled := t.disabledStreams[stream]; isDisabled {
+		m.stateTransfer(stream, t.disabledStreams, t.busyStreams)
+		return stream, t, idleDisabled, nil
+	}
+	if _, isCompleted := t.completedStreams[stream]; isCompleted {
+		m.stateTransfer(stream, t.completedStreams, t.busyStreams)
+		return stream, t, idleCompleted, nil
+	}
+	m.stateTransfer(stream, t.inactiveStreams, t.busyStreams)
+	return stream, t, idleInactive, nil
+}
+
+// Move a busy stream back into state. Assumes that the manager and the stream are locked.
+func (m *Manager) unmarkBusy(stream *Stream, t *Target, state idleState) {
+	switch state {
+	case idleDisabled:
+		m.stateTransfer(stream, t.busyStreams, t.disabledStreams)
+	case idleCompleted:
+		m.stateTransfer(stream, t.busyStreams, t.completedStreams)
+	default:
+		m.stateTransfer(stream, t.busyStreams, t.inactiveStreams)
+		m.notifyWaiters(t)
+	}
+}
+
 // Remove the stream from the active queue. Assumes that locks are in place for target and stream.
 // If this function returns true, you are expected to call the corresponding injector.DeactivateStreamService()
 func (m *Manager) deactivateStreamImpl(s *Stream, t *Target) {
@@ -152,6 +377,7 @@ func (m *Manager) deactivateStreamImpl(s *Stream, t *Target) {
 		s.activeStream.timer.Stop()
 		m.injector.DeactivateStreamService(s)
 		s.activeStream = nil
+		s.idleSince = time.Now().UnixNano()
 		m.stateTransfer(s, t.activeStreams, t.inactiveStreams)
 	} else {
 		panic("tried to deactivate an non-active stream")
@@ -168,6 +394,44 @@ func (m *Manager) disableStreamImpl(stream *Stream, t *Target) {
 	m.stateTransfer(stream, t.inactiveStreams, t.disabledStreams)
 }
 
+// Move a stream that was just deactivated into the terminal completed state. Assumes that locks are in
+// place for target and stream.
+func (m *Manager) completeStreamImpl(stream *Stream, t *Target) {
+	stream.MongoStatus = "completed"
+	m.stateTransfer(stream, t.inactiveStreams, t.completedStreams)
+}
+
+// Returns true if the stream has reached the max_frames of itself or its target.
+func (m *Manager) reachedMaxFrames(stream *Stream, t *Target) bool {
+	maxFrames := t.options.MaxFrames
+	if stream.MaxFrames > 0 {
+		maxFrames = stream.MaxFrames
+	}
+	return maxFrames > 0 && stream.Frames >= maxFrames
+}
+
+// Complete the active stream if it has reached its max_frames. The stream is deactivated and its
+// token becomes invalid. Returns true if the stream was completed.
+func (m *Manager) CheckCompletion(token string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	stream, ok := m.tokens[token]
+	if ok == false {
+		return false, errors.New("invalid token: " + token)
+	}
+	t := m.targets[stream.TargetId]
+	stream.Lock()
+	defer stream.Unlock()
+	if m.reachedMaxFrames(stream, t) == false {
+		return false, nil
+	}
+	// set the status first so DeactivateStreamService persists it
+	stream.MongoStatus = "completed"
+	m.deactivateStreamImpl(stream, t)
+	m.completeStreamImpl(stream, t)
+	return true, nil
+}
+
 // Idempotent, does nothing if stream is already disabled. The stream service is still called!
 func (m *Manager) DisableStream(streamId, user string) error {
 	m.Lock()
@@ -176,16 +440,26 @@ func (m *Manager) DisableStream(streamId, user string) error {
 		m.Unlock()
 		return errors.New("stream " + streamId + " does not exist")
 	}
+	t := m.targets[stream.TargetId]
+	if err := m.checkBusy(stream, t); err != nil {
+		m.Unlock()
+		return err
+	}
 	stream.Lock()
 	defer stream.Unlock()
 	if user != stream.Owner {
 		m.Unlock()
 		return errors.New("you do not own this stream.")
 	}
-	t := m.targets[stream.TargetId]
-	// state transfers to inactive if the stream is active
+	if _, isCompleted := t.completedStreams[stream]; isCompleted {
+		m.Unlock()
+		return errors.New("stream " + streamId + " is completed")
+	}
+	// state transfers to inactive if the stream is active, the status is set first so that
+	// DeactivateStreamService persists it
 	isActive := (stream.activeStream != nil)
 	if isActive {
+		stream.MongoStatus = "disabled"
 		m.deactivateStreamImpl(stream, t)
 	}
 	// state transfer from inactive to disabled
@@ -201,13 +475,21 @@ func (m *Manager) EnableStream(streamId, user string) error {
 		m.Unlock()
 		return errors.New("stream " + streamId + " does not exist")
 	}
+	t := m.targets[stream.TargetId]
+	if err := m.checkBusy(stream, t); err != nil {
+		m.Unlock()
+		return err
+	}
 	stream.Lock()
 	defer stream.Unlock()
 	if user != stream.Owner {
 		m.Unlock()
 		return errors.New("you do not own this stream.")
 	}
-	t := m.targets[stream.TargetId]
+	if _, isCompleted := t.completedStreams[stream]; isCompleted {
+		m.Unlock()
+		return errors.New("stream " + streamId + " is completed")
+	}
 	_, isActive := t.activeStreams[stream]
 	isInactive := t.inactiveStreams.Contains(stream)
 	if isActive || isInactive {
@@ -215,6 +497,7 @@ func (m *Manager) EnableStream(streamId, user string) error {
 		return m.injector.EnableStreamService(stream)
 	}
 	m.stateTransfer(stream, t.disabledStreams, t.inactiveStreams)
+	m.notifyWaiters(t)
 	m.Unlock()
 	return m.injector.EnableStreamService(stream)
 }
@@ -245,6 +528,89 @@ func (m *Manager) ModifyStream(streamId string, fn func(*Stream) error) error {
 	return fn(stream)
 }
 
+// Like ModifyStream, but fn is also allowed to change the fields that determine the order of
+// the target's inactive queue (eg. Frames or Priority). The stream is taken out of the queue
+// while fn runs and put back afterwards, even if fn fails.
+func (m *Manager) ModifyStreamOrdering(streamId, user string, fn func(*Stream) error) error {
+	m.Lock()
+	defer m.Unlock()
+	stream, ok := m.streams[streamId]
+	if ok == false {
+		return errors.New("stream " + streamId + " does not exist")
+	}
+	if user != stream.Owner {
+		return errors.New("you do not own this stream.")
+	}
+	t := m.targets[stream.TargetId]
+	if err := m.checkBusy(stream, t); err != nil {
+		return err
+	}
+	stream.Lock()
+	defer stream.Unlock()
+	queued := t.inactiveStreams.Remove(stream)
+	err := fn(stream)
+	if queued {
+		t.inactiveStreams.Add(stream)
+	}
+	return err
+}
+
+// Like ModifyStream, but checks ownership and refuses active streams. The manager is not locked while
+// fn runs, the stream is busy instead so that it can not be activated or changed in the meantime.
+func (m *Manager) ModifyInactiveStream(streamId, user string, fn func(*Stream) error) error {
+	m.Lock()
+	stream, t, state, err := m.markBusy(streamId, user)
+	if err != nil {
+		m.Unlock()
+		return err
+	}
+	stream.Lock()
+	m.Unlock()
+	err = fn(stream)
+	stream.Unlock()
+
+	// the stream can not have been removed in the meantime, and so neither can its target
+	m.Lock()
+	stream.Lock()
+	m.unmarkBusy(stream, t, state)
+	stream.Unlock()
+	m.Unlock()
+	return err
+}
+
+// Roll an inactive stream back, fn is expected to remove the partitions from disk and set the new
+// Frames. Active streams are refused since their core would keep writing to the removed partitions.
+// A completed stream that falls below its max_frames is disabled, and must be started again explicitly.
+// Like ModifyInactiveStream, the manager is not locked while fn runs.
+func (m *Manager) TruncateStream(streamId, user string, fn func(*Stream) error) error {
+	m.Lock()
+	stream, t, state, err := m.markBusy(streamId, user)
+	if err != nil {
+		m.Unlock()
+		return err
+	}
+	stream.Lock()
+	m.Unlock()
+	err = fn(stream)
+	stream.Unlock()
+
+	m.Lock()
+	stream.Lock()
+	defer stream.Unlock()
+	disable := state == idleCompleted && err == nil && m.reachedMaxFrames(stream, t) == false
+	if disable {
+		stream.MongoStatus = "disabled"
+		m.stateTransfer(stream, t.busyStreams, t.disabledStreams)
+	} else {
+		m.unmarkBusy(stream, t, state)
+	}
+	m.Unlock()
+	if disable {
+		return m.injector.DisableStreamService(stream)
+	}
+	return err
+}
+
 func (m *Manager) ModifyActiveStream(token string, fn func(*Stream) error) error {
 	m.RLock()
 	stream, ok := m.tokens[token]
@@ -271,36 +637,169 @@ func (m *Manager) ResetActiveStream(token string) error {
 	return nil
 }
 
+// Activate the next stream of the target and move it to the active set. Assumes that the manager is locked.
+func (m *Manager) activateStreamImpl(stream *Stream, t *Target, user, engine string) (token string) {
+	token = createToken(stream.TargetId)
+	m.stateTransfer(stream, t.inactiveStreams, t.activeStreams)
+	t.activations += 1
+	stream.activationSeq = t.activations
+	stream.activeStream = NewActiveStream(user, token, engine)
+	m.tokens[token] = stream
+	stream.activeStream.timer = time.AfterFunc(time.Second*time.Duration(m.expirationTime), func() {
+		m.DeactivateStream(token, 0)
+	})
+	return
+}
+
+// Hand inactive streams to the callers blocked in ActivateStreamWait, oldest caller first.
+// Must be called with the manager locked whenever a stream may have entered the inactive queue.
+func (m *Manager) notifyWaiters(t *Target) {
+	for e := t.waiters.Front(); e != nil && t.inactiveStreams.Len() > 0; {
+		next := e.Next()
+		w := e.Value.(*activationWaiter)
+		// waiters whose engine cannot run any of the streams keep their place in line
+		if stream := t.nextStream(w.engine); stream != nil {
+			t.waiters.Remove(e)
+			w.ready <- activation{stream, m.activateStreamImpl(stream, t, w.user, w.engine)}
+		}
+		e = next
+	}
+}
+
+// Wake up every caller blocked on the target without handing them a stream, used when the target is removed.
+func (m *Manager) dropWaiters(t *Target) {
+	for t.waiters.Len() > 0 {
+		w := t.waiters.Remove(t.waiters.Front()).(*activationWaiter)
+		w.ready <- activation{}
+	}
+}
+
+// Pick a target for an activation that did not ask for one. Owners (managers) are served in proportion
+// to their weight, and each owner's targets in proportion to the target weights, based on the number
+// of streams that are currently active. Only targets with inactive streams the engine can run are
+// considered. Assumes that the manager is locked.
+func (m *Manager) pickTarget(engine string) (*Target, error) {
+	ownerActive := make(map[string]int)
+	for _, t := range m.targets {
+		ownerActive[t.options.Owner] += len(t.activeStreams)
+	}
+	var best *Target
+	var bestOwner, bestTarget float64
+	hasStreams := false
+	for _, t := range m.targets {
+		if t.inactiveStreams.Len() == 0 {
+			continue
+		}
+		hasStreams = true
+		if t.acceptsEngine(engine) == false || t.nextStream(engine) == nil {
+			continue
+		}
+		owner := fairShare(ownerActive[t.options.Owner], t.options.OwnerWeight)
+		target := fairShare(len(t.activeStreams), t.options.Weight)
+		if best == nil || owner < bestOwner ||
+			(owner == bestOwner && (target < bestTarget || (target == bestTarget && t.targetId < best.targetId))) {
+			best, bestOwner, bestTarget = t, owner, target
+		}
+	}
+	if best == nil {
+		if hasStreams {
+			return nil, ErrNoCompatibleStreams
+		}
+		return nil, errors.New("No targets have streams")
+	}
+	return best, nil
+}
+
 func (m *Manager) ActivateStream(targetId, user, engine string, fn func(*Stream) error) (token string, streamId string, err error) {
+	return m.ActivateStreamWait(targetId, user, engine, 0, fn)
+}
+
+// Same as ActivateStream, but if the target has no inactive streams the engine may run, the caller
+// blocks for up to wait until one becomes available. Callers waiting on the same target are served in
+// FIFO order among those whose engine may run the stream. Streams with engine requirements of their
+// own (Stream.Engines) are only handed to engines that meet them.
+// If targetId is empty, a target is picked with pickTarget and wait is ignored.
+func (m *Manager) ActivateStreamWait(targetId, user, engine string, wait time.Duration, fn func(*Stream) error) (token string, streamId string, err error) {
 	m.Lock()
 
-	t, ok := m.targets[targetId]
-	if ok == false {
+	var t *Target
+	if targetId == "" {
+		t, err = m.pickTarget(engine)
+		if err != nil {
+			m.Unlock()
+			return
+		}
+	} else {
+		var ok bool
+		t, ok = m.targets[targetId]
+		if ok == false {
+			m.Unlock()
+			err = errors.New("Target does not exist")
+			return
+		}
+	}
+	if t.acceptsEngine(engine) == false {
 		m.Unlock()
-		err = errors.New("Target does not exist")
+		err = ErrNoCompatibleStreams
 		return
 	}
-	iterator := t.inactiveStreams.Iterator()
-	ok = iterator.Next()
-	if ok == false {
+	stream := t.nextStream(engine)
+	if stream != nil {
+		token = m.activateStreamImpl(stream, t, user, engine)
+		streamId = stream.StreamId
+		stream.Lock()
+		defer stream.Unlock()
 		m.Unlock()
-		err = errors.New("Target does not have streams")
+		err = fn(stream)
+		return
+	}
+	if wait <= 0 {
+		m.Unlock()
+		if t.inactiveStreams.Len() > 0 {
+			err = ErrNoCompatibleStreams
+		} else {
+			err = errors.New("Target does not have streams")
+		}
 		return
 	}
-	token = createToken(targetId)
-	stream := iterator.Key().(*Stream)
-	streamId = stream.StreamId
-	m.stateTransfer(stream, t.inactiveStreams, t.activeStreams)
-	stream.activeStream = NewActiveStream(user, token, engine)
-	m.tokens[token] = stream
-	stream.activeStream.timer = time.AfterFunc(time.Second*time.Duration(m.expirationTime), func() {
-		m.DeactivateStream(token, 0)
-	})
 
-	stream.Lock()
-	defer stream.Unlock()
+	w := &activationWaiter{
+		user:   user,
+		engine: engine,
+		ready:  make(chan activation, 1),
+	}
+	ele := t.waiters.PushBack(w)
 	m.Unlock()
-	err = fn(stream)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var a activation
+	select {
+	case a = <-w.ready:
+	case <-timer.C:
+		m.Lock()
+		select {
+		case a = <-w.ready:
+			// a stream was handed over while we were acquiring the lock
+		default:
+			t.waiters.Remove(ele)
+		}
+		m.Unlock()
+	}
+	if a.stream == nil {
+		err = errors.New("Target does not have streams")
+		return
+	}
+	a.stream.Lock()
+	defer a.stream.Unlock()
+	// the stream may have been deactivated or removed before we got hold of it
+	if a.stream.activeStream == nil || a.stream.activeStream.authToken != a.token {
+		err = errors.New("Stream was deactivated before it could be started")
+		return
+	}
+	token = a.token
+	streamId = a.stream.StreamId
+	err = fn(a.stream)
 	return
 }
 
@@ -315,11 +814,17 @@ func (m *Manager) DeactivateStream(token string, error_count int) error {
 	stream.Lock()
 	defer stream.Unlock()
 	stream.ErrorCount += error_count
+	if m.reachedMaxFrames(stream, t) {
+		stream.MongoStatus = "completed"
+	}
 	m.deactivateStreamImpl(stream, t)
-	if stream.ErrorCount >= MAX_STREAM_FAILS {
+	if stream.MongoStatus == "completed" {
+		m.completeStreamImpl(stream, t)
+	} else if stream.ErrorCount >= MAX_STREAM_FAILS {
 		m.disableStreamImpl(stream, t)
 		// we don't need to call DisableStreamService because DeactivateStreamService takes care of it.
 	}
+	m.notifyWaiters(t)
 	m.Unlock()
 	return nil
 }
@@ -4,8 +4,10 @@ import (
 	//"time"
 	"../util"
 	// "sort"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"sync"
 	// "sync/atomic"
 	"testing"
@@ -32,8 +34,55 @@ func (m *mockInterface) EnableStreamService(s *Stream) error {
 	return nil
 }
 
+func (m *mockInterface) TargetOptionsService(targetId string) (TargetOptions, error) {
+	return TargetOptions{}, nil
+}
+
 var intf = &mockInterface{}
 
+// mockInterface that hands out the same options for every target, unless they are listed in targets
+type mockOptionsInterface struct {
+	mockInterface
+	options TargetOptions
+	targets map[string]TargetOptions
+}
+
+func (m *mockOptionsInterface) TargetOptionsService(targetId string) (TargetOptions, error) {
+	if options, ok := m.targets[targetId]; ok {
+		return options, nil
+	}
+	return m.options, nil
+}
+
+// mockInterface whose options can not be loaded, until fail is cleared
+type mockFailingInterface struct {
+	mockInterface
+	fail bool
+}
+
+func (m *mockFailingInterface) TargetOptionsService(targetId string) (TargetOptions, error) {
+	if m.fail {
+		return TargetOptions{}, errors.New("no reachable servers")
+	}
+	return TargetOptions{MaxFrames: 10}, nil
+}
+
+func TestAddStreamOptionsError(t *testing.T) {
+	inj := &mockFailingInterface{fail: true}
+	m := NewManager(inj)
+	targetId := util.RandSeq(5)
+	stream := NewStream("a", targetId, "none", 0, 0, int(time.Now().Unix()))
+	assert.NotNil(t, m.AddStream(stream, targetId, true))
+	assert.Equal(t, len(m.targets), 0)
+	assert.Equal(t, len(m.streams), 0)
+	inj.fail = false
+	assert.Nil(t, m.AddStream(stream, targetId, true))
+	assert.Equal(t, m.targets[targetId].options.MaxFrames, 10)
+	// options are only loaded once per target
+	inj.fail = true
+	assert.Nil(t, m.AddStream(NewStream("b", targetId, "none", 0, 0, int(time.Now().Unix())), targetId, true))
+}
+
 func TestAddSameStream(t *testing.T) {
 	m := NewManager(intf)
 	targetId := util.RandSeq(36)
@@ -328,6 +377,586 @@ func TestActivateEmptyTarget(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestUnknownSchedulingPolicy(t *testing.T) {
+	_, err := NewSchedulingPolicy("bogus")
+	assert.NotNil(t, err)
+	m := NewManager(&mockOptionsInterface{options: TargetOptions{Scheduling: "bogus"}})
+	targetId := util.RandSeq(5)
+	stream := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	assert.Nil(t, m.AddStream(stream, targetId, true))
+	assert.Equal(t, m.targets[targetId].policy, mostFramesPolicy{})
+}
+
+func TestFewestFramesPolicy(t *testing.T) {
+	m := NewManager(&mockOptionsInterface{options: TargetOptions{Scheduling: "fewest_frames"}})
+	numStreams := 5
+	targetId := util.RandSeq(5)
+	for i := numStreams - 1; i >= 0; i-- {
+		stream := NewStream(util.RandSeq(5), targetId, "none", i, 0, int(time.Now().Unix()))
+		m.AddStream(stream, targetId, true)
+	}
+	for i := 0; i < numStreams; i++ {
+		_, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, m.streams[streamId].Frames, i)
+	}
+}
+
+func TestRoundRobinPolicy(t *testing.T) {
+	m := NewManager(&mockOptionsInterface{options: TargetOptions{Scheduling: "round_robin"}})
+	numStreams := 3
+	targetId := util.RandSeq(5)
+	for i := 0; i < numStreams; i++ {
+		stream := NewStream(util.RandSeq(5), targetId, "none", i, 0, int(time.Now().Unix()))
+		m.AddStream(stream, targetId, true)
+	}
+	order := make([]string, 0)
+	for i := 0; i < 3*numStreams; i++ {
+		token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Nil(t, m.DeactivateStream(token, 0))
+		order = append(order, streamId)
+	}
+	for i := numStreams; i < len(order); i++ {
+		assert.Equal(t, order[i], order[i-numStreams])
+	}
+	assert.NotEqual(t, order[0], order[1])
+	assert.NotEqual(t, order[1], order[2])
+	assert.NotEqual(t, order[0], order[2])
+}
+
+func TestOldestIdlePolicy(t *testing.T) {
+	m := NewManager(&mockOptionsInterface{options: TargetOptions{Scheduling: "oldest_idle"}})
+	numStreams := 3
+	targetId := util.RandSeq(5)
+	for i := 0; i < numStreams; i++ {
+		stream := NewStream(util.RandSeq(5), targetId, "none", i, 0, int(time.Now().Unix()))
+		m.AddStream(stream, targetId, true)
+	}
+	tokens := make([]string, 0)
+	streamIds := make([]string, 0)
+	for i := 0; i < numStreams; i++ {
+		token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		tokens = append(tokens, token)
+		streamIds = append(streamIds, streamId)
+	}
+	// deactivate in reverse order, the last stream to be activated is now the oldest idle one
+	for i := numStreams - 1; i >= 0; i-- {
+		assert.Nil(t, m.DeactivateStream(tokens[i], 0))
+		time.Sleep(time.Millisecond)
+	}
+	for i := numStreams - 1; i >= 0; i-- {
+		_, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, streamId, streamIds[i])
+	}
+}
+
+func TestWeightedRandomPolicy(t *testing.T) {
+	m := NewManager(&mockOptionsInterface{options: TargetOptions{Scheduling: "weighted_random"}})
+	targetId := util.RandSeq(5)
+	short := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	long := NewStream(util.RandSeq(5), targetId, "none", 99, 0, int(time.Now().Unix()))
+	m.AddStream(short, targetId, true)
+	m.AddStream(long, targetId, true)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Nil(t, m.DeactivateStream(token, 0))
+		counts[streamId] += 1
+	}
+	// expected ratio is 100:1
+	assert.True(t, counts[short.StreamId] > 900)
+	assert.True(t, counts[long.StreamId] > 0)
+}
+
+func TestPriorityOrdering(t *testing.T) {
+	m := NewManager(intf)
+	numStreams := 5
+	targetId := util.RandSeq(5)
+	for i := 0; i < numStreams; i++ {
+		stream := NewStream(util.RandSeq(5), targetId, "none", i, 0, int(time.Now().Unix()))
+		m.AddStream(stream, targetId, true)
+	}
+	// bump the shortest stream to the front of the queue
+	var shortest *Stream
+	for _, stream := range m.streams {
+		if stream.Frames == 0 {
+			shortest = stream
+		}
+	}
+	assert.NotNil(t, m.ModifyStreamOrdering(shortest.StreamId, "bad_user", func(s *Stream) error {
+		s.Priority = 1
+		return nil
+	}))
+	assert.Nil(t, m.ModifyStreamOrdering(shortest.StreamId, "none", func(s *Stream) error {
+		s.Priority = 1
+		return nil
+	}))
+	assert.Equal(t, m.targets[targetId].inactiveStreams.Len(), numStreams)
+	_, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, shortest.StreamId)
+	// the remaining streams are ordered by the policy
+	for i := numStreams - 1; i > 0; i-- {
+		_, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, m.streams[streamId].Frames, i)
+	}
+}
+
+func TestWeightedRandomPriority(t *testing.T) {
+	m := NewManager(&mockOptionsInterface{options: TargetOptions{Scheduling: "weighted_random"}})
+	targetId := util.RandSeq(5)
+	low := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	high := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	high.Priority = 1
+	high.Weight = 0.001
+	m.AddStream(low, targetId, true)
+	m.AddStream(high, targetId, true)
+	for i := 0; i < 100; i++ {
+		token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, streamId, high.StreamId)
+		assert.Nil(t, m.DeactivateStream(token, 0))
+	}
+}
+
+func TestPolicyAccept(t *testing.T) {
+	for _, name := range []string{"most_frames", "fewest_frames", "round_robin", "oldest_idle", "weighted_random"} {
+		policy, _ := NewSchedulingPolicy(name)
+		queue := NewCustomSet(policyComp(policy))
+		high := NewStream("high", "t", "none", 5, 0, int(time.Now().Unix()))
+		high.Priority = 1
+		queue.Add(high)
+		queue.Add(NewStream("a", "t", "none", 0, 0, int(time.Now().Unix())))
+		queue.Add(NewStream("b", "t", "none", 10, 0, int(time.Now().Unix())))
+		queue.Add(NewStream("c", "t", "none", 3, 0, int(time.Now().Unix())))
+		assert.Equal(t, policy.Next(queue, nil), high, name)
+		// streams that are not accepted are skipped, even those with a higher priority
+		accept := func(s *Stream) bool {
+			return s.StreamId == "a" || s.StreamId == "c"
+		}
+		for i := 0; i < 20; i++ {
+			next := policy.Next(queue, accept)
+			assert.True(t, next.StreamId == "a" || next.StreamId == "c", name)
+		}
+		assert.Nil(t, policy.Next(queue, func(s *Stream) bool { return false }), name)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, compareVersions("6.2", "6.2"), 0)
+	assert.Equal(t, compareVersions("6.2", "6.2.0"), 0)
+	assert.Equal(t, compareVersions("6.10", "6.2"), 1)
+	assert.Equal(t, compareVersions("5.9.9", "6"), -1)
+	assert.Equal(t, compareVersions("6.2b", "6.2a"), 1)
+}
+
+func TestEngineCompatibility(t *testing.T) {
+	options := TargetOptions{Engines: map[string]string{"openmm": "6.2", "terachem": ""}}
+	m := NewManager(&mockOptionsInterface{options: options})
+	targetId := util.RandSeq(5)
+	stream := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	for _, engine := range []string{"gromacs", "gromacs@5.0", "openmm", "openmm@6.1.9"} {
+		_, _, err := m.ActivateStream(targetId, "yutong", engine, mockFunc)
+		assert.Equal(t, err, ErrNoCompatibleStreams)
+	}
+	for _, engine := range []string{"terachem", "terachem@1.0", "openmm@6.2", "openmm@6.10"} {
+		token, _, err := m.ActivateStream(targetId, "yutong", engine, mockFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, m.tokens[token].activeStream.engine, engine)
+		assert.Nil(t, m.DeactivateStream(token, 0))
+	}
+	_, _, err := m.ActivateStream(targetId, "yutong", "openmm@6.2", mockFunc)
+	assert.Nil(t, err)
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm@6.2", mockFunc)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, err, ErrNoCompatibleStreams)
+	// incompatible engines must not wait for streams they can never get
+	_, _, err = m.ActivateStreamWait(targetId, "yutong", "gromacs", time.Minute, mockFunc)
+	assert.Equal(t, err, ErrNoCompatibleStreams)
+}
+
+func TestStreamEngineRequirements(t *testing.T) {
+	m := NewManager(intf)
+	targetId := util.RandSeq(5)
+	restricted := NewStream("a", targetId, "none", 10, 0, int(time.Now().Unix()))
+	restricted.Engines = map[string]string{"openmm": "7.0"}
+	m.AddStream(restricted, targetId, true)
+	m.AddStream(NewStream("b", targetId, "none", 0, 0, int(time.Now().Unix())), targetId, true)
+	assert.Equal(t, m.targets[targetId].restrictedStreams, 1)
+	// the restricted stream would be picked first, but only engines that meet its requirements get it
+	other, streamId, err := m.ActivateStream(targetId, "yutong", "gromacs", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, "b")
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm@6.2", mockFunc)
+	assert.Equal(t, err, ErrNoCompatibleStreams)
+	_, _, err = m.ActivateStream("", "yutong", "gromacs", mockFunc)
+	assert.Equal(t, err, ErrNoCompatibleStreams)
+	token, streamId, err := m.ActivateStream("", "yutong", "openmm@7.1", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, "a")
+
+	// a waiter is only handed a stream its engine may run
+	done := make(chan string)
+	go func() {
+		_, streamId, err := m.ActivateStreamWait(targetId, "yutong", "gromacs", time.Minute, mockFunc)
+		assert.Nil(t, err)
+		done <- streamId
+	}()
+	for {
+		m.RLock()
+		waiting := m.targets[targetId].waiters.Len()
+		m.RUnlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	m.RLock()
+	assert.Equal(t, m.targets[targetId].waiters.Len(), 1)
+	m.RUnlock()
+	assert.Nil(t, m.DeactivateStream(other, 0))
+	assert.Equal(t, <-done, "b")
+
+	assert.Nil(t, m.RemoveStream("a", "none"))
+	assert.Equal(t, m.targets[targetId].restrictedStreams, 0)
+}
+
+func TestActivateStreamWaitTimeout(t *testing.T) {
+	m := NewManager(intf)
+	targetId := util.RandSeq(5)
+	stream := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	_, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	start := time.Now()
+	_, _, err = m.ActivateStreamWait(targetId, "yutong", "openmm", 200*time.Millisecond, mockFunc)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+	assert.Equal(t, m.targets[targetId].waiters.Len(), 0)
+}
+
+func TestActivateStreamWaitFIFO(t *testing.T) {
+	m := NewManager(intf)
+	targetId := util.RandSeq(5)
+	stream := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	numWaiters := 5
+	results := make(chan string, numWaiters)
+	for i := 0; i < numWaiters; i++ {
+		user := strconv.Itoa(i)
+		go func() {
+			token, _, err := m.ActivateStreamWait(targetId, user, "openmm", 10*time.Second, mockFunc)
+			assert.Nil(t, err)
+			results <- user
+			time.Sleep(10 * time.Millisecond)
+			assert.Nil(t, m.DeactivateStream(token, 0))
+		}()
+		// make sure the waiters queue up in order
+		for {
+			m.RLock()
+			n := m.targets[targetId].waiters.Len()
+			m.RUnlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	for i := 0; i < numWaiters; i++ {
+		assert.Equal(t, <-results, strconv.Itoa(i))
+	}
+}
+
+func TestActivateStreamWaitEnable(t *testing.T) {
+	m := NewManager(intf)
+	targetId := util.RandSeq(5)
+	stream := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, false)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assert.Nil(t, m.EnableStream(stream.StreamId, "none"))
+	}()
+	_, streamId, err := m.ActivateStreamWait(targetId, "yutong", "openmm", 10*time.Second, mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, stream.StreamId)
+}
+
+func TestActivateStreamWaitRemove(t *testing.T) {
+	m := NewManager(intf)
+	targetId := util.RandSeq(5)
+	stream := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	_, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assert.Nil(t, m.RemoveStream(stream.StreamId, "none"))
+	}()
+	start := time.Now()
+	_, _, err = m.ActivateStreamWait(targetId, "yutong", "openmm", 10*time.Second, mockFunc)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestActivateAnyTarget(t *testing.T) {
+	inj := &mockOptionsInterface{targets: map[string]TargetOptions{
+		"a1": TargetOptions{Owner: "alice", OwnerWeight: 1},
+		"b1": TargetOptions{Owner: "bob", OwnerWeight: 3, Weight: 2},
+		"b2": TargetOptions{Owner: "bob", OwnerWeight: 3, Weight: 1},
+	}}
+	m := NewManager(inj)
+	for targetId, _ := range inj.targets {
+		for i := 0; i < 20; i++ {
+			stream := NewStream(util.RandSeq(12), targetId, "none", 0, 0, int(time.Now().Unix()))
+			m.AddStream(stream, targetId, true)
+		}
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 12; i++ {
+		_, streamId, err := m.ActivateStream("", "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		counts[m.streams[streamId].TargetId] += 1
+	}
+	assert.Equal(t, counts["a1"], 3)
+	assert.Equal(t, counts["b1"], 6)
+	assert.Equal(t, counts["b2"], 3)
+}
+
+func TestActivateAnyTargetEngine(t *testing.T) {
+	inj := &mockOptionsInterface{targets: map[string]TargetOptions{
+		"gromacs": TargetOptions{Owner: "alice", Engines: map[string]string{"gromacs": ""}},
+		"openmm":  TargetOptions{Owner: "bob", Engines: map[string]string{"openmm": ""}},
+	}}
+	m := NewManager(inj)
+	_, _, err := m.ActivateStream("", "yutong", "openmm", mockFunc)
+	assert.NotNil(t, err)
+	for targetId, _ := range inj.targets {
+		stream := NewStream(util.RandSeq(12), targetId, "none", 0, 0, int(time.Now().Unix()))
+		m.AddStream(stream, targetId, true)
+	}
+	_, _, err = m.ActivateStream("", "yutong", "terachem", mockFunc)
+	assert.Equal(t, err, ErrNoCompatibleStreams)
+	_, streamId, err := m.ActivateStream("", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, m.streams[streamId].TargetId, "openmm")
+	_, _, err = m.ActivateStream("", "yutong", "openmm", mockFunc)
+	assert.Equal(t, err, ErrNoCompatibleStreams)
+	_, streamId, err = m.ActivateStream("", "yutong", "gromacs", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, m.streams[streamId].TargetId, "gromacs")
+}
+
+func TestCompleteStream(t *testing.T) {
+	m := NewManager(&mockOptionsInterface{options: TargetOptions{MaxFrames: 10}})
+	targetId := util.RandSeq(5)
+	stream := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	other := NewStream(util.RandSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	other.MaxFrames = 20
+	setFrames := func(frames int) func(*Stream) error {
+		return func(s *Stream) error {
+			s.Frames = frames
+			return nil
+		}
+	}
+	m.AddStream(stream, targetId, true)
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Nil(t, m.ModifyActiveStream(token, setFrames(15)))
+	completed, err := m.CheckCompletion(token)
+	assert.Nil(t, err)
+	assert.True(t, completed)
+	assert.NotNil(t, m.ModifyActiveStream(token, mockFunc))
+
+	// the stream's own max_frames takes precedence
+	m.AddStream(other, targetId, true)
+	token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, other.StreamId)
+	assert.Nil(t, m.ModifyActiveStream(token, setFrames(15)))
+	completed, err = m.CheckCompletion(token)
+	assert.Nil(t, err)
+	assert.False(t, completed)
+	assert.Nil(t, m.DeactivateStream(token, 0))
+
+	assert.Equal(t, stream.MongoStatus, "completed")
+	assert.Equal(t, other.MongoStatus, "enabled")
+	target := m.targets[targetId]
+	assert.Equal(t, len(target.completedStreams), 1)
+	assert.Equal(t, target.inactiveStreams.Len(), 1)
+	assert.NotNil(t, m.EnableStream(stream.StreamId, "none"))
+	assert.NotNil(t, m.DisableStream(stream.StreamId, "none"))
+	token, streamId, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, other.StreamId)
+	// completion also happens when the core stops
+	assert.Nil(t, m.ModifyActiveStream(token, setFrames(20)))
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	assert.Equal(t, len(target.completedStreams), 2)
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.NotNil(t, err)
+	assert.Nil(t, m.RemoveStream(stream.StreamId, "none"))
+	assert.Nil(t, m.RemoveStream(other.StreamId, "none"))
+	assert.Equal(t, len(m.targets), 0)
+}
+
+func TestReloadTargetOptions(t *testing.T) {
+	inj := &mockOptionsInterface{options: TargetOptions{Scheduling: "most_frames"}}
+	m := NewManager(inj)
+	targetId := util.RandSeq(5)
+	m.AddStream(NewStream("a", targetId, "none", 10, 0, int(time.Now().Unix())), targetId, true)
+	m.AddStream(NewStream("b", targetId, "none", 2, 0, int(time.Now().Unix())), targetId, true)
+	inj.options = TargetOptions{Scheduling: "fewest_frames", MaxFrames: 20}
+	options, ok := m.TargetOptions(targetId)
+	assert.True(t, ok)
+	assert.Equal(t, options.MaxFrames, 0)
+	reloaded := m.ReloadTargetOptions()
+	assert.Equal(t, reloaded[targetId].MaxFrames, 20)
+	assert.Equal(t, reloaded[targetId].Owner, "none")
+	options, _ = m.TargetOptions(targetId)
+	assert.Equal(t, options.MaxFrames, 20)
+	// the queue follows the new policy
+	_, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, "b")
+	assert.Equal(t, m.targets[targetId].inactiveStreams.Len(), 1)
+}
+
+func TestReserveStream(t *testing.T) {
+	m := NewManager(intf)
+	targetId := util.RandSeq(5)
+	m.AddStream(NewStream("a", targetId, "none", 0, 0, int(time.Now().Unix())), targetId, true)
+	assert.NotNil(t, m.ReserveStream("a"))
+	assert.Nil(t, m.ReserveStream("b"))
+	assert.NotNil(t, m.ReserveStream("b"))
+	// a reserved stream does not exist yet
+	assert.NotNil(t, m.ReadStream("b", mockFunc))
+	m.ReleaseStream("b")
+	assert.Nil(t, m.ReserveStream("b"))
+	assert.Nil(t, m.AddStream(NewStream("b", targetId, "none", 0, 0, int(time.Now().Unix())), targetId, true))
+	assert.Equal(t, len(m.reserved), 0)
+	assert.NotNil(t, m.ReserveStream("b"))
+}
+
+func TestModifyInactiveStream(t *testing.T) {
+	m := NewManager(&mockInterface{})
+	targetId := util.RandSeq(5)
+	stream := NewStream("a", targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	assert.NotNil(t, m.ModifyInactiveStream("a", "yutong", mockFunc))
+	assert.NotNil(t, m.ModifyInactiveStream("b", "none", mockFunc))
+	assert.Nil(t, m.ModifyInactiveStream("a", "none", mockFunc))
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.NotNil(t, m.ModifyInactiveStream("a", "none", mockFunc))
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	assert.Nil(t, m.DisableStream("a", "none"))
+	assert.Nil(t, m.ModifyInactiveStream("a", "none", mockFunc))
+	assert.Equal(t, len(m.targets[targetId].disabledStreams), 1)
+	assert.Nil(t, m.EnableStream("a", "none"))
+
+	// the manager is usable while fn runs, but the stream itself can not be touched
+	other := NewStream("b", targetId, "none", 0, 0, int(time.Now().Unix()))
+	assert.Nil(t, m.ModifyInactiveStream("a", "none", func(s *Stream) error {
+		assert.Nil(t, m.AddStream(other, targetId, true))
+		assert.NotNil(t, m.ModifyInactiveStream("a", "none", mockFunc))
+		assert.NotNil(t, m.DisableStream("a", "none"))
+		token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, streamId, "b")
+		_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.NotNil(t, err)
+		assert.Nil(t, m.DeactivateStream(token, 0))
+		return nil
+	}))
+	assert.Equal(t, m.targets[targetId].inactiveStreams.Len(), 2)
+	assert.Equal(t, len(m.targets[targetId].busyStreams), 0)
+
+	// callers waiting for a stream get it once fn returns
+	assert.Nil(t, m.DisableStream("b", "none"))
+	done := make(chan string)
+	assert.Nil(t, m.ModifyInactiveStream("a", "none", func(s *Stream) error {
+		go func() {
+			_, streamId, err := m.ActivateStreamWait(targetId, "yutong", "openmm", time.Minute, mockFunc)
+			assert.Nil(t, err)
+			done <- streamId
+		}()
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}))
+	assert.Equal(t, <-done, "a")
+}
+
+func TestTruncateStream(t *testing.T) {
+	m := NewManager(&mockOptionsInterface{options: TargetOptions{MaxFrames: 10}})
+	targetId := util.RandSeq(5)
+	s1 := NewStream("a", targetId, "none", 12, 0, int(time.Now().Unix()))
+	s2 := NewStream("b", targetId, "none", 8, 0, int(time.Now().Unix()))
+	s1.MongoStatus = "completed"
+	m.AddStream(s1, targetId, true)
+	m.AddStream(s2, targetId, true)
+	setFrames := func(frames int) func(*Stream) error {
+		return func(s *Stream) error {
+			s.Frames = frames
+			return nil
+		}
+	}
+	assert.NotNil(t, m.TruncateStream("b", "yutong", setFrames(2)))
+	assert.NotNil(t, m.TruncateStream("c", "none", setFrames(2)))
+
+	// active streams are refused
+	token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, "b")
+	assert.NotNil(t, m.TruncateStream("b", "none", setFrames(2)))
+	assert.Equal(t, s2.Frames, 8)
+	assert.Nil(t, m.DeactivateStream(token, 0))
+
+	// a failed truncation leaves the queue intact
+	assert.NotNil(t, m.TruncateStream("b", "none", func(s *Stream) error {
+		return errors.New("disk error")
+	}))
+	target := m.targets[targetId]
+	assert.Equal(t, target.inactiveStreams.Len(), 1)
+	assert.Nil(t, m.TruncateStream("b", "none", setFrames(2)))
+	assert.Equal(t, s2.Frames, 2)
+	assert.True(t, target.inactiveStreams.Contains(s2))
+
+	// still past max_frames, so the stream stays completed
+	assert.Nil(t, m.TruncateStream("a", "none", setFrames(10)))
+	assert.Equal(t, s1.MongoStatus, "completed")
+	assert.Equal(t, len(target.completedStreams), 1)
+	assert.Nil(t, m.TruncateStream("a", "none", setFrames(4)))
+	assert.Equal(t, s1.MongoStatus, "disabled")
+	assert.Equal(t, len(target.completedStreams), 0)
+	assert.Equal(t, len(target.disabledStreams), 1)
+	assert.Nil(t, m.EnableStream("a", "none"))
+	assert.Equal(t, target.inactiveStreams.Len(), 2)
+
+	// the manager is usable while the truncation runs, but the stream itself can not be touched
+	assert.Nil(t, m.TruncateStream("a", "none", func(s *Stream) error {
+		assert.NotNil(t, m.EnableStream("a", "none"))
+		assert.NotNil(t, m.RemoveStream("a", "none"))
+		token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, streamId, "b")
+		assert.Nil(t, m.DeactivateStream(token, 0))
+		s.Frames = 1
+		return nil
+	}))
+	assert.Equal(t, target.inactiveStreams.Len(), 2)
+	assert.Equal(t, len(target.busyStreams), 0)
+}
+
 type MultiplexTester struct {
 	t *testing.T
 }
@@ -0,0 +1,223 @@
+package scv
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Number of times a migrated stream is started on the peer before the migration reports it disabled.
+const MIGRATE_START_ATTEMPTS int = 3
+
+// Client used to reach other SCVs. Their certificates are expected to be signed by the CA of this
+// SCV, if it has one.
+func newPeerClient(config Configuration) *http.Client {
+	client := &http.Client{}
+	if ca := config.SSL["CA"]; ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			log.Printf("Warning: cannot read CA %s, using the system roots for other SCVs: %s", ca, err.Error())
+			return client
+		}
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(pem)
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	}
+	return client
+}
+
+// Send a request to another SCV on behalf of the manager, and decode its reply into result if
+// result is not nil. Errors returned by the peer are passed through. Peers that registered with
+// SSL are reached over https.
+func (app *Application) peerRequest(method string, peer Configuration, url, token string, body io.Reader, result interface{}) error {
+	scheme := "http://"
+	if peer.HTTPS {
+		scheme = "https://"
+	}
+	host := peer.ExternalHost
+	req, err := http.NewRequest(method, scheme+host+url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", token)
+	resp, err := app.peerClient.Do(req)
+	if err != nil {
+		return errors.New("Cannot reach SCV " + host + ": " + err.Error())
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.New("Cannot read reply of SCV " + host)
+	}
+	if resp.StatusCode != 200 {
+		return errors.New("SCV " + host + " replied: " + strings.TrimSpace(string(data)))
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// Move a stream to another SCV registered in servers.scvs. The stream is disabled here and held busy,
+// so that nothing changes it until it is removed, sent to the /streams/import endpoint of the peer
+// and verified against the md5 of every file that was sent, which the peer computes from the files
+// it committed to its store. Only then is the stream started on the peer (if it was enabled), and
+// removed from this SCV's Mongo collection and disk. If anything fails before the peer confirms, the
+// stream is enabled here again, and a copy that does not match is deleted from the peer, or reported
+// if it cannot be. If it cannot be started on the peer, it stays there disabled and the error is
+// returned. Like exports, migrations may outlast the timeouts of the Server.
+func (app *Application) StreamMigrateHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		token := r.Header.Get("Authorization")
+		streamId := mux.Vars(r)["stream_id"]
+		type Message struct {
+			SCV string `json:"scv"`
+		}
+		msg := Message{}
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&msg)
+		if err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		if msg.SCV == "" || msg.SCV == app.Config.Name {
+			return errors.New("Bad request: invalid SCV " + msg.SCV)
+		}
+		peer, err := app.DB.Servers.Find(msg.SCV)
+		if err != nil {
+			return errors.New("Unknown SCV " + msg.SCV)
+		}
+		status := ""
+		e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			if stream.Owner != user {
+				return errors.New("You do not own this stream.")
+			}
+			status = stream.MongoStatus
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		// completed streams are never activated, and can not be disabled
+		if status != "completed" {
+			if e = app.Manager.DisableStream(streamId, user); e != nil {
+				return e
+			}
+		}
+		enable := func() {
+			if status == "enabled" {
+				app.Manager.EnableStream(streamId, user)
+			}
+		}
+		// nothing may change the stream after it is listed, it would be lost once it is removed here
+		held, e := app.Manager.HoldStream(streamId, user)
+		if e != nil {
+			enable()
+			return e
+		}
+		restore := func() {
+			app.Manager.Unhold(held)
+			enable()
+		}
+		manifestJSON, entries, e := app.listArchive(streamId, user, 0, int(^uint(0)>>1))
+		if e != nil {
+			restore()
+			return e
+		}
+
+		pr, pw := io.Pipe()
+		h := md5.New()
+		sums := make(map[string]string)
+		done := make(chan error, 1)
+		go func() {
+			gz := gzip.NewWriter(io.MultiWriter(pw, h))
+			tw := tar.NewWriter(gz)
+			err := writeArchive(tw, app.Store, streamId, manifestJSON, entries, sums)
+			if err == nil {
+				err = tw.Close()
+			}
+			if err == nil {
+				err = gz.Close()
+			}
+			pw.CloseWithError(err)
+			done <- err
+		}()
+		type Reply struct {
+			StreamId string            `json:"stream_id"`
+			MD5      string            `json:"md5"`
+			Files    map[string]string `json:"files"`
+		}
+		rep := Reply{}
+		// nothing is written to the client until the peer replies, the deadlines of its connection
+		// are pushed back as the peer reads the stream instead
+		e = app.peerRequest("POST", peer, "/streams/import", token, newTransfer(w, pr), &rep)
+		// unblocks the writer if the peer stopped reading early
+		pr.Close()
+		if writeErr := <-done; e == nil && writeErr != nil {
+			e = writeErr
+		}
+		if e != nil {
+			restore()
+			return e
+		}
+		verified := rep.MD5 == hex.EncodeToString(h.Sum(nil)) && len(rep.Files) == len(sums)
+		for name, sum := range sums {
+			verified = verified && rep.Files[name] == sum
+		}
+		if verified == false {
+			restore()
+			e = errors.New("Checksum mismatch while sending stream to SCV " + msg.SCV)
+			if deleteErr := app.peerRequest("PUT", peer, "/streams/delete/"+streamId, token, nil, nil); deleteErr != nil {
+				log.Printf("Stream %s is left half imported on SCV %s: %s", streamId, msg.SCV, deleteErr.Error())
+				e = errors.New(e.Error() + ", and the copy it received could not be deleted, delete it there: " + deleteErr.Error())
+			}
+			return e
+		}
+		var startErr error
+		if status == "enabled" {
+			for attempt := 1; attempt <= MIGRATE_START_ATTEMPTS; attempt++ {
+				if attempt > 1 {
+					time.Sleep(time.Duration(attempt-1) * time.Second)
+				}
+				startErr = app.peerRequest("PUT", peer, "/streams/start/"+streamId, token, nil, nil)
+				if startErr == nil {
+					break
+				}
+				log.Printf("Migrated stream %s could not be started on SCV %s: %s", streamId, msg.SCV, startErr.Error())
+			}
+		}
+
+		// the peer owns the stream from now on
+		app.Manager.RemoveHeldStream(held)
+		app.usage.RemoveStream(streamId)
+		if app.DB.Streams.Remove(streamId) != nil {
+			app.deferWrite(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: streamId})
+		}
+		app.Store.RemoveStream(streamId)
+		if startErr != nil {
+			return errors.New("Stream " + streamId + " was moved to SCV " + msg.SCV + " but is disabled there, it could not be started: " + startErr.Error())
+		}
+		data, e := json.Marshal(map[string]string{"stream_id": streamId, "scv": msg.SCV})
+		if e != nil {
+			return e
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,157 @@
+package scv
+
+import (
+	"errors"
+	"math/rand"
+)
+
+const DEFAULT_SCHEDULING_POLICY string = "most_frames"
+
+// A SchedulingPolicy decides which inactive stream of a target is handed out by
+// ActivateStream. Less is used to order the target's inactiveStreams queue, so it
+// must only depend on fields that do not change while a stream sits in the queue,
+// and it must break ties on StreamId so that two distinct streams never compare equal.
+// Next picks a stream out of the queue among those accept returns true for (every stream
+// if accept is nil), or returns nil if there are none.
+type SchedulingPolicy interface {
+	Less(s1, s2 *Stream) bool
+	Next(queue *Set, accept func(*Stream) bool) *Stream
+}
+
+// Returns the policy registered under name, eg. "fewest_frames". An empty name
+// returns the default policy.
+func NewSchedulingPolicy(name string) (SchedulingPolicy, error) {
+	switch name {
+	case "", "most_frames":
+		return mostFramesPolicy{}, nil
+	case "fewest_frames":
+		return fewestFramesPolicy{}, nil
+	case "round_robin":
+		return roundRobinPolicy{}, nil
+	case "oldest_idle":
+		return oldestIdlePolicy{}, nil
+	case "weighted_random":
+		return weightedRandomPolicy{}, nil
+	}
+	return nil, errors.New("unknown scheduling policy " + name)
+}
+
+// Wraps the policy's Less so it can be used as a skiplist comparator. Streams are
+// grouped by descending priority first, the policy only orders streams within a group.
+func policyComp(policy SchedulingPolicy) func(l, r interface{}) bool {
+	return func(l, r interface{}) bool {
+		s1 := l.(*Stream)
+		s2 := r.(*Stream)
+		if s1.Priority != s2.Priority {
+			return s1.Priority > s2.Priority
+		}
+		return policy.Less(s1, s2)
+	}
+}
+
+func firstStream(queue *Set, accept func(*Stream) bool) *Stream {
+	for i := queue.Iterator(); i.Next(); {
+		if stream := i.Key().(*Stream); accept == nil || accept(stream) {
+			return stream
+		}
+	}
+	return nil
+}
+
+// Extends the longest stream first. This was the only behavior before policies existed.
+type mostFramesPolicy struct{}
+
+func (p mostFramesPolicy) Less(s1, s2 *Stream) bool {
+	return StreamComp(s1, s2)
+}
+
+func (p mostFramesPolicy) Next(queue *Set, accept func(*Stream) bool) *Stream {
+	return firstStream(queue, accept)
+}
+
+// Extends the shortest stream first, which keeps the frame counts of an ensemble even.
+type fewestFramesPolicy struct{}
+
+func (p fewestFramesPolicy) Less(s1, s2 *Stream) bool {
+	if s1.Frames == s2.Frames {
+		return s1.StreamId < s2.StreamId
+	}
+	return s1.Frames < s2.Frames
+}
+
+func (p fewestFramesPolicy) Next(queue *Set, accept func(*Stream) bool) *Stream {
+	return firstStream(queue, accept)
+}
+
+// Hands out the stream that was activated least recently.
+type roundRobinPolicy struct{}
+
+func (p roundRobinPolicy) Less(s1, s2 *Stream) bool {
+	if s1.activationSeq == s2.activationSeq {
+		return s1.StreamId < s2.StreamId
+	}
+	return s1.activationSeq < s2.activationSeq
+}
+
+func (p roundRobinPolicy) Next(queue *Set, accept func(*Stream) bool) *Stream {
+	return firstStream(queue, accept)
+}
+
+// Hands out the stream that has been sitting in the inactive queue the longest.
+type oldestIdlePolicy struct{}
+
+func (p oldestIdlePolicy) Less(s1, s2 *Stream) bool {
+	if s1.idleSince == s2.idleSince {
+		return s1.StreamId < s2.StreamId
+	}
+	return s1.idleSince < s2.idleSince
+}
+
+func (p oldestIdlePolicy) Next(queue *Set, accept func(*Stream) bool) *Stream {
+	return firstStream(queue, accept)
+}
+
+// Picks a random stream among those with the highest priority, with probability
+// proportional to Weight/(1+Frames), so that short streams are favored without
+// starving long ones. This walks the entire priority group.
+type weightedRandomPolicy struct{}
+
+func (p weightedRandomPolicy) Less(s1, s2 *Stream) bool {
+	return StreamComp(s1, s2)
+}
+
+func (p weightedRandomPolicy) weight(s *Stream) float64 {
+	weight := s.Weight
+	// streams created before weights existed are stored with a weight of 0
+	if weight <= 0 {
+		weight = 1
+	}
+	return weight / float64(1+s.Frames)
+}
+
+func (p weightedRandomPolicy) Next(queue *Set, accept func(*Stream) bool) *Stream {
+	first := firstStream(queue, accept)
+	if first == nil {
+		return nil
+	}
+	total := 0.0
+	for i := queue.Iterator(); i.Next() && i.Key().(*Stream).Priority >= first.Priority; {
+		if s := i.Key().(*Stream); s.Priority == first.Priority && (accept == nil || accept(s)) {
+			total += p.weight(s)
+		}
+	}
+	pick := rand.Float64() * total
+	last := first
+	for i := queue.Iterator(); i.Next() && i.Key().(*Stream).Priority >= first.Priority; {
+		s := i.Key().(*Stream)
+		if s.Priority != first.Priority || (accept != nil && accept(s) == false) {
+			continue
+		}
+		last = s
+		pick -= p.weight(last)
+		if pick < 0 {
+			return last
+		}
+	}
+	return last
+}
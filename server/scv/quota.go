@@ -0,0 +1,325 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Limits on the disk space used by the streams of a target, in bytes, part of the options of the
+// target. 0 means unlimited. Owners have their own limit, the quota field of users.managers. Both are
+// reloaded by CheckpointJanitor, so changes apply within CHECKPOINT_JANITOR_INTERVAL.
+type QuotaOptions struct {
+	Stream int64 `bson:"stream"` // for each stream of the target
+	Target int64 `bson:"target"` // for all the streams of the target together
+}
+
+// Disk space used and allowed, in bytes. A quota of 0 means unlimited.
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Quota int64 `json:"quota"`
+}
+
+func (u Usage) allows(bytes int64) bool {
+	return u.Quota <= 0 || u.Bytes+bytes <= u.Quota
+}
+
+// Bytes that can still be added, assuming there is a quota.
+func (u Usage) left() int64 {
+	if u.Bytes > u.Quota {
+		return 0
+	}
+	return u.Quota - u.Bytes
+}
+
+// Returned when a write would exceed a quota.
+type QuotaError struct {
+	Level string // "stream", "target" or "owner"
+	Id    string
+	Usage Usage
+	Bytes int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("Quota exceeded: %s %s uses %d of %d bytes, cannot add %d more",
+		e.Level, e.Id, e.Usage.Bytes, e.Usage.Quota, e.Bytes)
+}
+
+type streamUsage struct {
+	targetId string
+	bytes    int64
+}
+
+type targetUsage struct {
+	Usage
+	owner       string
+	streamQuota int64
+}
+
+/*
+DiskUsage keeps track of the disk space used by every stream, target and owner, so that quotas are
+checked without walking directories. Streams are measured once when they are added and again after
+the rare operations that remove files, frames and checkpoints are counted as they are written.
+Seed files shared between streams count in full for each of them.
+
+DiskUsage has its own lock, which may be taken while holding those of the Manager and of a stream.
+*/
+type DiskUsage struct {
+	sync.Mutex
+	streams map[string]*streamUsage
+	targets map[string]*targetUsage
+	owners  map[string]*Usage
+}
+
+func NewDiskUsage() *DiskUsage {
+	return &DiskUsage{
+		streams: make(map[string]*streamUsage),
+		targets: make(map[string]*targetUsage),
+		owners:  make(map[string]*Usage),
+	}
+}
+
+func (d *DiskUsage) HasTarget(targetId string) bool {
+	d.Lock()
+	defer d.Unlock()
+	_, ok := d.targets[targetId]
+	return ok
+}
+
+// Set the quotas of a target and of its owner. Must be called before the streams of the target are
+// added. If the target changed hands, its usage is moved to the new owner. An empty owner keeps the
+// current one along with its quota, eg. for targets that have no document.
+func (d *DiskUsage) SetTarget(targetId, owner string, quota QuotaOptions, ownerQuota int64) {
+	d.Lock()
+	defer d.Unlock()
+	t, ok := d.targets[targetId]
+	if ok == false {
+		t = &targetUsage{owner: owner}
+		d.targets[targetId] = t
+	}
+	t.Quota = quota.Target
+	t.streamQuota = quota.Stream
+	if owner == "" {
+		d.owner(t.owner)
+		return
+	}
+	if owner != t.owner {
+		d.owner(t.owner).Bytes -= t.Bytes
+		t.owner = owner
+		d.owner(owner).Bytes += t.Bytes
+	}
+	d.owner(owner).Quota = ownerQuota
+}
+
+// Assumes the usage is locked.
+func (d *DiskUsage) owner(owner string) *Usage {
+	o, ok := d.owners[owner]
+	if ok == false {
+		o = &Usage{}
+		d.owners[owner] = o
+	}
+	return o
+}
+
+// Set the disk space used by a stream, after it was measured.
+func (d *DiskUsage) SetStream(streamId, targetId string, bytes int64) {
+	d.Lock()
+	defer d.Unlock()
+	s, ok := d.streams[streamId]
+	if ok == false {
+		s = &streamUsage{targetId: targetId}
+		d.streams[streamId] = s
+	}
+	d.add(s, bytes-s.bytes)
+}
+
+// Assumes the usage is locked, and the target of the stream is set.
+func (d *DiskUsage) add(s *streamUsage, bytes int64) {
+	s.bytes += bytes
+	t := d.targets[s.targetId]
+	t.Bytes += bytes
+	d.owners[t.owner].Bytes += bytes
+}
+
+// Count bytes written to, or removed from (if negative) a stream.
+func (d *DiskUsage) Add(streamId string, bytes int64) {
+	d.Lock()
+	defer d.Unlock()
+	if s, ok := d.streams[streamId]; ok {
+		d.add(s, bytes)
+	}
+}
+
+// Like Add, but returns a QuotaError and counts nothing if the stream, its target or its owner
+// would exceed their quota.
+func (d *DiskUsage) Reserve(streamId string, bytes int64) error {
+	d.Lock()
+	defer d.Unlock()
+	s, ok := d.streams[streamId]
+	if ok == false {
+		return nil
+	}
+	t := d.targets[s.targetId]
+	if stream := (Usage{s.bytes, t.streamQuota}); stream.allows(bytes) == false {
+		return &QuotaError{"stream", streamId, stream, bytes}
+	}
+	if t.allows(bytes) == false {
+		return &QuotaError{"target", s.targetId, t.Usage, bytes}
+	}
+	if o := d.owners[t.owner]; o.allows(bytes) == false {
+		return &QuotaError{"owner", t.owner, *o, bytes}
+	}
+	d.add(s, bytes)
+	return nil
+}
+
+// The quota of a stream, of its target or of its owner that leaves the stream the fewest bytes, as the
+// QuotaError of a write one byte larger than those. nil if none of them is limited.
+func (d *DiskUsage) Tightest(streamId string) *QuotaError {
+	d.Lock()
+	defer d.Unlock()
+	s, ok := d.streams[streamId]
+	if ok == false {
+		return nil
+	}
+	t := d.targets[s.targetId]
+	quotas := []QuotaError{
+		{"stream", streamId, Usage{s.bytes, t.streamQuota}, 0},
+		{"target", s.targetId, t.Usage, 0},
+		{"owner", t.owner, *d.owners[t.owner], 0},
+	}
+	var tightest *QuotaError
+	for i := range quotas {
+		q := &quotas[i]
+		if q.Usage.Quota > 0 && (tightest == nil || q.Usage.left() < tightest.Usage.left()) {
+			tightest = q
+		}
+	}
+	if tightest != nil {
+		tightest.Bytes = tightest.Usage.left() + 1
+	}
+	return tightest
+}
+
+func (d *DiskUsage) RemoveStream(streamId string) {
+	d.Lock()
+	defer d.Unlock()
+	if s, ok := d.streams[streamId]; ok {
+		d.add(s, -s.bytes)
+		delete(d.streams, streamId)
+	}
+}
+
+// Usage of an owner, of its targets and of their streams.
+type UsageReport struct {
+	Owner   Usage            `json:"owner"`
+	Targets map[string]Usage `json:"targets"`
+	Streams map[string]Usage `json:"streams"`
+}
+
+func (d *DiskUsage) Report(owner string) UsageReport {
+	d.Lock()
+	defer d.Unlock()
+	report := UsageReport{
+		Targets: make(map[string]Usage),
+		Streams: make(map[string]Usage),
+	}
+	if o, ok := d.owners[owner]; ok {
+		report.Owner = *o
+	}
+	for targetId, t := range d.targets {
+		if t.owner == owner {
+			report.Targets[targetId] = t.Usage
+		}
+	}
+	for streamId, s := range d.streams {
+		if t := d.targets[s.targetId]; t.owner == owner {
+			report.Streams[streamId] = Usage{s.bytes, t.streamQuota}
+		}
+	}
+	return report
+}
+
+// Total size of the files below dir of a stream.
+func storeSize(store StreamStore, streamId, dir string) (int64, error) {
+	files, err := store.ListFiles(streamId, dir)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(0)
+	for _, file := range files {
+		size += file.Size
+	}
+	return size, nil
+}
+
+// Measure the disk space used by a stream, loading the quotas of its target and owner the first
+// time one of its streams is measured. Since those come from the database, must not be called
+// while holding the lock of a stream.
+func (app *Application) measureUsage(stream *Stream) {
+	if app.usage.HasTarget(stream.TargetId) == false {
+		options, _ := app.TargetOptionsService(stream.TargetId)
+		app.setTargetUsage(stream, options, make(map[string]int64))
+	}
+	app.measureStream(stream)
+}
+
+// Set the quotas of the target of a stream from its options, and that of its owner. ownerQuotas holds
+// the quotas of the owners already looked up, so that each is queried only once.
+func (app *Application) setTargetUsage(stream *Stream, options TargetOptions, ownerQuotas map[string]int64) {
+	owner := options.Owner
+	if owner == "" {
+		owner = stream.Owner
+	}
+	ownerQuota, ok := ownerQuotas[owner]
+	if ok == false {
+		ownerQuota, _ = app.DB.Users.ManagerQuota(owner)
+		ownerQuotas[owner] = ownerQuota
+	}
+	app.usage.SetTarget(stream.TargetId, owner, options.Quota, ownerQuota)
+}
+
+// Measure the disk space used by a stream again, eg. after files of it were removed. Unlike
+// measureUsage it does not query the database, so it may be called while holding the lock of the
+// stream. Streams whose target has no quotas yet are left to measureUsage.
+func (app *Application) measureStream(stream *Stream) {
+	if app.usage.HasTarget(stream.TargetId) == false {
+		return
+	}
+	size, err := storeSize(app.Store, stream.StreamId, "")
+	if err != nil {
+		log.Printf("Warning: cannot measure disk usage of stream %s: %s", stream.StreamId, err.Error())
+		return
+	}
+	app.usage.SetStream(stream.StreamId, stream.TargetId, size)
+}
+
+// Reload the options of every target, along with the quotas of the targets and of their owners.
+// Like measureUsage, must not be called while holding the lock of a stream.
+func (app *Application) reloadTargetOptions() {
+	for targetId, options := range app.Manager.ReloadTargetOptions() {
+		ownerQuota, _ := app.DB.Users.ManagerQuota(options.Owner)
+		app.usage.SetTarget(targetId, options.Owner, options.Quota, ownerQuota)
+	}
+}
+
+// Disk usage and quotas of the current manager, of its targets and of their streams. Seed files that
+// streams share, eg. forks of the same stream, are counted in full for each of them, so the usage
+// reported and checked against the quotas can be more than the disk space actually taken.
+func (app *Application) UsageHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		data, err := json.Marshal(app.usage.Report(user))
+		if err != nil {
+			return errors.New("Cannot encode usage")
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,200 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDiskUsage(t *testing.T) {
+	d := NewDiskUsage()
+	d.SetTarget("t1", "yutong", QuotaOptions{Stream: 100, Target: 150}, 200)
+	d.SetTarget("t2", "yutong", QuotaOptions{}, 200)
+	d.SetStream("s1", "t1", 40)
+	d.SetStream("s2", "t1", 40)
+	d.SetStream("s3", "t2", 0)
+
+	assert.Nil(t, d.Reserve("s1", 60))
+	err := d.Reserve("s1", 1)
+	assert.Equal(t, err.(*QuotaError).Level, "stream")
+	err = d.Reserve("s2", 60)
+	assert.Equal(t, err.(*QuotaError).Level, "target")
+	assert.Equal(t, err.Error(), "Quota exceeded: target t1 uses 140 of 150 bytes, cannot add 60 more")
+	// s2 is held back by the target, which has 10 bytes left
+	tightest := d.Tightest("s2")
+	assert.Equal(t, tightest.Level, "target")
+	assert.Equal(t, tightest.Usage.left(), int64(10))
+	assert.Equal(t, tightest.Bytes, int64(11))
+	assert.Nil(t, d.Reserve("s3", 60))
+	err = d.Reserve("s3", 1)
+	assert.Equal(t, err.(*QuotaError).Level, "owner")
+	// unknown streams are not limited
+	assert.Nil(t, d.Reserve("s4", 1000))
+	assert.Nil(t, d.Tightest("s4"))
+	assert.Equal(t, d.Tightest("s3").Level, "owner")
+
+	d.Add("s1", -50)
+	d.SetStream("s2", "t1", 10)
+	report := d.Report("yutong")
+	assert.Equal(t, report.Owner, Usage{120, 200})
+	assert.Equal(t, report.Targets["t1"], Usage{60, 150})
+	assert.Equal(t, report.Targets["t2"], Usage{60, 0})
+	assert.Equal(t, report.Streams["s1"], Usage{50, 100})
+	d.RemoveStream("s1")
+	report = d.Report("yutong")
+	assert.Equal(t, report.Owner, Usage{70, 200})
+	assert.Equal(t, len(report.Streams), 2)
+	assert.Empty(t, d.Report("joe").Streams)
+
+	// the usage of a target that changed hands goes with it
+	d.SetTarget("t2", "joe", QuotaOptions{}, 100)
+	assert.Equal(t, d.Report("yutong").Owner, Usage{10, 200})
+	report = d.Report("joe")
+	assert.Equal(t, report.Owner, Usage{60, 100})
+	assert.Equal(t, report.Targets["t2"], Usage{60, 0})
+	err = d.Reserve("s3", 50)
+	assert.Equal(t, err.(*QuotaError).Id, "joe")
+	d.SetTarget("t2", "", QuotaOptions{}, 0)
+	assert.Equal(t, d.Report("joe").Owner, Usage{60, 100})
+}
+
+func (f *Fixture) getUsage(token string) (report UsageReport, code int) {
+	req, _ := http.NewRequest("GET", "/usage", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &report)
+	code = w.Code
+	return
+}
+
+func TestStreamQuota(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"quota": {"stream": 700}}}`)
+	auth_token := f.addManager("yutong", 1)
+	f.mongo.C("users", "managers").UpdateId("yutong", bson.M{"$set": bson.M{"quota": 5000}})
+	jsonData := `{"target_id":"` + target_id + `", "files": {"openmm": "0123456789"}}`
+	streamId, code := f.postStream(auth_token, jsonData)
+	assert.Equal(t, code, 200)
+	usage, code := f.getUsage(auth_token)
+	assert.Equal(t, code, 200)
+	seedSize := usage.Streams[streamId].Bytes
+	assert.True(t, seedSize >= 10)
+	assert.Equal(t, usage.Streams[streamId].Quota, int64(700))
+	assert.Equal(t, usage.Owner, Usage{seedSize, 5000})
+
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	frame := make([]byte, 400)
+	for i := range frame {
+		frame[i] = 'x'
+	}
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+string(frame)+`"}}`), 200)
+	usage, _ = f.getUsage(auth_token)
+	assert.Equal(t, usage.Streams[streamId].Bytes, seedSize+400)
+	assert.Equal(t, usage.Targets[target_id].Bytes, seedSize+400)
+
+	// the frame that would go over the quota is rejected and the stream paused
+	frame[0] = 'y'
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+string(frame)+`"}}`), 400)
+	frame[0] = 'z'
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+string(frame)+`"}}`), 400)
+	usage, _ = f.getUsage(auth_token)
+	assert.Equal(t, usage.Streams[streamId].Bytes, seedSize+400)
+	assert.Equal(t, len(f.app.Manager.targets[target_id].disabledStreams), 1)
+
+	// the buffered frame is dropped when the stream is activated again
+	assert.Equal(t, f.streamStart(auth_token, streamId), 200)
+	_, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	usage, _ = f.getUsage(auth_token)
+	assert.Equal(t, usage.Streams[streamId].Bytes, seedSize)
+
+	assert.Equal(t, f.deleteStream(auth_token, streamId), 200)
+	usage, _ = f.getUsage(auth_token)
+	assert.Equal(t, usage.Owner.Bytes, int64(0))
+}
+
+func TestQuotaPauseRestart(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"quota": {"stream": 100}}}`)
+	auth_token := f.addManager("yutong", 1)
+	streamId, code := f.postStream(auth_token, `{"target_id":"`+target_id+`", "files": {"openmm": "0123456789"}}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	frame := make([]byte, 200)
+	for i := range frame {
+		frame[i] = 'x'
+	}
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+string(frame)+`"}}`), 400)
+	// starting it again is not undone by the update the pause queued
+	assert.Equal(t, f.streamStart(auth_token, streamId), 200)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, f.loadMongoStream(streamId)["status"], "enabled")
+
+	// nor is a pause undone by the update the deactivation queued
+	token, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+string(frame)+`"}}`), 400)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, f.app.deferred.Len(), 0)
+	assert.Equal(t, f.loadMongoStream(streamId)["status"], "disabled")
+	f.resetManager()
+	f.app.LoadStreams()
+	assert.Equal(t, len(f.app.Manager.targets[target_id].disabledStreams), 1)
+	_, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+}
+
+func TestReloadQuota(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"quota": {"stream": 700}}}`)
+	auth_token := f.addManager("yutong", 1)
+	jsonData := `{"target_id":"` + target_id + `", "files": {"openmm": "0123456789"}}`
+	streamId, code := f.postStream(auth_token, jsonData)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	frame := make([]byte, 800)
+	for i := range frame {
+		frame[i] = 'x'
+	}
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+string(frame)+`"}}`), 400)
+
+	// quotas changed in Mongo apply once they are reloaded
+	f.mongo.C("data", "targets").UpdateId(target_id, bson.M{"$set": bson.M{"options": bson.M{"quota": bson.M{"stream": 2000, "target": 3000}}}})
+	f.mongo.C("users", "managers").UpdateId("yutong", bson.M{"$set": bson.M{"quota": 5000}})
+	usage, _ := f.getUsage(auth_token)
+	assert.Equal(t, usage.Streams[streamId].Quota, int64(700))
+	f.app.reloadTargetOptions()
+	usage, _ = f.getUsage(auth_token)
+	assert.Equal(t, usage.Streams[streamId].Quota, int64(2000))
+	assert.Equal(t, usage.Targets[target_id].Quota, int64(3000))
+	assert.Equal(t, usage.Owner.Quota, int64(5000))
+
+	assert.Equal(t, f.streamStart(auth_token, streamId), 200)
+	token, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+string(frame)+`"}}`), 200)
+
+	// and when the streams are loaded again
+	f.resetManager()
+	f.app.usage = NewDiskUsage()
+	f.app.LoadStreams()
+	usage, _ = f.getUsage(auth_token)
+	assert.Equal(t, usage.Streams[streamId].Quota, int64(2000))
+	assert.Equal(t, usage.Targets[target_id].Quota, int64(3000))
+	assert.Equal(t, usage.Owner.Quota, int64(5000))
+}
@@ -0,0 +1,453 @@
+package scv
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Looks up users in users.all and managers in users.managers.
+type UserRepository interface {
+	// Id of the user with the given token.
+	FindByToken(token string) (string, error)
+	IsManager(user string) bool
+	// Weight of a manager, mgo.ErrNotFound if the user is not a manager.
+	ManagerWeight(user string) (float64, error)
+	// Disk quota of a manager in bytes, 0 if unlimited.
+	ManagerQuota(user string) (int64, error)
+}
+
+// Looks up targets in data.targets.
+type TargetRepository interface {
+	// Decode the document of a target into result, mgo.ErrNotFound if the target has none.
+	Find(targetId string, result interface{}) error
+}
+
+// The streams owned by this SCV, in streams.{name}.
+type StreamRepository interface {
+	Insert(stream *Stream) error
+	All() ([]Stream, error)
+	// Decode the document of a stream into result, mgo.ErrNotFound if it does not exist.
+	Find(streamId string, result interface{}) error
+	// Set the given fields of a stream, mgo.ErrNotFound if it does not exist.
+	Update(streamId string, fields interface{}) error
+	Remove(streamId string) error
+	Count() (int, error)
+}
+
+// Statistics of donor sessions, in stats.{target_id}.
+type StatsRepository interface {
+	Insert(targetId string, stats StreamStats) error
+	// Decode the first statistics of a stream into result.
+	FindByStream(targetId, streamId string, result interface{}) error
+}
+
+// The SCVs sharing the database, in servers.scvs.
+type ServerRepository interface {
+	Register(config Configuration) error
+	Find(name string) (Configuration, error)
+}
+
+// Every collection an SCV uses. NewMongoDatabase is used in production, NewMemoryDatabase in tests.
+type Database struct {
+	Users   UserRepository
+	Targets TargetRepository
+	Streams StreamRepository
+	Stats   StatsRepository
+	Servers ServerRepository
+}
+
+// The subset of a Mongo collection that the repositories need.
+type collection interface {
+	Insert(doc interface{}) error
+	UpsertId(id, doc interface{}) error
+	UpdateId(id, update interface{}) error
+	RemoveId(id interface{}) error
+	FindId(id, result interface{}) error
+	// Decode the first document whose fields are equal to those of query.
+	FindOne(query bson.M, result interface{}) error
+	All(result interface{}) error
+	Count() (int, error)
+}
+
+func newDatabase(c func(db, name string) collection, scvName string) Database {
+	return Database{
+		Users:   userRepository{c},
+		Targets: targetRepository{c("data", "targets")},
+		Streams: streamRepository{c("streams", scvName)},
+		Stats:   statsRepository{c},
+		Servers: serverRepository{c("servers", "scvs")},
+	}
+}
+
+func NewMongoDatabase(session *mgo.Session, scvName string) Database {
+	index := mgo.Index{
+		Key:        []string{"target_id"},
+		Background: true, // See notes.
+	}
+	session.DB("streams").C(scvName).EnsureIndex(index)
+	return readMongoDatabase(session, scvName)
+}
+
+// Like NewMongoDatabase, but does not create the index.
+func readMongoDatabase(session *mgo.Session, scvName string) Database {
+	return newDatabase(func(db, name string) collection {
+		return mgoCollection{session.DB(db).C(name)}
+	}, scvName)
+}
+
+// Collections of a MemoryMongo can be shared by several applications, as if they were SCVs
+// sharing a Mongo server.
+func NewMemoryDatabase(mongo *MemoryMongo, scvName string) Database {
+	return newDatabase(func(db, name string) collection {
+		return mongo.C(db, name)
+	}, scvName)
+}
+
+type userRepository struct {
+	c func(db, name string) collection
+}
+
+func (r userRepository) FindByToken(token string) (string, error) {
+	type User struct {
+		Id string `bson:"_id"`
+	}
+	user := User{}
+	if err := r.c("users", "all").FindOne(bson.M{"token": token}, &user); err != nil {
+		return "", err
+	}
+	return user.Id, nil
+}
+
+func (r userRepository) IsManager(user string) bool {
+	result := make(map[string]interface{})
+	return r.c("users", "managers").FindId(user, &result) == nil
+}
+
+func (r userRepository) ManagerWeight(user string) (float64, error) {
+	type Manager struct {
+		Weight float64 `bson:"weight"`
+	}
+	manager := Manager{}
+	err := r.c("users", "managers").FindId(user, &manager)
+	return manager.Weight, err
+}
+
+func (r userRepository) ManagerQuota(user string) (int64, error) {
+	type Manager struct {
+		Quota int64 `bson:"quota"`
+	}
+	manager := Manager{}
+	err := r.c("users", "managers").FindId(user, &manager)
+	return manager.Quota, err
+}
+
+type targetRepository struct {
+	c collection
+}
+
+func (r targetRepository) Find(targetId string, result interface{}) error {
+	return r.c.FindId(targetId, result)
+}
+
+type streamRepository struct {
+	c collection
+}
+
+func (r streamRepository) Insert(stream *Stream) error {
+	return r.c.Insert(stream)
+}
+
+func (r streamRepository) All() ([]Stream, error) {
+	var streams []Stream
+	err := r.c.All(&streams)
+	return streams, err
+}
+
+func (r streamRepository) Find(streamId string, result interface{}) error {
+	return r.c.FindId(streamId, result)
+}
+
+func (r streamRepository) Update(streamId string, fields interface{}) error {
+	return r.c.UpdateId(streamId, bson.M{"$set": fields})
+}
+
+func (r streamRepository) Remove(streamId string) error {
+	return r.c.RemoveId(streamId)
+}
+
+func (r streamRepository) Count() (int, error) {
+	return r.c.Count()
+}
+
+type statsRepository struct {
+	c func(db, name string) collection
+}
+
+func (r statsRepository) Insert(targetId string, stats StreamStats) error {
+	return r.c("stats", targetId).Insert(stats)
+}
+
+func (r statsRepository) FindByStream(targetId, streamId string, result interface{}) error {
+	return r.c("stats", targetId).FindOne(bson.M{"stream": streamId}, result)
+}
+
+type serverRepository struct {
+	c collection
+}
+
+func (r serverRepository) Register(config Configuration) error {
+	return r.c.UpsertId(config.Name, config)
+}
+
+func (r serverRepository) Find(name string) (Configuration, error) {
+	config := Configuration{}
+	err := r.c.FindId(name, &config)
+	return config, err
+}
+
+type mgoCollection struct {
+	c *mgo.Collection
+}
+
+func (m mgoCollection) Insert(doc interface{}) error {
+	return m.c.Insert(doc)
+}
+
+func (m mgoCollection) UpsertId(id, doc interface{}) error {
+	_, err := m.c.UpsertId(id, doc)
+	return err
+}
+
+func (m mgoCollection) UpdateId(id, update interface{}) error {
+	return m.c.UpdateId(id, update)
+}
+
+func (m mgoCollection) RemoveId(id interface{}) error {
+	return m.c.RemoveId(id)
+}
+
+func (m mgoCollection) FindId(id, result interface{}) error {
+	return m.c.FindId(id).One(result)
+}
+
+func (m mgoCollection) FindOne(query bson.M, result interface{}) error {
+	return m.c.Find(query).One(result)
+}
+
+func (m mgoCollection) All(result interface{}) error {
+	return m.c.Find(bson.M{}).All(result)
+}
+
+func (m mgoCollection) Count() (int, error) {
+	return m.c.Count()
+}
+
+// Collections kept in memory, for tests and EmbeddedMongo. Documents go through bson like they
+// would with Mongo, so they decode to the same types.
+type MemoryMongo struct {
+	sync.Mutex
+	collections map[string]*MemoryCollection
+	// Called with the new version of every document that changes, or nil if it was removed. The
+	// change is only made if this succeeds, see EmbeddedMongo.
+	persist func(collection string, id interface{}, doc bson.M) error
+}
+
+func NewMemoryMongo() *MemoryMongo {
+	return &MemoryMongo{collections: make(map[string]*MemoryCollection)}
+}
+
+// The collection db.name, created if it does not exist yet.
+func (m *MemoryMongo) C(db, name string) *MemoryCollection {
+	m.Lock()
+	defer m.Unlock()
+	c, ok := m.collections[db+"."+name]
+	if ok == false {
+		c = &MemoryCollection{docs: make(map[interface{}]bson.M)}
+		if m.persist != nil {
+			c.persist = func(id interface{}, doc bson.M) error {
+				return m.persist(db+"."+name, id, doc)
+			}
+		}
+		m.collections[db+"."+name] = c
+	}
+	return c
+}
+
+// Only supports queries by equality of top level fields, and $set updates.
+type MemoryCollection struct {
+	sync.Mutex
+	ids     []interface{} // in insertion order
+	docs    map[interface{}]bson.M
+	persist func(id interface{}, doc bson.M) error
+}
+
+// Replace or remove (if doc is nil) a document. Assumes the collection is locked.
+func (c *MemoryCollection) set(id interface{}, doc bson.M) error {
+	if c.persist != nil {
+		if err := c.persist(id, doc); err != nil {
+			return err
+		}
+	}
+	c.load(id, doc)
+	return nil
+}
+
+// Like set, without persisting the change. Assumes the collection is locked.
+func (c *MemoryCollection) load(id interface{}, doc bson.M) {
+	_, exists := c.docs[id]
+	if doc == nil {
+		delete(c.docs, id)
+		for i, other := range c.ids {
+			if other == id {
+				c.ids = append(c.ids[:i], c.ids[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+	if exists == false {
+		c.ids = append(c.ids, id)
+	}
+	c.docs[id] = doc
+}
+
+func toDocument(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+func fromDocument(doc bson.M, result interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+func (c *MemoryCollection) Insert(doc interface{}) error {
+	d, err := toDocument(doc)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	id, ok := d["_id"]
+	if ok == false {
+		id = bson.NewObjectId()
+		d["_id"] = id
+	}
+	if _, ok = c.docs[id]; ok {
+		return errors.New("E11000 duplicate key error")
+	}
+	return c.set(id, d)
+}
+
+func (c *MemoryCollection) UpsertId(id, doc interface{}) error {
+	d, err := toDocument(doc)
+	if err != nil {
+		return err
+	}
+	d["_id"] = id
+	c.Lock()
+	defer c.Unlock()
+	return c.set(id, d)
+}
+
+func (c *MemoryCollection) UpdateId(id, update interface{}) error {
+	u, err := toDocument(update)
+	if err != nil {
+		return err
+	}
+	fields, ok := u["$set"].(bson.M)
+	if ok == false || len(u) != 1 {
+		return errors.New("Only $set updates are supported")
+	}
+	c.Lock()
+	defer c.Unlock()
+	d, ok := c.docs[id]
+	if ok == false {
+		return mgo.ErrNotFound
+	}
+	updated := bson.M{}
+	for key, value := range d {
+		updated[key] = value
+	}
+	for key, value := range fields {
+		updated[key] = value
+	}
+	return c.set(id, updated)
+}
+
+func (c *MemoryCollection) RemoveId(id interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.docs[id]; ok == false {
+		return mgo.ErrNotFound
+	}
+	return c.set(id, nil)
+}
+
+func (c *MemoryCollection) FindId(id, result interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	d, ok := c.docs[id]
+	if ok == false {
+		return mgo.ErrNotFound
+	}
+	return fromDocument(d, result)
+}
+
+func (c *MemoryCollection) FindOne(query bson.M, result interface{}) error {
+	q, err := toDocument(query)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, id := range c.ids {
+		d := c.docs[id]
+		match := true
+		for key, value := range q {
+			if reflect.DeepEqual(d[key], value) == false {
+				match = false
+				break
+			}
+		}
+		if match {
+			return fromDocument(d, result)
+		}
+	}
+	return mgo.ErrNotFound
+}
+
+// Decode every document into result, which must point to a slice.
+func (c *MemoryCollection) All(result interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	slice := reflect.ValueOf(result).Elem()
+	res := reflect.MakeSlice(slice.Type(), 0, len(c.ids))
+	for _, id := range c.ids {
+		elem := reflect.New(slice.Type().Elem())
+		if err := fromDocument(c.docs[id], elem.Interface()); err != nil {
+			return err
+		}
+		res = reflect.Append(res, elem.Elem())
+	}
+	slice.Set(res)
+	return nil
+}
+
+func (c *MemoryCollection) Count() (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.ids), nil
+}
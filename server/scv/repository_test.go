@@ -0,0 +1,85 @@
+package scv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMemoryDatabaseStreams(t *testing.T) {
+	mongo := NewMemoryMongo()
+	db := NewMemoryDatabase(mongo, "scv1")
+	other := NewMemoryDatabase(mongo, "scv2")
+	stream := NewStream("s1", "t1", "yutong", 0, 0, 1000)
+	assert.Nil(t, db.Streams.Insert(stream))
+	assert.NotNil(t, db.Streams.Insert(stream))
+	assert.Nil(t, db.Streams.Insert(NewStream("s2", "t1", "yutong", 4, 1, 1000)))
+	count, _ := db.Streams.Count()
+	assert.Equal(t, count, 2)
+	count, _ = other.Streams.Count()
+	assert.Equal(t, count, 0)
+
+	assert.Nil(t, db.Streams.Update("s1", bson.M{"frames": 7, "status": "disabled"}))
+	assert.Equal(t, db.Streams.Update("s3", bson.M{"frames": 7}), mgo.ErrNotFound)
+	result := make(map[string]interface{})
+	assert.Nil(t, db.Streams.Find("s1", &result))
+	assert.Equal(t, result["frames"], 7)
+	assert.Equal(t, result["status"], "disabled")
+	assert.Equal(t, result["target_id"], "t1")
+
+	streams, err := db.Streams.All()
+	assert.Nil(t, err)
+	assert.Equal(t, len(streams), 2)
+	assert.Equal(t, streams[0].StreamId, "s1")
+	assert.Equal(t, streams[0].Frames, 7)
+	assert.Equal(t, streams[1].ErrorCount, 1)
+
+	assert.Nil(t, db.Streams.Remove("s1"))
+	assert.Equal(t, db.Streams.Remove("s1"), mgo.ErrNotFound)
+	assert.Equal(t, db.Streams.Find("s1", &result), mgo.ErrNotFound)
+}
+
+func TestMemoryDatabaseUsers(t *testing.T) {
+	mongo := NewMemoryMongo()
+	db := NewMemoryDatabase(mongo, "scv1")
+	mongo.C("users", "all").Insert(bson.M{"_id": "yutong", "token": "abc"})
+	mongo.C("users", "managers").Insert(bson.M{"_id": "yutong", "weight": 2})
+	mongo.C("data", "targets").Insert(bson.M{"_id": "t1", "owner": "yutong", "options": bson.M{"max_frames": 5}})
+
+	user, err := db.Users.FindByToken("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, user, "yutong")
+	_, err = db.Users.FindByToken("def")
+	assert.Equal(t, err, mgo.ErrNotFound)
+	assert.True(t, db.Users.IsManager("yutong"))
+	assert.False(t, db.Users.IsManager("joe"))
+	weight, err := db.Users.ManagerWeight("yutong")
+	assert.Nil(t, err)
+	assert.Equal(t, weight, 2.0)
+
+	type Target struct {
+		Owner   string        `bson:"owner"`
+		Options TargetOptions `bson:"options"`
+	}
+	target := Target{}
+	assert.Nil(t, db.Targets.Find("t1", &target))
+	assert.Equal(t, target.Owner, "yutong")
+	assert.Equal(t, target.Options.MaxFrames, 5)
+
+	stats := StreamStats{Engine: "openmm", Frames: 1.5, Stream: "s1"}
+	assert.Nil(t, db.Stats.Insert("t1", stats))
+	found := StreamStats{}
+	assert.Nil(t, db.Stats.FindByStream("t1", "s1", &found))
+	assert.Equal(t, found, stats)
+	assert.Equal(t, db.Stats.FindByStream("t2", "s1", &found), mgo.ErrNotFound)
+
+	config := Configuration{Name: "scv1", ExternalHost: "a.b.c"}
+	assert.Nil(t, db.Servers.Register(config))
+	config.ExternalHost = "d.e.f"
+	assert.Nil(t, db.Servers.Register(config))
+	found_config, err := db.Servers.Find("scv1")
+	assert.Nil(t, err)
+	assert.Equal(t, found_config.ExternalHost, "d.e.f")
+}
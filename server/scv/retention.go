@@ -0,0 +1,180 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Time between two passes of the checkpoint janitor.
+const CHECKPOINT_JANITOR_INTERVAL time.Duration = 10 * time.Minute
+
+// Which checkpoints of a stream are kept, part of the options of its target. The zero value keeps
+// every checkpoint. The frames of a partition, in its checkpoint 0, are always kept.
+type RetentionOptions struct {
+	// Number of checkpoints kept in each partition, 0 keeps them all.
+	KeepLast int `bson:"keep_last"`
+	// Keep only the latest checkpoint of every partition but the last one.
+	LatestOnly bool `bson:"latest_only"`
+}
+
+func (r RetentionOptions) enabled() bool {
+	return r.KeepLast > 0 || r.LatestOnly
+}
+
+// A checkpoint removed, or that would be removed, by the janitor.
+type PrunedCheckpoint struct {
+	StreamId   string `json:"stream_id"`
+	Partition  int    `json:"partition"`
+	Checkpoint int    `json:"checkpoint"`
+}
+
+// The checkpoints of a stream that the retention options do not keep.
+func expiredCheckpoints(store StreamStore, streamId string, retention RetentionOptions) ([]PrunedCheckpoint, error) {
+	res := make([]PrunedCheckpoint, 0)
+	partitions, err := store.ListPartitions(streamId)
+	if err != nil {
+		return nil, err
+	}
+	// partition 0 has no frames, so it is not listed
+	if _, err = store.Stat(streamId, "0"); err == nil {
+		partitions = append([]int{0}, partitions...)
+	}
+	for i, partition := range partitions {
+		keep := retention.KeepLast
+		if retention.LatestOnly && i < len(partitions)-1 {
+			keep = 1
+		}
+		if keep <= 0 {
+			continue
+		}
+		names, err := store.ListDir(streamId, strconv.Itoa(partition))
+		if err != nil {
+			return nil, err
+		}
+		checkpoints := numericNames(names, false)
+		for j := 0; j < len(checkpoints)-keep; j++ {
+			if checkpoints[j] == 0 {
+				// the frames of the partition stay, only its checkpoint files go
+				if _, err = store.Stat(streamId, checkpointDir(partition, 0)); err != nil {
+					continue
+				}
+			}
+			res = append(res, PrunedCheckpoint{streamId, partition, checkpoints[j]})
+		}
+	}
+	return res, nil
+}
+
+func removeCheckpoint(store StreamStore, checkpoint PrunedCheckpoint) error {
+	if checkpoint.Checkpoint == 0 {
+		return store.Remove(checkpoint.StreamId, checkpointDir(checkpoint.Partition, 0))
+	}
+	return store.Remove(checkpoint.StreamId, strconv.Itoa(checkpoint.Partition)+"/"+strconv.Itoa(checkpoint.Checkpoint))
+}
+
+/*
+Remove the checkpoints that the retention options of their targets do not keep, and return them. If
+dryRun is set nothing is removed. The options are those of the Manager, which CheckpointJanitor
+reloads before every pass together with the quotas. Each stream is locked while its checkpoints are
+removed, so that checkpoints keep being committed in order.
+*/
+func (app *Application) PruneCheckpoints(dryRun bool) []PrunedCheckpoint {
+	return app.pruneCheckpoints(dryRun, "")
+}
+
+// Like PruneCheckpoints, restricted to the streams of owner unless it is empty.
+func (app *Application) pruneCheckpoints(dryRun bool, owner string) []PrunedCheckpoint {
+	pruned := make([]PrunedCheckpoint, 0)
+	streamIds, err := app.Store.ListStreams()
+	if err != nil {
+		log.Printf("Warning: cannot list streams to prune: %s", err.Error())
+		return pruned
+	}
+	for _, streamId := range streamIds {
+		targetId := ""
+		if app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			if owner != "" && stream.Owner != owner {
+				return errors.New("not owned")
+			}
+			targetId = stream.TargetId
+			return nil
+		}) != nil {
+			continue
+		}
+		options, _ := app.Manager.TargetOptions(targetId)
+		retention := options.Retention
+		if retention.enabled() == false {
+			continue
+		}
+		app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+			expired, err := expiredCheckpoints(app.Store, streamId, retention)
+			if err != nil {
+				log.Printf("Warning: cannot list checkpoints of stream %s: %s", streamId, err.Error())
+				return err
+			}
+			for _, checkpoint := range expired {
+				if dryRun == false {
+					if err = removeCheckpoint(app.Store, checkpoint); err != nil {
+						log.Printf("Warning: cannot remove checkpoint %d of partition %d of stream %s: %s",
+							checkpoint.Checkpoint, checkpoint.Partition, streamId, err.Error())
+						return err
+					}
+				}
+				pruned = append(pruned, checkpoint)
+			}
+			if dryRun == false && len(expired) > 0 {
+				app.measureStream(stream)
+			}
+			return nil
+		})
+	}
+	return pruned
+}
+
+// Prune checkpoints every CHECKPOINT_JANITOR_INTERVAL until the application finishes, after loading
+// the options of the targets again. With Config.RetentionDryRun the checkpoints are only logged, the
+// plan can also be queried with RetentionHandler.
+func (app *Application) CheckpointJanitor() {
+	defer app.statsWG.Done()
+	ticker := time.NewTicker(CHECKPOINT_JANITOR_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.finish:
+			return
+		case <-ticker.C:
+			app.reloadTargetOptions()
+			pruned := app.PruneCheckpoints(app.Config.RetentionDryRun)
+			if len(pruned) == 0 {
+				continue
+			}
+			verb := "Removed"
+			if app.Config.RetentionDryRun {
+				verb = "Would remove"
+			}
+			for _, checkpoint := range pruned {
+				log.Printf("%s checkpoint %d of partition %d of stream %s", verb, checkpoint.Checkpoint, checkpoint.Partition, checkpoint.StreamId)
+			}
+		}
+	}
+}
+
+// The checkpoints of the current manager's streams that the janitor would remove if it ran now.
+func (app *Application) RetentionHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		data, err := json.Marshal(app.pruneCheckpoints(true, user))
+		if err != nil {
+			return errors.New("Cannot encode checkpoints")
+		}
+		w.Write(data)
+		return nil
+	}
+}
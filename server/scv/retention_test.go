@@ -0,0 +1,98 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPruneCheckpoints(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"retention": {"keep_last": 2, "latest_only": true}}}`)
+	f.addTarget("67890", "yutong", `{"options": {}}`)
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.1}`), 200)
+	}
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "12345"}}`), 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "67890"}}`), 200)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.1}`), 200)
+	}
+	// streams of targets without retention options are left alone
+	otherId, _ := f.postStream(auth_token, `{"target_id":"67890", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
+	otherToken, code := f.activateStream("67890", "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, f.postCheckpoint(otherToken, `{"files": {"chkpt": "data"}, "frames": 0.1}`), 200)
+	}
+
+	expected := []PrunedCheckpoint{
+		{streamId, 0, 1}, {streamId, 0, 2}, {streamId, 0, 3},
+		{streamId, 2, 0}, {streamId, 2, 1},
+	}
+	assert.Equal(t, f.app.PruneCheckpoints(true), expected)
+	_, err := f.app.Store.Stat(streamId, "0/1")
+	assert.Nil(t, err)
+
+	assert.Equal(t, f.app.PruneCheckpoints(false), expected)
+	for _, name := range []string{"0/1", "0/2", "0/3", "2/0/checkpoint_files", "2/1"} {
+		_, err = f.app.Store.Stat(streamId, name)
+		assert.NotNil(t, err, name)
+	}
+	for _, name := range []string{"0/4", "2/0/frames.xtc", "2/2", "2/3"} {
+		_, err = f.app.Store.Stat(streamId, name)
+		assert.Nil(t, err, name)
+	}
+	_, err = f.app.Store.Stat(otherId, "0/1")
+	assert.Nil(t, err)
+	assert.Empty(t, f.app.PruneCheckpoints(false))
+
+	// cores still start from the last checkpoint
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data5"}, "frames": 0.1}`), 200)
+	assert.Equal(t, string(f.download(auth_token, streamId, "2/4/checkpoint_files/chkpt")), "data5")
+
+	// options changed in Mongo apply once they are reloaded
+	f.mongo.C("data", "targets").UpdateId("67890", bson.M{"$set": bson.M{"options": bson.M{"retention": bson.M{"keep_last": 2}}}})
+	expected = []PrunedCheckpoint{{streamId, 2, 2}}
+	assert.Equal(t, f.app.PruneCheckpoints(true), expected)
+	f.app.Manager.ReloadTargetOptions()
+	// streams are pruned in the order the store lists them
+	expected = []PrunedCheckpoint{{otherId, 0, 1}, {streamId, 2, 2}}
+	if streamId < otherId {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	assert.Equal(t, f.app.PruneCheckpoints(true), expected)
+
+	// the plan is available to the owner of the streams
+	planned, code := f.getRetention(auth_token)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, planned, expected)
+	planned, code = f.getRetention(f.addManager("joe", 1))
+	assert.Equal(t, code, 200)
+	assert.Empty(t, planned)
+	_, err = f.app.Store.Stat(otherId, "0/1")
+	assert.Nil(t, err)
+}
+
+func (f *Fixture) getRetention(token string) (result []PrunedCheckpoint, code int) {
+	req, _ := http.NewRequest("GET", "/retention", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	code = w.Code
+	return
+}
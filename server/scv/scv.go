@@ -3,7 +3,6 @@ package scv
 import (
 	"bytes"
 	"compress/gzip"
-	"container/list"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
@@ -32,18 +31,29 @@ import (
 
 var _ = fmt.Printf
 
+// Upper bound on the wait of a long-polling activation, in seconds. This must stay well below
+// the WriteTimeout of the server.
+const MAX_ACTIVATION_WAIT int = 45
+
 type Application struct {
 	Config  Configuration
-	Mongo   *mgo.Session
+	Mongo   *mgo.Session // nil if the application does not use MongoDB, see NewApplicationWithDatabase
+	DB      Database
 	Manager *Manager
 	Router  *mux.Router
+	Store   StreamStore
 
 	server     *Server
-	stats      *list.List // things we put in this list should persist when server dies
+	deferred   *DeferredQueue // writes to Mongo that persist when server dies
+	embedded   *EmbeddedMongo // nil unless config.Database is "embedded"
+	usage      *DiskUsage
+	disk       *DiskWatchdog
 	statsWG    sync.WaitGroup
-	statsMutex sync.Mutex
 	shutdown   chan os.Signal
 	finish     chan struct{}
+	peerClient *http.Client // used to migrate streams to other SCVs
+	readOnly   bool         // see NewReadOnlyApplication
+	dataLock   *os.File     // held on the data directory, see lockDataDir
 }
 
 /*
@@ -54,82 +64,92 @@ Usually when this method is called, it's in a double mutex.
 */
 func (app *Application) DeactivateStreamService(s *Stream) error {
 	// Record stats for stream and defer insertion until later.
-	stats := make(map[string]interface{})
 	streamId := s.StreamId
 	donorFrames := s.activeStream.donorFrames
-	stats["engine"] = s.activeStream.engine
-	stats["user"] = s.activeStream.user
-	stats["start_time"] = s.activeStream.startTime
-	stats["end_time"] = int(time.Now().Unix())
-	stats["frames"] = donorFrames
-	stats["stream"] = streamId
-	stats_cursor := app.Mongo.DB("stats").C(s.TargetId)
-	fn1 := func() error {
-		return stats_cursor.Insert(stats)
+	stats := StreamStats{
+		Engine:    s.activeStream.engine,
+		User:      s.activeStream.user,
+		StartTime: s.activeStream.startTime,
+		EndTime:   int(time.Now().Unix()),
+		Frames:    donorFrames,
+		Stream:    streamId,
 	}
 	status := "enabled"
-	if s.ErrorCount >= MAX_STREAM_FAILS {
+	if s.MongoStatus == "completed" {
+		status = "completed"
+	} else if s.MongoStatus == "disabled" || s.ErrorCount >= MAX_STREAM_FAILS {
+		// DisableStream sets the status before deactivating
 		status = "disabled"
 	}
 	// Update frames, error_count, and status in Mongo
-	stream_prop := bson.M{"$set": bson.M{"frames": s.Frames, "error_count": s.ErrorCount, "status": status}}
-	stream_cursor := app.Mongo.DB("streams").C(app.Config.Name)
-	fn2 := func() error {
-		// Possible corner case where the stream is actually deleted here.
-		stream_cursor.UpdateId(streamId, stream_prop)
-		// We do not care about the return code.
-		return nil
-	}
+	update := StreamUpdate{Frames: s.Frames, ErrorCount: s.ErrorCount, Status: status}
 
-	app.statsMutex.Lock()
 	if donorFrames > 0 {
-		app.stats.PushBack(fn1)
+		app.deferWrite(DeferredOp{Type: DEFERRED_STATS_INSERT, StreamId: streamId, TargetId: s.TargetId, Stats: &stats})
 	}
-	app.stats.PushBack(fn2)
-	app.statsMutex.Unlock()
+	app.deferWrite(DeferredOp{Type: DEFERRED_STREAM_UPDATE, StreamId: streamId, Update: &update})
 	return nil
 }
 
+// The status is written right away, and queued again so that the updates of earlier deactivations
+// still waiting in the deferred queue cannot overwrite it.
 func (app *Application) EnableStreamService(s *Stream) error {
-	cursor := app.Mongo.DB("streams").C(app.Config.Name)
 	s.ErrorCount = 0
 	s.MongoStatus = "enabled"
-	return cursor.UpdateId(s.StreamId, bson.M{"$set": bson.M{"status": "enabled", "error_count": 0}})
+	app.deferWrite(DeferredOp{Type: DEFERRED_STATUS, StreamId: s.StreamId, Status: &StreamStatus{"enabled", 0}})
+	return app.DB.Streams.Update(s.StreamId, bson.M{"status": "enabled", "error_count": 0})
 }
 
+// Like EnableStreamService, the status is also queued behind the pending deferred writes.
 func (app *Application) DisableStreamService(s *Stream) error {
-	cursor := app.Mongo.DB("streams").C(app.Config.Name)
 	// fmt.Println("DISABLING STREAM", streamId)
-	return cursor.UpdateId(s.StreamId, bson.M{"$set": bson.M{"status": "disabled"}})
+	app.deferWrite(DeferredOp{Type: DEFERRED_STATUS, StreamId: s.StreamId, Status: &StreamStatus{"disabled", s.ErrorCount}})
+	return app.DB.Streams.Update(s.StreamId, bson.M{"status": "disabled"})
 }
 
-func (app *Application) drainStats() {
-	app.statsMutex.Lock()
-	for app.stats.Len() > 0 {
-		ele := app.stats.Front()
-		fn := ele.Value.(func() error)
-		err := fn()
-		if err == nil {
-			app.stats.Remove(ele)
-		} else {
-			fmt.Println(err)
-			break
-		}
+// Load the options and owner of a target from data.targets, and the owner's weight from
+// users.managers. Targets that have no document use the defaults.
+func (app *Application) TargetOptionsService(targetId string) (TargetOptions, error) {
+	type Message struct {
+		Owner   string        `bson:"owner"`
+		Options TargetOptions `bson:"options"`
+	}
+	msg := Message{}
+	err := app.DB.Targets.Find(targetId, &msg)
+	if err == mgo.ErrNotFound {
+		return msg.Options, nil
+	} else if err != nil {
+		log.Printf("Warning: cannot load options for target %s: %s", targetId, err.Error())
+		return msg.Options, err
+	}
+	msg.Options.Owner = msg.Owner
+	if weight, err := app.DB.Users.ManagerWeight(msg.Owner); err == nil {
+		msg.Options.OwnerWeight = weight
 	}
-	app.statsMutex.Unlock()
+	return msg.Options, nil
+}
+
+func (app *Application) drainStats() {
+	app.deferred.Drain(app.applyDeferred, time.Now())
 }
 
+// Write the deferred writes to disk as they are queued, and apply them to Mongo until the application
+// finishes. Writes that still fail then are kept on disk and replayed by the next run.
 func (app *Application) RecordDeferredDocs() {
 	defer app.statsWG.Done()
+	flushed := make(chan struct{})
+	go func() {
+		app.deferred.FlushUntil(app.finish)
+		close(flushed)
+	}()
 	for {
 		select {
 		case <-app.finish:
+			<-flushed
 			app.drainStats()
-
-			// persist stats here if not empty
-			// if app.stats.Len() > 0 {
-			// }
-
+			if pending := app.deferred.Len(); pending > 0 {
+				log.Printf("%d deferred writes will be replayed on restart", pending)
+			}
 			return
 		default:
 			app.drainStats()
@@ -145,96 +165,237 @@ type Configuration struct {
 	ExternalHost string            `json:"ExternalHost",bson:"host"`
 	InternalHost string            `json:"InternalHost",bson:"-"`
 	SSL          map[string]string `json:"SSL",bson:"-"`
+	// Set by RegisterSCV when SSL is configured, so that other SCVs reach this one over https.
+	HTTPS bool `json:"-" bson:"https"`
+	// "mongo" (the default) to use the server at MongoURI, "embedded" to keep the metadata in
+	// {Name}_data/metadata.db instead, see EmbeddedMongo.
+	Database string `json:"Database" bson:"-"`
+	// Only log the checkpoints that the retention options of the targets would remove. They can be
+	// listed at any time with GET /retention.
+	RetentionDryRun bool `json:"RetentionDryRun" bson:"-"`
+	// Free disk space below which activations, new streams and frames are refused.
+	DiskThresholds DiskThresholds `json:"DiskThresholds" bson:"-"`
 }
 
 func (app *Application) RegisterSCV() {
 	log.Printf("Registering SCV %s with database...", app.Config.Name)
-	cursor := app.Mongo.DB("servers").C("scvs")
-	_, err := cursor.UpsertId(app.Config.Name, app.Config)
+	app.Config.HTTPS = len(app.Config.SSL) > 0
+	err := app.DB.Servers.Register(app.Config)
 	if err != nil {
 		panic("Could not connect to MongoDB: " + err.Error())
 	}
 }
 
+// Load the streams of Mongo into the Manager, checking them against the disk. Streams that cannot be
+// loaded are logged and skipped rather than fixed, scv fsck reports and repairs them.
 func (app *Application) LoadStreams() {
-	var mongoStreams []Stream
+	// replay the writes left by the previous run first, so that deleted streams stay deleted
+	app.drainStats()
 
-	err := app.StreamsCursor().Find(bson.M{}).All(&mongoStreams)
+	mongoStreams, err := app.DB.Streams.All()
 	if err != nil {
 		panic("Could not connect to MongoDB: " + err.Error())
 	}
 
+	// deletes that are still failing leave the stream in Mongo and its files on disk, until they succeed
+	deleted := app.deferred.Queued(DEFERRED_STREAM_DELETE)
 	mongoStreamIds := make(map[string]Stream)
 	for _, val := range mongoStreams {
+		if _, ok := deleted[val.StreamId]; ok {
+			log.Println("Warning: stream " + val.StreamId + " is waiting to be deleted, not loading it")
+			continue
+		}
 		mongoStreamIds[val.StreamId] = val
 	}
 
 	log.Printf("Loading %d streams...", len(mongoStreamIds))
 
 	diskStreamIds := make(map[string]struct{})
-	fileData, err := ioutil.ReadDir(filepath.Join(app.Config.Name+"_data", "streams"))
-	for _, v := range fileData {
-		diskStreamIds[v.Name()] = struct{}{}
+	storedIds, err := app.Store.ListStreams()
+	if err != nil {
+		panic("Unable to list streams: " + err.Error())
+	}
+	for _, v := range storedIds {
+		diskStreamIds[v] = struct{}{}
 	}
 	// Check that disk streams is equal to mongo streams. That is mongoStreams /subset of diskStreamIds
 	for streamId, stream := range mongoStreamIds {
 		_, ok := diskStreamIds[streamId]
 		if ok == false {
-			log.Panicln("Cannot find data for stream " + streamId + " on disk")
+			// its data has to be restored or the stream forgotten, see scv fsck -forget
+			log.Println("Warning: cannot find data for stream " + streamId + " on disk, not loading it")
+			delete(mongoStreamIds, streamId)
+			continue
+		}
+		// undo whatever was interrupted when the SCV last stopped
+		changes, err := app.Store.Recover(streamId)
+		if err != nil {
+			log.Printf("Warning: unable to recover stream %s, not loading it: %s", streamId, err.Error())
+			delete(mongoStreamIds, streamId)
+			continue
+		}
+		for _, change := range changes {
+			log.Printf("Warning: recovering stream %s, %s", streamId, change)
 		}
-		partitions, err := app.ListPartitions(streamId)
+		// streams created before metadata files existed get one, so that fsck can recreate them
+		if _, err = app.Store.Stat(streamId, STREAM_METADATA); err != nil {
+			if err = app.writeStreamMetadata(&stream); err != nil {
+				log.Printf("Warning: cannot write %s of stream %s: %s", STREAM_METADATA, streamId, err.Error())
+			}
+		}
+		partitions, err := app.Store.ListPartitions(streamId)
 		if err != nil {
-			panic("Unable to list partitions for stream " + streamId)
+			log.Printf("Warning: unable to list partitions of stream %s, not loading it: %s", streamId, err.Error())
+			delete(mongoStreamIds, streamId)
+			continue
 		}
 		lastFrame := 0
 		if len(partitions) > 0 {
 			lastFrame = partitions[len(partitions)-1]
 		}
+		stream.PersistedFrames = stream.Frames
 		if lastFrame != stream.Frames {
 			log.Printf("Warning: frame count mismatch for stream %s. Disk: %d, Mongo: %d, using disk value.", streamId, lastFrame, stream.Frames)
 		}
 		stream.Frames = lastFrame
 		mongoStreamIds[streamId] = stream
 	}
+	// they are left alone, scv fsck -repair quarantines them
 	for streamId, _ := range diskStreamIds {
 		_, ok := mongoStreamIds[streamId]
-		if ok == false {
-			streamDir := app.StreamDir(streamId)
-			log.Println("Warning: stream " + streamId + " is present on disk but not in Mongo, removing " + streamDir)
-			os.RemoveAll(streamDir)
+		if _, isDeleted := deleted[streamId]; ok == false && isDeleted == false {
+			log.Println("Warning: stream " + streamId + " is present on disk but not in Mongo, not loading it")
 		}
 	}
 
+	// the options of the targets are loaded once by AddStream, and the quotas of the owners once here
+	ownerQuotas := make(map[string]int64)
 	for _, stream := range mongoStreamIds {
 		if stream.MongoStatus == "enabled" {
-			app.Manager.AddStream(&stream, stream.TargetId, true)
-		} else if stream.MongoStatus == "disabled" {
-			app.Manager.AddStream(&stream, stream.TargetId, false)
+			err = app.Manager.AddStream(&stream, stream.TargetId, true)
+		} else if stream.MongoStatus == "disabled" || stream.MongoStatus == "completed" {
+			err = app.Manager.AddStream(&stream, stream.TargetId, false)
 		} else {
-			panic("Unknown stream status")
+			err = errors.New("unknown status " + stream.MongoStatus)
+		}
+		if err != nil {
+			log.Printf("Warning: unable to load stream %s: %s", stream.StreamId, err.Error())
+			continue
+		}
+		if app.usage.HasTarget(stream.TargetId) == false {
+			options, _ := app.Manager.TargetOptions(stream.TargetId)
+			app.setTargetUsage(&stream, options, ownerQuotas)
 		}
+		app.measureStream(&stream)
 	}
 }
 
 func NewApplication(config Configuration) *Application {
-	session, err := mgo.Dial(config.MongoURI)
+	return openApplication(config, false)
+}
+
+// Like NewApplication, for commands that only read the data of an SCV, eg. scv fsck without -repair.
+// Nothing is written: files left by interrupted uploads and deferred writes stay, the embedded
+// metadata store is not compacted and no index is created in MongoDB. Fails while an SCV uses the
+// data directory, since its data would change while it is read.
+func NewReadOnlyApplication(config Configuration) *Application {
+	return openApplication(config, true)
+}
+
+func openApplication(config Configuration, readOnly bool) *Application {
+	lock, err := lockDataDir(config, readOnly)
 	if err != nil {
-		panic(err)
+		panic("Could not lock " + config.Name + "_data: " + err.Error())
 	}
-	app := Application{
-		Config:  config,
-		Mongo:   session,
-		Manager: nil,
-		stats:   list.New(),
-		finish:  make(chan struct{}),
+	var app *Application
+	switch config.Database {
+	case "", "mongo":
+		session, err := mgo.Dial(config.MongoURI)
+		if err != nil {
+			panic(err)
+		}
+		if readOnly {
+			app = newApplication(config, readMongoDatabase(session, config.Name), true)
+		} else {
+			app = newApplication(config, NewMongoDatabase(session, config.Name), false)
+		}
+		app.Mongo = session
+	case "embedded":
+		open := OpenEmbeddedMongo
+		if readOnly {
+			open = ReadEmbeddedMongo
+		}
+		embedded, err := open(EmbeddedPath(config))
+		if err != nil {
+			panic("Could not open metadata store: " + err.Error())
+		}
+		app = newApplication(config, NewMemoryDatabase(embedded.MemoryMongo, config.Name), readOnly)
+		app.embedded = embedded
+	default:
+		panic("Unknown database " + config.Database)
 	}
+	app.dataLock = lock
+	return app
+}
 
-	index := mgo.Index{
-		Key:        []string{"target_id"},
-		Background: true, // See notes.
+// Lock the data directory of an SCV, exclusively unless readOnly is set, so that maintenance commands
+// do not run against a live SCV. The lock is held until the process exits or the application shuts
+// down. A read-only lock does not create the lock file, if there is none no SCV is using the data.
+func lockDataDir(config Configuration, readOnly bool) (*os.File, error) {
+	path := filepath.Join(config.Name+"_data", "lock")
+	how := syscall.LOCK_EX
+	var file *os.File
+	var err error
+	if readOnly {
+		how = syscall.LOCK_SH
+		file, err = os.Open(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+	} else if err = makeDir(filepath.Dir(path)); err == nil {
+		file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, errors.New("it is in use by another SCV")
+	}
+	return file, nil
+}
+
+// Create an application that uses db instead of connecting to MongoDB, eg. a MemoryDatabase.
+func NewApplicationWithDatabase(config Configuration, db Database) *Application {
+	return newApplication(config, db, false)
+}
+
+func newApplication(config Configuration, db Database, readOnly bool) *Application {
+	loadDeferred := NewDeferredQueue
+	if readOnly {
+		loadDeferred = loadDeferredQueue
+	}
+	deferred, err := loadDeferred(filepath.Join(config.Name+"_data", "deferred"))
+	if err != nil {
+		panic("Could not load deferred writes: " + err.Error())
+	}
+	app := Application{
+		Config:     config,
+		DB:         db,
+		Manager:    nil,
+		Store:      NewFileStore(filepath.Join(config.Name+"_data", "streams")),
+		deferred:   deferred,
+		usage:      NewDiskUsage(),
+		disk:       NewDiskWatchdog(config.Name+"_data", config.DiskThresholds),
+		finish:     make(chan struct{}),
+		peerClient: newPeerClient(config),
+		readOnly:   readOnly,
 	}
-	app.StreamsCursor().EnsureIndex(index)
 
+	if readOnly == false {
+		// uploads interrupted by the end of the previous run
+		os.RemoveAll(app.uploadDir())
+	}
 	app.Manager = NewManager(&app)
 	app.Router = mux.NewRouter()
 	app.Router.Handle("/", app.AliveHandler()).Methods("GET")
@@ -245,7 +406,17 @@ func NewApplication(config Configuration) *Application {
 	app.Router.Handle("/streams/start/{stream_id}", app.StreamEnableHandler()).Methods("PUT")
 	app.Router.Handle("/streams/stop/{stream_id}", app.StreamDisableHandler()).Methods("PUT")
 	app.Router.Handle("/streams/delete/{stream_id}", app.StreamDeleteHandler()).Methods("PUT")
+	app.Router.Handle("/streams/priority/{stream_id}", app.StreamPriorityHandler()).Methods("PUT")
+	app.Router.Handle("/streams/truncate/{stream_id}", app.StreamTruncateHandler()).Methods("PUT")
+	app.Router.Handle("/streams/reseed/{stream_id}", app.StreamReseedHandler()).Methods("PUT")
+	app.Router.Handle("/streams/import", app.StreamImportHandler()).Methods("POST")
+	app.Router.Handle("/streams/migrate/{stream_id}", app.StreamMigrateHandler()).Methods("POST")
+	app.Router.Handle("/streams/export/{stream_id}", app.StreamExportHandler()).Methods("GET")
+	app.Router.Handle("/streams/trajectory/{stream_id}/{file}", app.StreamTrajectoryHandler()).Methods("GET")
+	app.Router.Handle("/streams/fork/{stream_id}", app.StreamForkHandler()).Methods("POST")
 	app.Router.Handle("/streams/sync/{stream_id}", app.StreamSyncHandler()).Methods("GET")
+	app.Router.Handle("/usage", app.UsageHandler()).Methods("GET")
+	app.Router.Handle("/retention", app.RetentionHandler()).Methods("GET")
 	app.Router.Handle("/core/start", app.CoreStartHandler()).Methods("GET")
 	app.Router.Handle("/core/frame", app.CoreFrameHandler()).Methods("POST")
 	app.Router.Handle("/core/checkpoint", app.CoreCheckpointHandler()).Methods("POST")
@@ -256,44 +427,38 @@ func NewApplication(config Configuration) *Application {
 		app.server.TLS(config.SSL["Cert"], config.SSL["Key"])
 		app.server.CA(config.SSL["CA"])
 	}
-	app.statsWG.Add(1)
+	// for RecordDeferredDocs, which would write
+	if readOnly == false {
+		app.statsWG.Add(1)
+	}
 	return &app
 }
 
-func (app *Application) StreamsCursor() *mgo.Collection {
-	return app.Mongo.DB("streams").C(app.Config.Name)
-}
-
 type AppHandler func(http.ResponseWriter, *http.Request) error
 
-// if we need to return different error codes, simply subclass error class and implement a different type of error
-// and use a dynamic switch type?
+// Errors that implement StatusCode, eg. DiskSpaceError, are returned with that code, others with 400.
+type statusCoder interface {
+	StatusCode() int
+}
+
 func (fn AppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := fn(w, r); err != nil {
-		http.Error(w, err.Error(), 400)
+		code := 400
+		if e, ok := err.(statusCoder); ok {
+			code = e.StatusCode()
+		}
+		http.Error(w, err.Error(), code)
 	}
 }
 
 // Look up the User using the Authorization header
 func (app *Application) CurrentUser(r *http.Request) (user string, err error) {
 	token := r.Header.Get("Authorization")
-	cursor := app.Mongo.DB("users").C("all")
-	result := make(map[string]interface{})
-	if err = cursor.Find(bson.M{"token": token}).One(&result); err != nil {
-		return
-	}
-	user = result["_id"].(string)
-	return
+	return app.DB.Users.FindByToken(token)
 }
 
 func (app *Application) IsManager(user string) bool {
-	cursor := app.Mongo.DB("users").C("managers")
-	result := make(map[string]interface{})
-	if err := cursor.Find(bson.M{"_id": user}).One(&result); err != nil {
-		return false
-	} else {
-		return true
-	}
+	return app.DB.Users.IsManager(user)
 }
 
 func (app *Application) CurrentManager(r *http.Request) (user string, err error) {
@@ -308,11 +473,6 @@ func (app *Application) CurrentManager(r *http.Request) (user string, err error)
 	return user, nil
 }
 
-// Return a path indicating where stream files should be stored
-func (app *Application) StreamDir(stream_id string) string {
-	return filepath.Join(app.Config.Name+"_data", "streams", stream_id)
-}
-
 // Run starts the server. Listens and Serves asynchronously. And sets up necessary
 // signal handlers for graceful termination. This blocks until a signal is sent
 func (app *Application) Run() {
@@ -328,6 +488,10 @@ func (app *Application) Run() {
 		}
 	}()
 	go app.RecordDeferredDocs()
+	app.statsWG.Add(1)
+	go app.CheckpointJanitor()
+	app.statsWG.Add(1)
+	go app.WatchDiskSpace()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 	<-c
@@ -339,11 +503,26 @@ func (app *Application) Shutdown() {
 	app.server.Close()
 	close(app.finish)
 	app.statsWG.Wait()
-	app.Mongo.Close()
+	if app.Mongo != nil {
+		app.Mongo.Close()
+	}
+	if app.embedded != nil {
+		app.embedded.Close()
+	}
+	if app.dataLock != nil {
+		app.dataLock.Close()
+	}
 }
 
+// Reports the free disk space and what is refused because of it.
 func (app *Application) AliveHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		free, level := app.disk.Status()
+		data, _ := json.Marshal(map[string]interface{}{
+			"disk_free":   free,
+			"disk_status": level.String(),
+		})
+		w.Write(data)
 		return nil
 	}
 }
@@ -354,9 +533,10 @@ func (app *Application) StreamActivateHandler() AppHandler {
 			return errors.New("Unauthorized")
 		}
 		type Message struct {
-			TargetId string `json:"target_id"`
-			Engine   string `json:"engine"`
+			TargetId string `json:"target_id"` // if empty, the SCV picks a target
+			Engine   string `json:"engine"`    // "name" or "name@version"
 			User     string `json:"user"`
+			Wait     int    `json:"wait"` // seconds to wait for a stream if none are available
 		}
 		msg := Message{}
 		decoder := json.NewDecoder(r.Body)
@@ -364,11 +544,22 @@ func (app *Application) StreamActivateHandler() AppHandler {
 		if err != nil {
 			return errors.New("Bad request: " + err.Error())
 		}
-		fn := func(s *Stream) error {
-			err := os.RemoveAll(filepath.Join(app.StreamDir(s.StreamId), "buffer_files"))
+		if err = app.disk.Refuse(DISK_NO_ACTIVATIONS); err != nil {
 			return err
 		}
-		token, _, err := app.Manager.ActivateStream(msg.TargetId, msg.User, msg.Engine, fn)
+		fn := func(s *Stream) error {
+			size, _ := storeSize(app.Store, s.StreamId, "buffer_files")
+			if err := app.Store.ClearBuffer(s.StreamId); err != nil {
+				return err
+			}
+			app.usage.Add(s.StreamId, -size)
+			return nil
+		}
+		if msg.Wait > MAX_ACTIVATION_WAIT {
+			msg.Wait = MAX_ACTIVATION_WAIT
+		}
+		wait := time.Duration(msg.Wait) * time.Second
+		token, _, err := app.Manager.ActivateStreamWait(msg.TargetId, msg.User, msg.Engine, wait, fn)
 		if err != nil {
 			return errors.New("Unable to activate stream: " + err.Error())
 		}
@@ -387,33 +578,12 @@ func splitExt(path string) (root string, ext string) {
 	return
 }
 
-func maxCheckpoint(path string) (int, error) {
-	checkpointDirs, e := ioutil.ReadDir(path)
-	if e != nil {
-		return 0, errors.New("Cannot read frames directory")
-	}
-	// find the folder containing the last checkpoint
-	lastCheckpoint := 0
-	for _, fileProp := range checkpointDirs {
-		count, _ := strconv.Atoi(fileProp.Name())
-		if count > lastCheckpoint {
-			lastCheckpoint = count
-		}
-	}
-	return lastCheckpoint, nil
-}
-
 func (app *Application) StreamDownloadHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
 		streamId := mux.Vars(r)["stream_id"]
 		file := mux.Vars(r)["file"]
-		absStreamDir, _ := filepath.Abs(filepath.Join(app.StreamDir(streamId)))
-		requestedFile, _ := filepath.Abs(filepath.Join(app.StreamDir(streamId), file))
-		if len(requestedFile) < len(absStreamDir) {
-			return errors.New("Invalid file path")
-		}
-		if requestedFile[0:len(absStreamDir)] != absStreamDir {
-			return errors.New("Invalid file path.")
+		if _, err := cleanName(file); err != nil {
+			return err
 		}
 		user, err := app.CurrentUser(r)
 		if err != nil {
@@ -423,7 +593,12 @@ func (app *Application) StreamDownloadHandler() AppHandler {
 			if stream.Owner != user {
 				return errors.New("You do not own this stream.")
 			}
-			binary, e := ioutil.ReadFile(requestedFile)
+			reader, e := app.Store.OpenFile(streamId, file)
+			if e != nil {
+				return errors.New("Unable to read file.")
+			}
+			defer reader.Close()
+			binary, e := ioutil.ReadAll(reader)
 			if e != nil {
 				return errors.New("Unable to read file.")
 			}
@@ -433,21 +608,27 @@ func (app *Application) StreamDownloadHandler() AppHandler {
 	}
 }
 
-// Return the number of partitions in a stream.
-func (app *Application) ListPartitions(streamId string) ([]int, error) {
-	res := make([]int, 0)
-	files, err := ioutil.ReadDir(app.StreamDir(streamId))
+// Return the frame counts at which the seed files of a stream were replaced. The seed files that
+// were in use up to N frames are kept in seeds/N, files always holds the current seed files.
+func (app *Application) ListSeedVersions(streamId string) ([]int, error) {
+	names, err := app.Store.ListDir(streamId, "seeds")
 	if err != nil {
-		return nil, errors.New("FATAL StreamSyncHandler(), can't read streamDir")
+		return nil, errors.New("Cannot read seeds directory")
 	}
-	for _, fileInfo := range files {
-		num, err2 := strconv.Atoi(fileInfo.Name())
-		if err2 == nil && num > 0 {
-			res = append(res, num)
-		}
+	return numericNames(names, false), nil
+}
+
+// Return the directory of the seed files that produced the given partition, relative to the stream.
+func (app *Application) SeedDir(streamId string, partition int) (string, error) {
+	versions, err := app.ListSeedVersions(streamId)
+	if err != nil {
+		return "", err
 	}
-	sort.Ints(res)
-	return res, nil
+	idx := sort.SearchInts(versions, partition)
+	if idx < len(versions) {
+		return "seeds/" + strconv.Itoa(versions[idx]), nil
+	}
+	return "files", nil
 }
 
 func (app *Application) StreamSyncHandler() AppHandler {
@@ -461,14 +642,9 @@ func (app *Application) StreamSyncHandler() AppHandler {
 		result := make(map[string]interface{})
 
 		listSeeds := func() []string {
-			seedDir := filepath.Join(app.StreamDir(streamId), "files")
-			files, err := ioutil.ReadDir(seedDir)
+			res, err := app.Store.ListDir(streamId, "files")
 			if err != nil {
-				panic("FATAL StreamSyncHandler(), can't read seedDir" + seedDir)
-			}
-			res := make([]string, 0)
-			for _, fileInfo := range files {
-				res = append(res, fileInfo.Name())
+				panic("FATAL StreamSyncHandler(), can't read seed files of " + streamId)
 			}
 			return res
 		}
@@ -476,28 +652,21 @@ func (app *Application) StreamSyncHandler() AppHandler {
 		listFramesAndCheckpoints := func(min_partition int) ([]string, []string) {
 
 			frames := make([]string, 0)
-			checkpoints := make([]string, 0)
 
-			frameDir := filepath.Join(app.StreamDir(streamId), strconv.Itoa(min_partition), "0")
+			frameDir := strconv.Itoa(min_partition) + "/0"
 
-			frameFiles, err := ioutil.ReadDir(frameDir)
+			frameFiles, err := app.Store.ListDir(streamId, frameDir)
 			if err != nil {
 				panic("FATAL StreamSyncHandler(), can't read frameDir: " + frameDir)
 			}
-			for _, fileInfo := range frameFiles {
-				if fileInfo.Name() != "checkpoint_files" {
-					frames = append(frames, fileInfo.Name())
+			for _, name := range frameFiles {
+				if name != "checkpoint_files" {
+					frames = append(frames, name)
 				}
 			}
-			checkpointDir := filepath.Join(frameDir, "checkpoint_files")
-			checkpointFiles, err := ioutil.ReadDir(checkpointDir)
+			checkpoints, err := app.Store.ListDir(streamId, frameDir+"/checkpoint_files")
 			if err != nil {
-				panic("FATAL StreamSyncHandler(), can't read checkpointDir: " + checkpointDir)
-			}
-			for _, fileInfo := range checkpointFiles {
-				if fileInfo.Name() != "checkpoint_files" {
-					checkpoints = append(checkpoints, fileInfo.Name())
-				}
+				panic("FATAL StreamSyncHandler(), can't read checkpointDir: " + frameDir)
 			}
 			return frames, checkpoints
 		}
@@ -506,12 +675,16 @@ func (app *Application) StreamSyncHandler() AppHandler {
 			if stream.Owner != user {
 				return errors.New("You do not own this stream.")
 			}
-			partitions, err := app.ListPartitions(streamId)
+			partitions, err := app.Store.ListPartitions(streamId)
 			if err != nil {
 				return err
 			}
 			result["partitions"] = partitions
 			result["seed_files"] = listSeeds()
+			result["seed_versions"], err = app.ListSeedVersions(streamId)
+			if err != nil {
+				return err
+			}
 			if len(partitions) > 0 {
 				result["frame_files"], result["checkpoint_files"] = listFramesAndCheckpoints(partitions[0])
 			}
@@ -551,6 +724,213 @@ func (app *Application) StreamDisableHandler() AppHandler {
 	}
 }
 
+func (app *Application) StreamPriorityHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		type Message struct {
+			Priority *int     `json:"priority"`
+			Weight   *float64 `json:"weight"`
+		}
+		msg := Message{}
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&msg)
+		if err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		if msg.Weight != nil && *msg.Weight <= 0 {
+			return errors.New("Bad request: weight must be positive")
+		}
+		ordering := StreamOrdering{}
+		e := app.Manager.ModifyStreamOrdering(streamId, user, func(stream *Stream) error {
+			if msg.Priority != nil {
+				stream.Priority = *msg.Priority
+			}
+			if msg.Weight != nil {
+				stream.Weight = *msg.Weight
+			}
+			ordering = StreamOrdering{stream.Priority, stream.Weight}
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		app.deferWrite(DeferredOp{Type: DEFERRED_ORDERING, StreamId: streamId, Ordering: &ordering})
+		return nil
+	}
+}
+
+// Roll a stream back to the last partition at or below the given frame count. Partitions past it
+// are removed from disk, and the next core resumes from the last checkpoint of the kept partition.
+func (app *Application) StreamTruncateHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		type Message struct {
+			Frames *int `json:"frames"`
+		}
+		msg := Message{}
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&msg)
+		if err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		if msg.Frames == nil || *msg.Frames < 0 {
+			return errors.New("Bad request: frames must be a non-negative integer")
+		}
+		frames := 0
+		e := app.Manager.TruncateStream(streamId, user, func(stream *Stream) error {
+			partitions, err := app.Store.ListPartitions(streamId)
+			if err != nil {
+				return err
+			}
+			// the frame count is persisted even if only some partitions could be removed. It is
+			// queued behind the writes of the frames that were removed, which would otherwise
+			// overwrite it. PersistedFrames follows once it is applied.
+			defer func() {
+				app.deferWrite(DeferredOp{Type: DEFERRED_FRAMES, StreamId: streamId, Frames: &StreamFrames{stream.Frames}})
+				app.measureStream(stream)
+			}()
+			// remove the newest partitions first so a partial failure still leaves a valid stream
+			for i := len(partitions) - 1; i >= 0; i-- {
+				if partitions[i] <= *msg.Frames {
+					frames = partitions[i]
+					break
+				}
+				err = app.Store.Remove(streamId, strconv.Itoa(partitions[i]))
+				if err != nil {
+					stream.Frames = partitions[i]
+					return errors.New("Unable to remove partition " + strconv.Itoa(partitions[i]))
+				}
+			}
+			stream.Frames = frames
+			// seed versions past the kept partitions only produced removed ones, except the first
+			// which now covers the partitions up to frames
+			versions, err := app.ListSeedVersions(streamId)
+			if err != nil {
+				return err
+			}
+			for i := len(versions) - 1; i >= 0 && versions[i] > frames; i-- {
+				versionDir := "seeds/" + strconv.Itoa(versions[i])
+				if i > 0 && versions[i-1] >= frames {
+					err = app.Store.Remove(streamId, versionDir)
+				} else {
+					err = app.Store.Rename(streamId, versionDir, "seeds/"+strconv.Itoa(frames))
+				}
+				if err != nil {
+					return errors.New("Unable to remove seed version " + strconv.Itoa(versions[i]))
+				}
+			}
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		data, e := json.Marshal(map[string]int{"frames": frames})
+		if e != nil {
+			return e
+		}
+		w.Write(data)
+		return
+	}
+}
+
+// Replace some of the seed files of an inactive stream, and/or append a checkpoint to its current
+// partition that the next core resumes from. The seed files being replaced are first copied to
+// seeds/{frames} so earlier partitions remain tied to the files that produced them. An injected
+// checkpoint is not merged with the previous one, so it must contain every checkpoint file.
+func (app *Application) StreamReseedHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		type Message struct {
+			Files      map[string]string `json:"files"`
+			Checkpoint map[string]string `json:"checkpoint"`
+		}
+		msg := Message{}
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&msg)
+		if err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		if len(msg.Files) == 0 && len(msg.Checkpoint) == 0 {
+			return errors.New("Bad request: no files or checkpoint given")
+		}
+		for _, content := range []map[string]string{msg.Files, msg.Checkpoint} {
+			for filename := range content {
+				if filename == "" || filepath.Base(filename) != filename {
+					return errors.New("Bad request: invalid filename " + filename)
+				}
+			}
+		}
+		return app.Manager.ModifyInactiveStream(streamId, user, func(stream *Stream) error {
+			if len(msg.Checkpoint) > 0 && stream.Frames == 0 {
+				return errors.New("Stream has no frames to checkpoint, replace its seed files instead")
+			}
+			if len(msg.Files) > 0 {
+				versionDir := "seeds/" + strconv.Itoa(stream.Frames)
+				// if a version already exists the current seed files never produced a frame
+				if _, err := app.Store.Stat(streamId, versionDir); os.IsNotExist(err) {
+					seedFiles, err := readFiles(app.Store, streamId, "files")
+					if err != nil {
+						return errors.New("Cannot read seed files")
+					}
+					tmpDir := versionDir + ".tmp"
+					app.Store.Remove(streamId, tmpDir)
+					for filename, binary := range seedFiles {
+						err = app.Store.WriteFile(streamId, tmpDir+"/"+filename, binary)
+						if err != nil {
+							return errors.New("Cannot write seed version")
+						}
+					}
+					err = app.Store.Rename(streamId, tmpDir, versionDir)
+					if err != nil {
+						return errors.New("Cannot write seed version")
+					}
+				}
+				for filename, filestring := range msg.Files {
+					err := app.Store.WriteSeed(streamId, filename, []byte(filestring))
+					if err != nil {
+						return errors.New("Cannot write seed files")
+					}
+				}
+			}
+			if len(msg.Checkpoint) > 0 {
+				partition := strconv.Itoa(stream.Frames)
+				lastCheckpoint, err := app.Store.LastCheckpoint(streamId, stream.Frames)
+				if err != nil {
+					return errors.New("Cannot read partition " + partition)
+				}
+				checkpointDir := partition + "/" + strconv.Itoa(lastCheckpoint+1)
+				tmpDir := checkpointDir + ".tmp"
+				app.Store.Remove(streamId, tmpDir)
+				for filename, filestring := range msg.Checkpoint {
+					err := app.Store.WriteFile(streamId, tmpDir+"/checkpoint_files/"+filename, []byte(filestring))
+					if err != nil {
+						return errors.New("Cannot write checkpoint files")
+					}
+				}
+				// CoreStartHandler picks the checkpoint up once it has its final name
+				err = app.Store.Rename(streamId, tmpDir, checkpointDir)
+				if err != nil {
+					return errors.New("Cannot write checkpoint files")
+				}
+			}
+			app.measureStream(stream)
+			return nil
+		})
+	}
+}
+
 func (app *Application) StreamDeleteHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		streamId := mux.Vars(r)["stream_id"]
@@ -562,12 +942,8 @@ func (app *Application) StreamDeleteHandler() AppHandler {
 		if err != nil {
 			return err
 		}
-		fn1 := func() error {
-			return app.StreamsCursor().RemoveId(streamId)
-		}
-		app.statsMutex.Lock()
-		app.stats.PushBack(fn1)
-		app.statsMutex.Unlock()
+		app.usage.RemoveStream(streamId)
+		app.deferWrite(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: streamId})
 		return nil
 	}
 }
@@ -579,43 +955,201 @@ func (app *Application) StreamsHandler() AppHandler {
 			return auth_err
 		}
 		type Message struct {
-			TargetId string            `json:"target_id"`
-			Files    map[string]string `json:"files"`
-			Tags     map[string]string `json:"tags,omitempty"`
+			TargetId  string            `json:"target_id"`
+			Files     map[string]string `json:"files"`
+			Tags      map[string]string `json:"tags,omitempty"`
+			Priority  int               `json:"priority"`
+			Weight    float64           `json:"weight"`
+			MaxFrames int               `json:"max_frames"`
+			Engines   map[string]string `json:"engines,omitempty"`
 		}
-		msg := Message{}
+		msg := Message{Weight: 1}
 		decoder := json.NewDecoder(r.Body)
 		err = decoder.Decode(&msg)
 		if err != nil {
 			return errors.New("Bad request: " + err.Error())
 		}
+		if msg.Weight <= 0 {
+			return errors.New("Bad request: weight must be positive")
+		}
 		streamId := util.RandSeq(36)
-		// Add files to disk
 		stream := NewStream(streamId, msg.TargetId, user, 0, 0, int(time.Now().Unix()))
-		todo := map[string]map[string]string{"files": msg.Files, "tags": msg.Tags}
-		for Directory, Content := range todo {
-			for filename, fileb64 := range Content {
-				files_dir := filepath.Join(app.StreamDir(streamId), Directory)
-				os.MkdirAll(files_dir, 0776)
-				err = ioutil.WriteFile(filepath.Join(files_dir, filename), []byte(fileb64), 0776)
+		stream.Priority = msg.Priority
+		stream.Weight = msg.Weight
+		stream.MaxFrames = msg.MaxFrames
+		stream.Engines = msg.Engines
+		e := app.createStream(stream, msg.Files, msg.Tags)
+		if e != nil {
+			return e
+		}
+		data, err := json.Marshal(map[string]string{"stream_id": streamId})
+		if e != nil {
+			return e
+		}
+		w.Write(data)
+		return
+	}
+}
+
+// Write the seed files and tags of a new stream to disk, insert it into Mongo and add it to the Manager.
+func (app *Application) createStream(stream *Stream, files, tags map[string]string) (err error) {
+	if err = app.disk.Refuse(DISK_NO_STREAMS); err != nil {
+		return err
+	}
+	streamId := stream.StreamId
+	// Add files to disk
+	for filename, fileb64 := range files {
+		err = app.Store.WriteSeed(streamId, filename, []byte(fileb64))
+		if err != nil {
+			app.Store.RemoveStream(streamId)
+			return err
+		}
+	}
+	for filename, fileb64 := range tags {
+		err = app.Store.WriteFile(streamId, "tags/"+filename, []byte(fileb64))
+		if err != nil {
+			app.Store.RemoveStream(streamId)
+			return err
+		}
+	}
+	return app.insertStream(stream)
+}
+
+// Insert a stream whose directory is already in place into Mongo and add it to the Manager. The
+// directory is removed if the stream can not be inserted.
+func (app *Application) insertStream(stream *Stream) error {
+	err := app.writeStreamMetadata(stream)
+	if err == nil {
+		err = app.DB.Streams.Insert(stream)
+	}
+	if err != nil {
+		// clean up
+		app.Store.RemoveStream(stream.StreamId)
+		return errors.New("Unable insert stream into DB")
+	}
+	stream.PersistedFrames = stream.Frames
+	// Insert stream into Manager after ensuring state is correct.
+	if err = app.Manager.AddStream(stream, stream.TargetId, stream.MongoStatus == "enabled"); err != nil {
+		// the stream would only show up after a restart
+		app.DB.Streams.Remove(stream.StreamId)
+		app.Store.RemoveStream(stream.StreamId)
+		return err
+	}
+	app.measureUsage(stream)
+	return nil
+}
+
+// Create a new stream whose seed files are the files a core would have been started with at the
+// given partition and checkpoint of an existing stream, ie. the seed files of the parent overlaid
+// with the checkpoint files. Every partition but 0 starts with checkpoint 0, which is forked from
+// like any other. Partition 0 forks from the parent's seed files alone and takes no checkpoint.
+func (app *Application) StreamForkHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		parentId := mux.Vars(r)["stream_id"]
+		type Message struct {
+			TargetId   string            `json:"target_id"`  // defaults to the parent's target
+			Partition  *int              `json:"partition"`  // defaults to the last partition
+			Checkpoint *int              `json:"checkpoint"` // defaults to the last checkpoint of the partition
+			Tags       map[string]string `json:"tags,omitempty"`
+			Priority   int               `json:"priority"`
+			Weight     float64           `json:"weight"`
+			MaxFrames  int               `json:"max_frames"`
+			Engines    map[string]string `json:"engines,omitempty"` // defaults to the parent's engines
+		}
+		msg := Message{Weight: 1}
+		if r.Body != nil {
+			decoder := json.NewDecoder(r.Body)
+			err = decoder.Decode(&msg)
+			if err != nil && err != io.EOF {
+				return errors.New("Bad request: " + err.Error())
+			}
+		}
+		if msg.Weight <= 0 {
+			return errors.New("Bad request: weight must be positive")
+		}
+		var stream *Stream
+		files := make(map[string]string)
+		e := app.Manager.ReadStream(parentId, func(parent *Stream) error {
+			if parent.Owner != user {
+				return errors.New("You do not own this stream.")
+			}
+			partition := parent.Frames
+			if msg.Partition != nil {
+				partition = *msg.Partition
+			}
+			if msg.TargetId == "" {
+				msg.TargetId = parent.TargetId
+			}
+			if msg.Engines == nil {
+				msg.Engines = parent.Engines
+			}
+			var checkpoint *int
+			if partition > 0 {
+				partitions, err := app.Store.ListPartitions(parentId)
 				if err != nil {
 					return err
 				}
+				idx := sort.SearchInts(partitions, partition)
+				if idx == len(partitions) || partitions[idx] != partition {
+					return errors.New("Partition " + strconv.Itoa(partition) + " does not exist")
+				}
+				checkpoint = msg.Checkpoint
+				if checkpoint == nil {
+					last, err := app.Store.LastCheckpoint(parentId, partition)
+					if err != nil {
+						return errors.New("Cannot read partition " + strconv.Itoa(partition))
+					}
+					checkpoint = &last
+				} else if *checkpoint < 0 {
+					return errors.New("Checkpoint " + strconv.Itoa(*checkpoint) + " does not exist")
+				}
+				checkpointFiles, err := app.Store.ReadCheckpoint(parentId, partition, *checkpoint)
+				if err != nil {
+					return errors.New("Cannot read checkpoint " + strconv.Itoa(*checkpoint) + " of partition " + strconv.Itoa(partition))
+				}
+				for filename, binary := range checkpointFiles {
+					files[filename] = string(binary)
+				}
+			} else if partition < 0 {
+				return errors.New("Partition " + strconv.Itoa(partition) + " does not exist")
+			} else if msg.Checkpoint != nil {
+				return errors.New("Bad request: partition 0 is forked from the seed files, not a checkpoint")
 			}
+			seedDir, err := app.SeedDir(parentId, partition)
+			if err != nil {
+				return err
+			}
+			seedFiles, err := readFiles(app.Store, parentId, seedDir)
+			if err != nil {
+				return errors.New("Cannot read seed files")
+			}
+			for filename, binary := range seedFiles {
+				if _, ok := files[filename]; ok == false {
+					files[filename] = string(binary)
+				}
+			}
+			stream = NewStream(util.RandSeq(36), msg.TargetId, user, 0, 0, int(time.Now().Unix()))
+			stream.ParentId = parentId
+			stream.ParentPartition = partition
+			stream.ParentCheckpoint = checkpoint
+			return nil
+		})
+		if e != nil {
+			return e
 		}
-		cursor := app.StreamsCursor()
-		err = cursor.Insert(stream)
-		if err != nil {
-			// clean up
-			os.RemoveAll(app.StreamDir(streamId))
-			return errors.New("Unable insert stream into DB")
-		}
-		// Insert stream into Manager after ensuring state is correct.
-		e := app.Manager.AddStream(stream, msg.TargetId, true)
+		stream.Priority = msg.Priority
+		stream.Weight = msg.Weight
+		stream.MaxFrames = msg.MaxFrames
+		stream.Engines = msg.Engines
+		e = app.createStream(stream, files, msg.Tags)
 		if e != nil {
 			return e
 		}
-		data, err := json.Marshal(map[string]string{"stream_id": streamId})
+		data, e := json.Marshal(map[string]string{"stream_id": stream.StreamId})
 		if e != nil {
 			return e
 		}
@@ -642,142 +1176,218 @@ func (app *Application) StreamInfoHandler() AppHandler {
 	}
 }
 
-func pathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
+// Decode the frame files of a JSON message. Files may be base64 encoded, with a .b64 suffix, and
+// then also gzipped, with a .gz.b64 suffix.
+func decodeFrameJSON(body []byte, md5String string) (*coreFiles, error) {
+	type Message struct {
+		Files  map[string]string `json:"files"`
+		Frames int               `json:"frames"`
+	}
+	msg := Message{Frames: 1}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	err := decoder.Decode(&msg)
+	if err != nil {
+		return nil, errors.New("Could not decode JSON")
+	}
+	files := make(map[string][]byte)
+	size := int64(0)
+	for filename, filestring := range msg.Files {
+		root, ext := splitExt(filename)
+		filebin := []byte(filestring)
+		if ext == ".b64" {
+			filename = root
+			reader := base64.NewDecoder(base64.StdEncoding, bytes.NewReader(filebin))
+			filecopy, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			filebin = filecopy
+			root, ext := splitExt(filename)
+			if ext == ".gz" {
+				filename = root
+				reader, err := gzip.NewReader(bytes.NewReader(filebin))
+				if err != nil {
+					return nil, err
+				}
+				defer reader.Close()
+				filecopy, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return nil, err
+				}
+				filebin = filecopy
+			}
+		}
+		files[filename] = filebin
+		size += int64(len(filebin))
+	}
+	return &coreFiles{data: files, size: size, frames: float64(msg.Frames), hash: md5String}, nil
+}
+
+// Checkpoint files are sent as is.
+func decodeCheckpointJSON(body []byte, md5String string) (*coreFiles, error) {
+	type Message struct {
+		Files  map[string]string `json:"files"`
+		Frames float64           `json:"frames"`
+	}
+	msg := Message{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if err := decoder.Decode(&msg); err != nil {
+		return nil, errors.New("Could not decode JSON")
+	}
+	files := &coreFiles{data: make(map[string][]byte), frames: msg.Frames, hash: md5String}
+	for filename, filestring := range msg.Files {
+		files.data[filename] = []byte(filestring)
+		files.size += int64(len(filestring))
+	}
+	return files, nil
+}
+
+// Read the files of a frame or a checkpoint, from a binary upload or from a JSON message that
+// decode understands. Both are checked against their md5 before anything is written.
+func (app *Application) readCoreFiles(r *http.Request, frames float64, limit uploadLimit,
+	decode func(body []byte, md5String string) (*coreFiles, error)) (*coreFiles, error) {
+	if isUpload(r) {
+		return app.receiveUpload(r, frames, limit)
+	}
+	md5String := r.Header.Get("Content-MD5")
+	body, _ := ioutil.ReadAll(r.Body)
+	h := md5.New()
+	io.WriteString(h, string(body))
+	if md5String != hex.EncodeToString(h.Sum(nil)) {
+		return nil, errors.New("MD5 mismatch")
+	}
+	return decode(body, md5String)
+}
+
+// Check that a core still has its stream before receiving a binary upload from it, and limit the
+// upload to the free disk space above the Frames threshold and, if quota is set, to what the quotas
+// of the stream leave. Checkpoints are never refused for a quota, but still for the disk.
+func (app *Application) uploadLimit(r *http.Request, quota bool) (uploadLimit, error) {
+	limit := uploadLimit{bytes: -1}
+	if isUpload(r) == false {
+		return limit, nil
+	}
+	var streamId string
+	err := app.Manager.ModifyActiveStream(r.Header.Get("Authorization"), func(stream *Stream) error {
+		streamId = stream.StreamId
+		return nil
+	})
+	if err != nil {
+		return limit, err
+	}
+	if quota {
+		if tightest := app.usage.Tightest(streamId); tightest != nil {
+			limit = limit.min(tightest.Usage.left(), tightest)
+		}
 	}
-	if os.IsNotExist(err) {
-		return false, nil
+	if space := app.disk.FrameSpace(); space >= 0 {
+		free, _ := app.disk.Status()
+		limit = limit.min(space, &DiskSpaceError{DISK_NO_FRAMES, free})
 	}
-	return false, err
+	return limit, nil
 }
 
 func (app *Application) CoreFrameHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
 		token := r.Header.Get("Authorization")
-		md5String := r.Header.Get("Content-MD5")
-		body, _ := ioutil.ReadAll(r.Body)
-		h := md5.New()
-		io.WriteString(h, string(body))
-		if md5String != hex.EncodeToString(h.Sum(nil)) {
-			return errors.New("MD5 mismatch")
-		}
-		return app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
-			type Message struct {
-				Files  map[string]string `json:"files"`
-				Frames int               `json:"frames"`
-			}
-			msg := Message{Frames: 1}
-			decoder := json.NewDecoder(bytes.NewReader(body))
-			err := decoder.Decode(&msg)
-			if err != nil {
-				return errors.New("Could not decode JSON")
-			}
-			if md5String == stream.activeStream.frameHash {
-				return errors.New("POSTed same frame twice")
-			}
-			stream.activeStream.frameHash = md5String
-			for filename, filestring := range msg.Files {
-				root, ext := splitExt(filename)
-				filebin := []byte(filestring)
-				if ext == ".b64" {
-					filename = root
-					reader := base64.NewDecoder(base64.StdEncoding, bytes.NewReader(filebin))
-					filecopy, err := ioutil.ReadAll(reader)
-					if err != nil {
-						return err
-					}
-					filebin = filecopy
-					root, ext := splitExt(filename)
-					if ext == ".gz" {
-						filename = root
-						reader, err := gzip.NewReader(bytes.NewReader(filebin))
-						defer reader.Close()
-						if err != nil {
-							return err
-						}
-						filecopy, err := ioutil.ReadAll(reader)
-						if err != nil {
-							return err
-						}
-						filebin = filecopy
-					}
+		if err = app.disk.Refuse(DISK_NO_FRAMES); err != nil {
+			return err
+		}
+		limit, err := app.uploadLimit(r, true)
+		if err != nil {
+			return err
+		}
+		var streamId, owner string // set if the frame exceeds a quota
+		frame, err := app.readCoreFiles(r, 1, limit, decodeFrameJSON)
+		if err == nil {
+			defer frame.Close()
+			err = app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+				if frame.hash == stream.activeStream.frameHash {
+					return errors.New("POSTed same frame twice")
 				}
-				dir := filepath.Join(app.StreamDir(stream.StreamId), "buffer_files")
-				os.MkdirAll(dir, 0776)
-				filename = filepath.Join(dir, filename)
-				file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0776)
-				defer file.Close()
-				if err != nil {
+				if err := app.usage.Reserve(stream.StreamId, frame.size); err != nil {
+					streamId, owner = stream.StreamId, stream.Owner
 					return err
 				}
-				_, err = file.Write(filebin)
+				// nothing is appended if this fails, so the core can POST the frame again
+				files, err := frame.readers()
+				if err == nil {
+					err = app.Store.AppendFramesFrom(stream.StreamId, files)
+				}
 				if err != nil {
-					return err
+					app.usage.Add(stream.StreamId, -frame.size)
+					return errors.New("Unable to append frame")
 				}
+				stream.activeStream.frameHash = frame.hash
+				stream.activeStream.bufferFrames += 1
+				return nil
+			})
+		} else if _, ok := err.(*QuotaError); ok {
+			// the upload went past the quota before it was received
+			app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+				streamId, owner = stream.StreamId, stream.Owner
+				return nil
+			})
+		}
+		if streamId != "" {
+			// pause the stream until a manager frees space or raises the quota and starts it again
+			if e := app.Manager.DisableStream(streamId, owner); e != nil {
+				log.Printf("Warning: cannot pause stream %s: %s", streamId, e.Error())
 			}
-			stream.activeStream.bufferFrames += 1
-			return nil
-		})
+			log.Printf("Paused stream %s: %s", streamId, err.Error())
+		}
+		return err
 	}
 }
 
 func (app *Application) CoreCheckpointHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
 		token := r.Header.Get("Authorization")
-		md5String := r.Header.Get("Content-MD5")
-		body, _ := ioutil.ReadAll(r.Body)
-		h := md5.New()
-		io.WriteString(h, string(body))
-		if md5String != hex.EncodeToString(h.Sum(nil)) {
-			return errors.New("MD5 mismatch")
-		}
-		return app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
-			streamDir := app.StreamDir(stream.StreamId)
-			bufferDir := filepath.Join(streamDir, "buffer_files")
-			checkpointDir := filepath.Join(bufferDir, "checkpoint_files")
-			os.MkdirAll(checkpointDir, 0776)
-			type Message struct {
-				Files  map[string]string `json:"files"`
-				Frames float64           `json:"frames"`
-			}
-			msg := Message{}
-			decoder := json.NewDecoder(bytes.NewReader(body))
-			err := decoder.Decode(&msg)
+		limit, err := app.uploadLimit(r, false)
+		if err != nil {
+			return err
+		}
+		checkpoint, err := app.readCoreFiles(r, 0, limit, decodeCheckpointJSON)
+		if err != nil {
+			return err
+		}
+		defer checkpoint.Close()
+		err = app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+			files, err := checkpoint.readers()
 			if err != nil {
-				return errors.New("Could not decode JSON")
+				return errors.New("Unable to write checkpoint files")
 			}
-			for filename, filestring := range msg.Files {
-				fileDir := filepath.Join(checkpointDir, filename)
-				fileBin := []byte(filestring)
-				ioutil.WriteFile(fileDir, fileBin, 0776)
+			for filename, reader := range files {
+				err = app.Store.WriteCheckpointFrom(stream.StreamId, filename, reader)
+				if err != nil {
+					app.Store.Remove(stream.StreamId, "buffer_files/checkpoint_files")
+					return errors.New("Unable to write checkpoint files")
+				}
 			}
+			// checkpoints are never rejected, they are needed to resume the stream
+			app.usage.Add(stream.StreamId, checkpoint.size)
 			bufferFrames := stream.activeStream.bufferFrames
 			sumFrames := stream.Frames + bufferFrames
-			partition := filepath.Join(streamDir, strconv.Itoa(sumFrames))
-			os.MkdirAll(partition, 0766)
-			var renameDir string
-
-			if bufferFrames == 0 {
-				exist, _ := pathExists(partition)
-				if exist {
-					lastCheckpoint, _ := maxCheckpoint(partition)
-					renameDir = filepath.Join(partition, strconv.Itoa(lastCheckpoint+1))
-				} else {
-					renameDir = filepath.Join(partition, "1")
-				}
-			} else {
-				renameDir = filepath.Join(partition, "0")
+			// the frames stay buffered if this fails, and are committed with the next checkpoint
+			err = app.Store.CommitPartition(stream.StreamId, sumFrames)
+			if err != nil {
+				return errors.New("Unable to commit partition")
 			}
-			os.Rename(bufferDir, renameDir)
 			stream.Frames = sumFrames
-			stream.activeStream.donorFrames += msg.Frames
+			stream.LastCheckpoint = int(time.Now().Unix())
+			stream.activeStream.donorFrames += checkpoint.frames
 			stream.activeStream.bufferFrames = 0
-			// TODO: update frame count in MongoDB (do we want to?)
-			// This stream is mutex'd
+			// so that LoadStreams finds the same frame count in Mongo and on disk after a crash
+			done := StreamCheckpoint{Frames: stream.Frames, LastCheckpoint: stream.LastCheckpoint}
+			app.deferWrite(DeferredOp{Type: DEFERRED_CHECKPOINT, StreamId: stream.StreamId, Checkpoint: &done})
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+		// The stream may have expired in the meantime, DeactivateStream then completes it instead.
+		app.Manager.CheckCompletion(token)
+		return nil
 	}
 }
 
@@ -798,42 +1408,33 @@ func (app *Application) CoreStartHandler() AppHandler {
 			rep.StreamId = stream.StreamId
 			rep.TargetId = stream.TargetId
 			// Load stream's options from Mongo
-			cursor := app.Mongo.DB("data").C("targets")
 			mgoRes := make(map[string]interface{})
-			if err = cursor.Find(bson.M{"_id": stream.TargetId}).One(&mgoRes); err != nil {
+			if err = app.DB.Targets.Find(stream.TargetId, &mgoRes); err != nil {
 				return errors.New("Cannot load target's options")
 			}
 			rep.Options = mgoRes["options"]
 			// Load the streams' files
 			if stream.Frames > 0 {
-				frameDir := filepath.Join(app.StreamDir(rep.StreamId), strconv.Itoa(stream.Frames))
-				lastCheckpoint, _ := maxCheckpoint(frameDir)
-				checkpointDir := filepath.Join(frameDir, strconv.Itoa(lastCheckpoint), "checkpoint_files")
-				checkpointFiles, e := ioutil.ReadDir(checkpointDir)
+				lastCheckpoint, e := app.Store.LastCheckpoint(rep.StreamId, stream.Frames)
+				if e != nil {
+					return errors.New("Cannot find last checkpoint: " + e.Error())
+				}
+				checkpointFiles, e := app.Store.ReadCheckpoint(rep.StreamId, stream.Frames, lastCheckpoint)
 				if e != nil {
 					return errors.New("Cannot load checkpoint directory")
 				}
-				for _, fileProp := range checkpointFiles {
-					binary, e := ioutil.ReadFile(filepath.Join(checkpointDir, fileProp.Name()))
-					if e != nil {
-						return errors.New("Cannot read checkpoint file")
-					}
-					rep.Files[fileProp.Name()] = string(binary)
+				for filename, binary := range checkpointFiles {
+					rep.Files[filename] = string(binary)
 				}
 			}
-			seedDir := filepath.Join(app.StreamDir(rep.StreamId), "files")
-			seedFiles, e := ioutil.ReadDir(seedDir)
+			seedFiles, e := readFiles(app.Store, rep.StreamId, "files")
 			if e != nil {
-				return errors.New("Cannot read seed directory")
+				return errors.New("Cannot read seed files")
 			}
-			for _, fileProp := range seedFiles {
-				_, ok := rep.Files[fileProp.Name()]
+			for filename, binary := range seedFiles {
+				_, ok := rep.Files[filename]
 				if ok == false {
-					binary, e := ioutil.ReadFile(filepath.Join(seedDir, fileProp.Name()))
-					if e != nil {
-						return errors.New("Cannot read seed files")
-					}
-					rep.Files[fileProp.Name()] = string(binary)
+					rep.Files[filename] = string(binary)
 				}
 			}
 			return nil
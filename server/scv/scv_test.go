@@ -1,20 +1,25 @@
 package scv
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -29,7 +34,8 @@ var _ = fmt.Printf
 var serverAddr string = "http://127.0.0.1/streams/wowsogood"
 
 type Fixture struct {
-	app *Application
+	app   *Application
+	mongo *MemoryMongo
 }
 
 func (f *Fixture) addUser(user string) (token string) {
@@ -38,16 +44,16 @@ func (f *Fixture) addUser(user string) (token string) {
 		Id    string `bson:"_id"`
 		Token string `bson:"token"`
 	}
-	f.app.Mongo.DB("users").C("all").Insert(Msg{user, token})
+	f.mongo.C("users", "all").Insert(Msg{user, token})
 	return
 }
 
 func (f *Fixture) addTarget(targetId, owner, options string) {
-	type Msg struct {
-		Id    string `bson:"_id"`
-		Owner string `bson:"owner"`
-	}
-	f.app.Mongo.DB("data").C("targets").Insert(Msg{targetId, owner})
+	msg := bson.M{}
+	json.Unmarshal([]byte(options), &msg)
+	msg["_id"] = targetId
+	msg["owner"] = owner
+	f.mongo.C("data", "targets").Insert(msg)
 	return
 }
 
@@ -57,7 +63,7 @@ func (f *Fixture) addManager(user string, weight int) (token string) {
 		Id     string `bson:"_id"`
 		Weight int    `bson:"weight"`
 	}
-	f.app.Mongo.DB("users").C("managers").Insert(Msg{user, weight})
+	f.mongo.C("users", "managers").Insert(Msg{user, weight})
 	return
 }
 
@@ -69,23 +75,25 @@ func NewFixture() *Fixture {
 		ExternalHost: "alexis.stanford.edu",
 		InternalHost: "127.0.0.1",
 	}
+	os.RemoveAll(config.Name + "_data")
+	mongo := NewMemoryMongo()
 	f := Fixture{
-		app: NewApplication(config),
-	}
-	db_names, _ := f.app.Mongo.DatabaseNames()
-	for _, name := range db_names {
-		f.app.Mongo.DB(name).DropDatabase()
+		app:   NewApplicationWithDatabase(config, NewMemoryDatabase(mongo, config.Name)),
+		mongo: mongo,
 	}
-	os.RemoveAll(f.app.Config.Name + "_data")
 	go f.app.RecordDeferredDocs()
 	return &f
 }
 
+// Replace the manager as if the SCV had restarted. The deferred writes are applied through
+// app.Manager, so they are held back meanwhile.
+func (f *Fixture) resetManager() {
+	f.app.deferred.draining.Lock()
+	defer f.app.deferred.draining.Unlock()
+	f.app.Manager = NewManager(f.app)
+}
+
 func (f *Fixture) shutdown() {
-	db_names, _ := f.app.Mongo.DatabaseNames()
-	for _, name := range db_names {
-		f.app.Mongo.DB(name).DropDatabase()
-	}
 	os.RemoveAll(f.app.Config.Name + "_data")
 	f.app.Shutdown()
 }
@@ -161,6 +169,27 @@ func (f *Fixture) activateStream(target_id, engine, user, cc_token string) (toke
 	return
 }
 
+func (f *Fixture) activateStreamWait(target_id, engine, user, cc_token string, wait int) (token string, code int) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"target_id": target_id,
+		"engine":    engine,
+		"user":      user,
+		"wait":      wait,
+	})
+	req, _ := http.NewRequest("POST", "/streams/activate", bytes.NewBuffer(data))
+	req.Header.Add("Authorization", cc_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	code = w.Code
+	if code != 200 {
+		return
+	}
+	result := make(map[string]string)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	token = result["token"]
+	return
+}
+
 func (f *Fixture) getStream(stream_id string) (result Stream, code int) {
 	req, _ := http.NewRequest("GET", "/streams/info/"+stream_id, nil)
 	w := httptest.NewRecorder()
@@ -256,6 +285,132 @@ func (f *Fixture) postStream(token string, data string) (stream_id string, code
 	return
 }
 
+func (f *Fixture) streamPriority(token, streamId, data string) int {
+	req, _ := http.NewRequest("PUT", "/streams/priority/"+streamId, bytes.NewBuffer([]byte(data)))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func (f *Fixture) forkStream(token, streamId, data string) (stream_id string, code int) {
+	req, _ := http.NewRequest("POST", "/streams/fork/"+streamId, bytes.NewBuffer([]byte(data)))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	code = w.Code
+	if code != 200 {
+		return
+	}
+	stream_map := make(map[string]string)
+	json.Unmarshal(w.Body.Bytes(), &stream_map)
+	stream_id = stream_map["stream_id"]
+	return
+}
+
+func (f *Fixture) truncateStream(token, streamId, data string) (frames int, code int) {
+	req, _ := http.NewRequest("PUT", "/streams/truncate/"+streamId, bytes.NewBuffer([]byte(data)))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	code = w.Code
+	if code != 200 {
+		return
+	}
+	frames_map := make(map[string]int)
+	json.Unmarshal(w.Body.Bytes(), &frames_map)
+	frames = frames_map["frames"]
+	return
+}
+
+func (f *Fixture) reseedStream(token, streamId, data string) int {
+	req, _ := http.NewRequest("PUT", "/streams/reseed/"+streamId, bytes.NewBuffer([]byte(data)))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
+// Returns a second application sharing Mongo with the fixture, as if it were another SCV.
+func (f *Fixture) peer(name string) *Fixture {
+	config := f.app.Config
+	config.Name = name
+	os.RemoveAll(config.Name + "_data")
+	p := Fixture{
+		app:   NewApplicationWithDatabase(config, NewMemoryDatabase(f.mongo, config.Name)),
+		mongo: f.mongo,
+	}
+	go p.app.RecordDeferredDocs()
+	return &p
+}
+
+func (f *Fixture) exportArchive(token, streamId, query string) (archive []byte, code int) {
+	req, _ := http.NewRequest("GET", "/streams/export/"+streamId+query, nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Body.Bytes(), w.Code
+}
+
+// Returns the content of every entry of the exported archive, by name.
+func (f *Fixture) exportStream(token, streamId, query string) (entries map[string][]byte, code int) {
+	archive, code := f.exportArchive(token, streamId, query)
+	if code != 200 {
+		return
+	}
+	var reader io.Reader = bytes.NewReader(archive)
+	if strings.Contains(query, "gzip") {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, 0
+		}
+		reader = gz
+	}
+	entries = make(map[string][]byte)
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0
+		}
+		entries[hdr.Name], _ = ioutil.ReadAll(tr)
+	}
+	return
+}
+
+func (f *Fixture) trajectory(token, streamId, file, query string) (data []byte, partitions string, code int) {
+	req, _ := http.NewRequest("GET", "/streams/trajectory/"+streamId+"/"+file+query, nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Body.Bytes(), w.Header().Get("X-Partitions"), w.Code
+}
+
+func (f *Fixture) importStream(token string, archive []byte) (stream_id string, code int) {
+	req, _ := http.NewRequest("POST", "/streams/import", bytes.NewReader(archive))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	code = w.Code
+	if code != 200 {
+		return
+	}
+	stream_map := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &stream_map)
+	stream_id = stream_map["stream_id"].(string)
+	return
+}
+
+func (f *Fixture) migrateStream(token, streamId, scv string) (code int) {
+	req, _ := http.NewRequest("POST", "/streams/migrate/"+streamId, bytes.NewBuffer([]byte(`{"scv": "`+scv+`"}`)))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
 func (f *Fixture) deleteStream(token, streamId string) (code int) {
 	req, _ := http.NewRequest("PUT", "/streams/delete/"+streamId, nil)
 	req.Header.Add("Authorization", token)
@@ -297,9 +452,8 @@ func (f *Fixture) coreStart(token string) (streamId string, code int) {
 }
 
 func (f *Fixture) loadMongoStream(stream_id string) map[string]interface{} {
-	cursor := f.app.Mongo.DB("streams").C(f.app.Config.Name)
 	result := make(map[string]interface{})
-	cursor.Find(bson.M{"_id": stream_id}).One(&result)
+	f.app.DB.Streams.Find(stream_id, &result)
 	return result
 }
 
@@ -307,9 +461,8 @@ func TestRegisterSCV(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
 	f.app.RegisterSCV()
-	config := Configuration{}
-	cursor := f.app.Mongo.DB("servers").C("scvs")
-	cursor.FindId(f.app.Config.Name).One(&config)
+	config, err := f.app.DB.Servers.Find(f.app.Config.Name)
+	assert.Nil(t, err)
 	assert.Equal(t, config.Name, f.app.Config.Name)
 	assert.Equal(t, config.ExternalHost, f.app.Config.ExternalHost)
 	assert.Equal(t, config.Password, f.app.Config.Password)
@@ -323,7 +476,7 @@ func TestLoadStreamsSuccess(t *testing.T) {
 		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
 		"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
 	f.postStream(token, jsonData)
-	f.app.Manager = NewManager(f.app)
+	f.resetManager()
 	defer func() {
 		if recover() != nil {
 			assert.True(t, false)
@@ -333,7 +486,7 @@ func TestLoadStreamsSuccess(t *testing.T) {
 }
 
 func TestLoadStreamsExistsInMongo(t *testing.T) {
-	// Streams that exist in Mongo but not on disk throws a panic.
+	// Streams that exist in Mongo but not on disk are skipped.
 	f := NewFixture()
 	defer f.shutdown()
 	token := f.addManager("yutong", 1)
@@ -341,35 +494,104 @@ func TestLoadStreamsExistsInMongo(t *testing.T) {
 		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
 		"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
 	stream_id, _ := f.postStream(token, jsonData)
+	good_id, _ := f.postStream(token, jsonData)
 
-	os.RemoveAll(f.app.StreamDir(stream_id))
+	f.app.Store.RemoveStream(stream_id)
 
-	defer func() {
-		if recover() != nil {
-			// passed
-		} else {
-			// failed
-			assert.True(t, false)
-		}
-	}()
+	f.resetManager()
+	f.app.LoadStreams()
+	_, code := f.getStream(stream_id)
+	assert.Equal(t, code, 400)
+	_, code = f.getStream(good_id)
+	assert.Equal(t, code, 200)
+	// the document is kept until the data is restored or fsck forgets it
+	assert.Equal(t, f.loadMongoStream(stream_id)["_id"], stream_id)
+}
+
+func TestLoadStreamsPendingDelete(t *testing.T) {
+	// Streams whose deferred delete has not been applied yet stay deleted.
+	f := NewFixture()
+	defer f.shutdown()
+	token := f.addManager("yutong", 1)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	stream_id, _ := f.postStream(token, jsonData)
+	good_id, _ := f.postStream(token, jsonData)
+	// as if Mongo had been failing, the delete waits for its next attempt
+	assert.Nil(t, f.app.Manager.RemoveStream(stream_id, "yutong"))
+	f.app.deferred.Push(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: stream_id, Attempts: 5,
+		NextTry: time.Now().Add(time.Hour)})
+
+	f.resetManager()
 	f.app.LoadStreams()
+	_, code := f.getStream(stream_id)
+	assert.Equal(t, code, 400)
+	_, code = f.getStream(good_id)
+	assert.Equal(t, code, 200)
+	// the files are left for the delete rather than quarantined
+	_, err := f.app.Store.Stat(stream_id, "files/openmm")
+	assert.Nil(t, err)
 }
 
 func TestLoadStreamsExistsOnDisk(t *testing.T) {
-	// Streams that exist on disk but not in Mongo are deleted
+	// Streams that exist on disk but not in Mongo are left for fsck to quarantine
 	f := NewFixture()
 	defer f.shutdown()
 
 	someString := "blah"
 
-	os.MkdirAll(f.app.StreamDir("1234"), 0776)
-	err := ioutil.WriteFile(filepath.Join(f.app.StreamDir("1234"), "output.txt"), []byte(someString), 0776)
+	err := f.app.Store.WriteFile("1234", "output.txt", []byte(someString))
 	assert.Nil(t, err)
-	_, err = ioutil.ReadDir(f.app.StreamDir("1234"))
+	_, err = f.app.Store.Stat("1234", "")
 	assert.Nil(t, err)
 	f.app.LoadStreams()
-	_, err = ioutil.ReadDir(f.app.StreamDir("1234"))
+	_, code := f.getStream("1234")
+	assert.Equal(t, code, 400)
+	_, err = f.app.Store.Stat("1234", "output.txt")
+	assert.Nil(t, err)
+	_, err = f.app.Fsck(FsckOptions{Repair: true})
+	assert.Nil(t, err)
+	_, err = f.app.Store.Stat("1234", "")
 	assert.NotNil(t, err)
+	quarantined, err := filepath.Glob(filepath.Join(f.app.Config.Name+"_data", "quarantine", "1234.*", "output.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(quarantined), 1)
+}
+
+// Fails to recover the given stream.
+type failingRecoverStore struct {
+	StreamStore
+	streamId string
+}
+
+func (s failingRecoverStore) Recover(streamId string) ([]string, error) {
+	if streamId == s.streamId {
+		return nil, errors.New("cannot recover " + streamId)
+	}
+	return s.StreamStore.Recover(streamId)
+}
+
+func TestLoadStreamsSkipsBroken(t *testing.T) {
+	// Streams that cannot be loaded are skipped instead of stopping the SCV
+	f := NewFixture()
+	defer f.shutdown()
+	token := f.addManager("yutong", 1)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	unknown_id, _ := f.postStream(token, jsonData)
+	broken_id, _ := f.postStream(token, jsonData)
+	good_id, _ := f.postStream(token, jsonData)
+	f.app.DB.Streams.Update(unknown_id, bson.M{"status": "bogus"})
+	f.app.Store = failingRecoverStore{f.app.Store, broken_id}
+
+	f.resetManager()
+	f.app.LoadStreams()
+	_, code := f.getStream(unknown_id)
+	assert.Equal(t, code, 400)
+	_, code = f.getStream(broken_id)
+	assert.Equal(t, code, 400)
+	_, code = f.getStream(good_id)
+	assert.Equal(t, code, 200)
 }
 
 func TestLoadStreamsInconsistentFrames(t *testing.T) {
@@ -388,11 +610,11 @@ func TestLoadStreamsInconsistentFrames(t *testing.T) {
 	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 200)
 
 	// manually hack Mongo to use a different frame count.
-	err := f.app.StreamsCursor().UpdateId(stream_id, bson.M{"$set": bson.M{"frames": "50"}})
+	err := f.app.DB.Streams.Update(stream_id, bson.M{"frames": "50"})
 	assert.Nil(t, err)
 	stream, code := f.getStream(stream_id)
 	assert.Equal(t, code, 200)
-	f.app.Manager = NewManager(f.app)
+	f.resetManager()
 	f.app.LoadStreams()
 	stream, code = f.getStream(stream_id)
 	assert.Equal(t, code, 200)
@@ -409,7 +631,7 @@ func TestLoadDisabledStreams(t *testing.T) {
 	auth_token := f.addManager("yutong", 1)
 	stream_id, _ := f.postStream(auth_token, jsonData)
 	assert.Equal(t, f.streamStop(auth_token, stream_id), 200)
-	f.app.Manager = NewManager(f.app)
+	f.resetManager()
 	f.app.LoadStreams()
 	stream, code := f.getStream(stream_id)
 	assert.Equal(t, code, 200)
@@ -435,7 +657,7 @@ func TestLoadStreamsErrorCount(t *testing.T) {
 	}
 	// It takes some time to insert the stream's status into Mongo
 	time.Sleep(1 * time.Second)
-	f.app.Manager = NewManager(f.app)
+	f.resetManager()
 	f.app.LoadStreams()
 	stream, code := f.getStream(stream_id)
 	assert.Equal(t, code, 200)
@@ -459,7 +681,7 @@ func TestLoadStreamsErrorCountOK(t *testing.T) {
 	}
 	// It takes some time to insert the stream's status into Mongo
 	time.Sleep(1 * time.Second)
-	f.app.Manager = NewManager(f.app)
+	f.resetManager()
 	f.app.LoadStreams()
 	stream, code := f.getStream(stream_id)
 	assert.Equal(t, code, 200)
@@ -495,9 +717,7 @@ func TestPostStream(t *testing.T) {
 	stream_id, code = f.postStream(token, jsonData)
 	assert.Equal(t, code, 200)
 
-	cursor := f.app.Mongo.DB("streams").C(f.app.Config.Name)
-	result := make(map[string]interface{})
-	cursor.Find(bson.M{"_id": stream_id}).One(&result)
+	result := f.loadMongoStream(stream_id)
 
 	assert.Equal(t, result["frames"].(int), 0)
 	assert.Equal(t, result["error_count"].(int), 0)
@@ -517,12 +737,12 @@ func TestDeleteStreamMulti(t *testing.T) {
 	stream1, _ := f.postStream(token, jsonData)
 	stream2, _ := f.postStream(token, jsonData)
 	assert.Equal(t, f.deleteStream(token, stream1), 200)
-	time.Sleep(time.Second)
-	count, _ := f.app.StreamsCursor().Count()
+	time.Sleep(2 * time.Second)
+	count, _ := f.app.DB.Streams.Count()
 	assert.Equal(t, count, 1)
 	assert.Equal(t, f.deleteStream(token, stream2), 200)
-	time.Sleep(time.Second)
-	count, _ = f.app.StreamsCursor().Count()
+	time.Sleep(2 * time.Second)
+	count, _ = f.app.DB.Streams.Count()
 	assert.Equal(t, count, 0)
 
 }
@@ -538,9 +758,11 @@ func TestDeleteStream(t *testing.T) {
 	assert.Equal(t, f.deleteStream(token, stream_id), 200)
 	assert.Equal(t, len(f.app.Manager.streams), 0)
 	assert.Equal(t, len(f.app.Manager.targets), 0)
-	time.Sleep(time.Second)
-	count, _ := f.app.StreamsCursor().Count()
+	time.Sleep(2 * time.Second)
+	count, _ := f.app.DB.Streams.Count()
 	assert.Equal(t, count, 0)
+	_, err := f.app.Store.Stat(stream_id, "")
+	assert.True(t, os.IsNotExist(err))
 }
 
 func TestDeleteActiveStream(t *testing.T) {
@@ -556,8 +778,8 @@ func TestDeleteActiveStream(t *testing.T) {
 	assert.Equal(t, f.deleteStream(token, stream_id), 200)
 	assert.Equal(t, len(f.app.Manager.streams), 0)
 	assert.Equal(t, len(f.app.Manager.targets), 0)
-	time.Sleep(time.Second)
-	count, _ := f.app.StreamsCursor().Count()
+	time.Sleep(2 * time.Second)
+	count, _ := f.app.DB.Streams.Count()
 	assert.Equal(t, count, 0)
 }
 
@@ -580,8 +802,8 @@ func TestDeleteDisabledStream(t *testing.T) {
 	assert.Equal(t, f.deleteStream(auth_token, stream_id), 200)
 	assert.Equal(t, len(f.app.Manager.streams), 0)
 	assert.Equal(t, len(f.app.Manager.targets), 0)
-	time.Sleep(time.Second)
-	count, _ := f.app.StreamsCursor().Count()
+	time.Sleep(2 * time.Second)
+	count, _ := f.app.DB.Streams.Count()
 	assert.Equal(t, count, 0)
 }
 
@@ -701,109 +923,985 @@ func TestStreamActivation(t *testing.T) {
 	assert.Equal(t, code, 400)
 }
 
-func TestBadCoreStart(t *testing.T) {
+func TestTargetSchedulingPolicy(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
-	req, _ := http.NewRequest("GET", "/core/start", nil)
-	req.Header.Add("Authorization", "bad_token")
-	w := httptest.NewRecorder()
-	f.app.Router.ServeHTTP(w, req)
-	assert.Equal(t, w.Code, 400)
+	auth_token := f.addManager("yutong", 1)
+	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1, "scheduling": "fewest_frames"}}`)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "b123",
+		"amber": "b234"}}`
+	_, code := f.postStream(auth_token, jsonData)
+	assert.Equal(t, code, 200)
+	_, code = f.postStream(auth_token, strings.Replace(jsonData, "12345", "54321", 1))
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.app.Manager.targets["12345"].policy, fewestFramesPolicy{})
+	assert.Equal(t, f.app.Manager.targets["54321"].policy, mostFramesPolicy{})
 }
 
-func TestHammerTime(t *testing.T) {
+func TestStreamPriority(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
-
-	auth_token := f.addManager("yutong", 1)
-
-	streams := make([]string, 0)
-	nTargets := 5
-	nStreams := 20
-	nActivations := 29
-	nCycles := 12
-
-	for j := 0; j < nTargets; j++ {
-		target_id := "target_" + strconv.Itoa(j)
-		jsonData := `{"target_id":"` + target_id + `",
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
 				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
 				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
-		f.addTarget(target_id, "yutong", `{"options": {"steps_per_frame": 1}}`)
-		for i := 0; i < nStreams; i++ {
-			stream_id, code := f.postStream(auth_token, jsonData)
-			assert.Equal(t, code, 200)
-			streams = append(streams, stream_id)
-		}
-	}
+	f.addTarget(target_id, "yutong", `{"options": {"steps_per_frame": 1}}`)
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, jsonData)
+	stream_id, _ := f.postStream(auth_token, jsonData)
+	stream, code := f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.Priority, 0)
+	assert.Equal(t, stream.Weight, 1.0)
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	frameCounts := make(map[string]int)
-	consecutiveCheckpoints := make(map[string]int)
-	for j := 0; j < nTargets; j++ {
-		target_id := "target_" + strconv.Itoa(j)
-		for i := 0; i < nStreams; i++ {
-			wg.Add(1)
-			go func() {
-				for j := 0; j < nActivations; j++ {
-					token, code := f.activateStream(target_id, "some_engine", "some_user", f.app.Config.Password)
-					assert.Equal(t, code, 200)
-					streamId, code := f.coreStart(token)
-					for i := 0; i < nCycles; i++ {
-						var concatBin string
-						fCount := rand.Intn(4)
-						for j := 0; j < fCount; j++ {
-							data := util.RandSeq(10)
-							concatBin += data
-							assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "`+data+`"}}`), 200)
-							time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
-							assert.Equal(t, f.coreHeartbeat(token), 200)
-							time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
-						}
-						mu.Lock()
-						frameCounts[streamId] += fCount
-						nFrames := frameCounts[streamId]
-						if fCount == 0 {
-							consecutiveCheckpoints[streamId] += 1
-						} else {
-							consecutiveCheckpoints[streamId] = 0
-						}
-						consChkpt := consecutiveCheckpoints[streamId]
-						mu.Unlock()
-						assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.streamPriority(auth_token, stream_id, `{"weight": -1}`), 400)
+	assert.Equal(t, f.streamPriority(auth_token, "bad_stream", `{"priority": 3}`), 400)
+	assert.Equal(t, f.streamPriority(auth_token, stream_id, `{"priority": 3}`), 200)
+	stream, code = f.getStream(stream_id)
+	assert.Equal(t, stream.Priority, 3)
+	assert.Equal(t, stream.Weight, 1.0)
+	assert.Equal(t, f.streamPriority(auth_token, stream_id, `{"weight": 2.5}`), 200)
+	stream, code = f.getStream(stream_id)
+	assert.Equal(t, stream.Priority, 3)
+	assert.Equal(t, stream.Weight, 2.5)
 
-						if fCount > 0 {
-							frameBin := f.downloadFrame(auth_token, streamId, "some_file", nFrames)
-							if concatBin != string(frameBin) {
-								fmt.Println(streamId, nFrames, "EXPECTED", concatBin, "GOT", string(frameBin))
-							}
-							assert.Equal(t, concatBin, string(frameBin))
-						}
-						url := strconv.Itoa(nFrames) + "/" + strconv.Itoa(consChkpt) + "/checkpoint_files/chkpt"
-						chkptBin := f.download(auth_token, streamId, url)
-						assert.Equal(t, "data", string(chkptBin))
-					}
-					assert.Equal(t, f.coreStop(token, ""), 200)
-				}
-				wg.Done()
-			}()
-		}
-	}
-	wg.Wait()
+	// Mongo is updated in the background
+	time.Sleep(2 * time.Second)
+	result := f.loadMongoStream(stream_id)
+	assert.Equal(t, result["priority"].(int), 3)
+	assert.Equal(t, result["weight"].(float64), 2.5)
+
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	streamId, code := f.coreStart(token)
+	assert.Equal(t, streamId, stream_id)
 }
 
-func TestStreamCheckpoint(t *testing.T) {
+func TestEngineActivation(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
 	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"steps_per_frame": 1, "engines": {"openmm": "6.2"}}}`)
 	jsonData := `{"target_id":"` + target_id + `",
 				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
 				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
 	auth_token := f.addManager("yutong", 1)
-	streamId, code := f.postStream(auth_token, jsonData)
-	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	f.postStream(auth_token, jsonData)
+	_, code := f.activateStream(target_id, "openmm@6.0", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+	_, code = f.activateStream(target_id, "terachem", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+	token, code := f.activateStream(target_id, "openmm@6.3", "some_donor", f.app.Config.Password)
 	assert.Equal(t, code, 200)
-	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data1"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+}
+
+func TestStreamEngines(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `", "engines": {"openmm": "7.0"},
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, code := f.postStream(auth_token, jsonData)
+	assert.Equal(t, code, 200)
+	stream, _ := f.getStream(streamId)
+	assert.Equal(t, stream.Engines, map[string]string{"openmm": "7.0"})
+	assert.Equal(t, f.loadMongoStream(streamId)["engines"], map[string]interface{}{"openmm": "7.0"})
+	_, code = f.activateStream(target_id, "openmm@6.2", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+	token, code := f.activateStream(target_id, "openmm@7.1", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	// forks keep the requirements of their parent unless they have their own
+	forkId, code := f.forkStream(auth_token, streamId, `{"partition": 0}`)
+	assert.Equal(t, code, 200)
+	stream, _ = f.getStream(forkId)
+	assert.Equal(t, stream.Engines, map[string]string{"openmm": "7.0"})
+	forkId, code = f.forkStream(auth_token, streamId, `{"partition": 0, "engines": {}}`)
+	assert.Equal(t, code, 200)
+	stream, _ = f.getStream(forkId)
+	assert.Empty(t, stream.Engines)
+	_, code = f.activateStream(target_id, "gromacs", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+}
+
+func TestStreamActivationWait(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	start := time.Now()
+	_, code = f.activateStreamWait(target_id, "some_engine", "other_donor", f.app.Config.Password, 1)
+	assert.Equal(t, code, 400)
+	assert.True(t, time.Since(start) >= time.Second)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		assert.Equal(t, f.coreStop(token, ""), 200)
+	}()
+	token, code = f.activateStreamWait(target_id, "some_engine", "other_donor", f.app.Config.Password, 5)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+}
+
+func TestStreamActivationAnyTarget(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	yutong := f.addManager("yutong", 1)
+	vijay := f.addManager("vijay", 3)
+	f.addTarget("target_y", "yutong", `{"options": {"steps_per_frame": 1}}`)
+	f.addTarget("target_v", "vijay", `{"options": {"steps_per_frame": 1}}`)
+	for i := 0; i < 10; i++ {
+		_, code := f.postStream(yutong, `{"target_id":"target_y", "files": {"openmm": "b123"}}`)
+		assert.Equal(t, code, 200)
+		_, code = f.postStream(vijay, `{"target_id":"target_v", "files": {"openmm": "b123"}}`)
+		assert.Equal(t, code, 200)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		token, code := f.activateStream("", "some_engine", "some_donor", f.app.Config.Password)
+		assert.Equal(t, code, 200)
+		stream := f.app.Manager.tokens[token]
+		counts[stream.TargetId] += 1
+	}
+	assert.Equal(t, counts["target_y"], 2)
+	assert.Equal(t, counts["target_v"], 6)
+}
+
+func TestStreamCompletion(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"steps_per_frame": 1, "max_frames": 3}}`)
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"openmm": "b123"}}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "`+strconv.Itoa(i)+`"}}`), 200)
+	}
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 200)
+	// the token is no longer valid after the stream is completed
+	assert.Equal(t, f.coreHeartbeat(token), 400)
+	stream, code := f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "completed")
+	assert.Equal(t, stream.Frames, 3)
+	assert.Equal(t, f.streamStart(auth_token, stream_id), 400)
+
+	time.Sleep(2 * time.Second)
+	result := f.loadMongoStream(stream_id)
+	assert.Equal(t, result["status"].(string), "completed")
+	assert.Equal(t, result["frames"].(int), 3)
+
+	// streams can override the target's max_frames
+	other_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"openmm": "b123"}, "max_frames": 5}`)
+	assert.Equal(t, code, 200)
+	stream, _ = f.getStream(other_id)
+	assert.Equal(t, stream.MaxFrames, 5)
+
+	f.resetManager()
+	f.app.LoadStreams()
+	targetImpl := f.app.Manager.targets[target_id]
+	assert.Equal(t, len(targetImpl.completedStreams), 1)
+	assert.Equal(t, targetImpl.inactiveStreams.Len(), 1)
+}
+
+func TestStreamTruncate(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"steps_per_frame": 1}}`)
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "`+strconv.Itoa(i)+`"}}`), 200)
+		assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt`+strconv.Itoa(i)+`"}, "frames": 0.234}`), 200)
+	}
+	// active streams can not be truncated
+	_, code = f.truncateStream(auth_token, stream_id, `{"frames": 1}`)
+	assert.Equal(t, code, 400)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	_, code = f.truncateStream(auth_token, stream_id, `{}`)
+	assert.Equal(t, code, 400)
+	_, code = f.truncateStream(auth_token, stream_id, `{"frames": -1}`)
+	assert.Equal(t, code, 400)
+	other_token := f.addManager("vijay", 1)
+	_, code = f.truncateStream(other_token, stream_id, `{"frames": 1}`)
+	assert.Equal(t, code, 400)
+
+	frames, code := f.truncateStream(auth_token, stream_id, `{"frames": 2}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, frames, 2)
+	partitions, _ := f.app.Store.ListPartitions(stream_id)
+	assert.Equal(t, partitions, []int{1, 2})
+	stream, _ := f.getStream(stream_id)
+	assert.Equal(t, stream.Frames, 2)
+	// the frame count is written after the updates the core queued for the removed frames
+	time.Sleep(2 * time.Second)
+	result := f.loadMongoStream(stream_id)
+	assert.Equal(t, result["frames"].(int), 2)
+	stream, _ = f.getStream(stream_id)
+	assert.Equal(t, stream.PersistedFrames, 2)
+
+	// the next core resumes from the last checkpoint of the kept partition
+	token, code = f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	req, _ := http.NewRequest("GET", "/core/start", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	type Reply struct {
+		Files map[string]string `json:"files"`
+	}
+	rep := Reply{}
+	json.Unmarshal(w.Body.Bytes(), &rep)
+	assert.Equal(t, rep.Files["state"], "chkpt2")
+	assert.Equal(t, rep.Files["system"], "s123")
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "4"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt4"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.download(auth_token, stream_id, "3/0/some_file"), []byte("4"))
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	// truncating to 0 rolls the stream back to its seed files
+	frames, code = f.truncateStream(auth_token, stream_id, `{"frames": 0}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, frames, 0)
+	partitions, _ = f.app.Store.ListPartitions(stream_id)
+	assert.Equal(t, len(partitions), 0)
+	assert.Equal(t, f.download(auth_token, stream_id, "files/state"), []byte("seed"))
+}
+
+// Fails to remove the given file of every stream.
+type failingRemoveStore struct {
+	StreamStore
+	name string
+}
+
+func (s failingRemoveStore) Remove(streamId, name string) error {
+	if name == s.name {
+		return errors.New("cannot remove " + name)
+	}
+	return s.StreamStore.Remove(streamId, name)
+}
+
+func TestStreamTruncatePartialFailure(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "`+strconv.Itoa(i)+`"}}`), 200)
+		assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt`+strconv.Itoa(i)+`"}, "frames": 0.234}`), 200)
+	}
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, f.loadMongoStream(stream_id)["frames"].(int), 3)
+
+	// partition 3 is removed but not partition 2, the stream is left with 2 frames
+	f.app.Store = failingRemoveStore{f.app.Store, "2"}
+	_, code = f.truncateStream(auth_token, stream_id, `{"frames": 1}`)
+	assert.Equal(t, code, 400)
+	stream, _ := f.getStream(stream_id)
+	assert.Equal(t, stream.Frames, 2)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, f.loadMongoStream(stream_id)["frames"].(int), 2)
+	stream, _ = f.getStream(stream_id)
+	assert.Equal(t, stream.PersistedFrames, 2)
+}
+
+func TestStreamReseed(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"steps_per_frame": 1}}`)
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s1", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+
+	// a stream without frames can not take a checkpoint
+	assert.Equal(t, f.reseedStream(auth_token, stream_id, `{"checkpoint": {"state": "chkpt"}}`), 400)
+	assert.Equal(t, f.reseedStream(auth_token, stream_id, `{}`), 400)
+	assert.Equal(t, f.reseedStream(auth_token, stream_id, `{"files": {"../system": "s2"}}`), 400)
+	other_token := f.addManager("vijay", 1)
+	assert.Equal(t, f.reseedStream(other_token, stream_id, `{"files": {"system": "s2"}}`), 400)
+
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.reseedStream(auth_token, stream_id, `{"files": {"system": "s2"}}`), 400)
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "1"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt1"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	assert.Equal(t, f.reseedStream(auth_token, stream_id, `{"files": {"system": "s2"}, "checkpoint": {"state": "chkpt2"}}`), 200)
+	assert.Equal(t, f.download(auth_token, stream_id, "files/system"), []byte("s2"))
+	assert.Equal(t, f.download(auth_token, stream_id, "files/state"), []byte("seed"))
+	assert.Equal(t, f.download(auth_token, stream_id, "seeds/1/system"), []byte("s1"))
+	versions, _ := f.app.ListSeedVersions(stream_id)
+	assert.Equal(t, versions, []int{1})
+	seedDir, _ := f.app.SeedDir(stream_id, 1)
+	assert.Equal(t, seedDir, "seeds/1")
+	seedDir, _ = f.app.SeedDir(stream_id, 2)
+	assert.Equal(t, seedDir, "files")
+
+	// replacing again before any new frame keeps the first version
+	assert.Equal(t, f.reseedStream(auth_token, stream_id, `{"files": {"system": "s3"}}`), 200)
+	assert.Equal(t, f.download(auth_token, stream_id, "seeds/1/system"), []byte("s1"))
+
+	// the next core starts from the new seed files and the injected checkpoint
+	token, code = f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	req, _ := http.NewRequest("GET", "/core/start", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	type Reply struct {
+		Files map[string]string `json:"files"`
+	}
+	rep := Reply{}
+	json.Unmarshal(w.Body.Bytes(), &rep)
+	assert.Equal(t, rep.Files["system"], "s3")
+	assert.Equal(t, rep.Files["state"], "chkpt2")
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "2"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt3"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	// forks use the seed files that produced the partition
+	child_id, code := f.forkStream(auth_token, stream_id, `{"partition": 1, "checkpoint": 0}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.download(auth_token, child_id, "files/system"), []byte("s1"))
+	child_id, code = f.forkStream(auth_token, stream_id, `{"partition": 2}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.download(auth_token, child_id, "files/system"), []byte("s3"))
+
+	// rolling back past a version keeps it tied to the remaining partitions
+	assert.Equal(t, f.reseedStream(auth_token, stream_id, `{"files": {"system": "s4"}}`), 200)
+	versions, _ = f.app.ListSeedVersions(stream_id)
+	assert.Equal(t, versions, []int{1, 2})
+	_, code = f.truncateStream(auth_token, stream_id, `{"frames": 1}`)
+	assert.Equal(t, code, 200)
+	versions, _ = f.app.ListSeedVersions(stream_id)
+	assert.Equal(t, versions, []int{1})
+	assert.Equal(t, f.download(auth_token, stream_id, "seeds/1/system"), []byte("s1"))
+	_, code = f.truncateStream(auth_token, stream_id, `{"frames": 0}`)
+	assert.Equal(t, code, 200)
+	versions, _ = f.app.ListSeedVersions(stream_id)
+	assert.Equal(t, versions, []int{0})
+	assert.Equal(t, f.download(auth_token, stream_id, "seeds/0/system"), []byte("s1"))
+}
+
+func TestStreamExport(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}, "tags": {"pdb": "a.pdb"}}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+strconv.Itoa(i)+`"}}`), 200)
+		assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt`+strconv.Itoa(i)+`"}, "frames": 0.234}`), 200)
+	}
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	for _, query := range []string{"", "?gzip=1"} {
+		entries, code := f.exportStream(auth_token, stream_id, query)
+		assert.Equal(t, code, 200)
+		assert.Equal(t, len(entries), 10)
+		assert.Equal(t, entries[stream_id+"/files/system"], []byte("s123"))
+		assert.Equal(t, entries[stream_id+"/tags/pdb"], []byte("a.pdb"))
+		assert.Equal(t, entries[stream_id+"/2/0/frames.xtc"], []byte("2"))
+		assert.Equal(t, entries[stream_id+"/3/0/checkpoint_files/state"], []byte("chkpt3"))
+		manifest := ArchiveManifest{}
+		assert.Nil(t, json.Unmarshal(entries[stream_id+"/manifest.json"], &manifest))
+		assert.Equal(t, manifest.StreamId, stream_id)
+		assert.Equal(t, manifest.Partitions, []int{1, 2, 3})
+		assert.Equal(t, len(manifest.Files), 9)
+		assert.Equal(t, manifest.Files["1/0/checkpoint_files/state"], int64(6))
+		stream := Stream{}
+		assert.Nil(t, json.Unmarshal(manifest.Stream, &stream))
+		assert.Equal(t, stream.Frames, 3)
+		assert.Equal(t, stream.TargetId, target_id)
+	}
+
+	entries, code := f.exportStream(auth_token, stream_id, "?from=2&to=2")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, len(entries), 6)
+	_, ok := entries[stream_id+"/2/0/frames.xtc"]
+	assert.True(t, ok)
+	_, ok = entries[stream_id+"/3/0/frames.xtc"]
+	assert.False(t, ok)
+
+	_, code = f.exportStream(auth_token, stream_id, "?from=a")
+	assert.Equal(t, code, 400)
+	_, code = f.exportStream(auth_token, "bad_stream", "")
+	assert.Equal(t, code, 400)
+	other_token := f.addManager("vijay", 1)
+	_, code = f.exportStream(other_token, stream_id, "")
+	assert.Equal(t, code, 400)
+}
+
+func TestStreamTrajectory(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "a", "log.txt": "x"}}`), 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "b", "log.txt": "y"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt1"}, "frames": 0.234}`), 200)
+	// a checkpoint without new frames does not add a partition
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt2"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "c"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt3"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "d", "log.txt": "z"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt4"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	data, partitions, code := f.trajectory(auth_token, stream_id, "frames.xtc", "")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, data, []byte("abcd"))
+	assert.Equal(t, partitions, "2,3,4")
+	data, partitions, code = f.trajectory(auth_token, stream_id, "frames.xtc", "?from=3")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, data, []byte("cd"))
+	assert.Equal(t, partitions, "3,4")
+	data, _, code = f.trajectory(auth_token, stream_id, "log.txt", "?to=2")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, data, []byte("xy"))
+
+	// partition 3 has no log
+	_, _, code = f.trajectory(auth_token, stream_id, "log.txt", "")
+	assert.Equal(t, code, 400)
+	_, _, code = f.trajectory(auth_token, stream_id, "frames.xtc", "?from=5")
+	assert.Equal(t, code, 400)
+	_, _, code = f.trajectory(auth_token, stream_id, "checkpoint_files", "")
+	assert.Equal(t, code, 400)
+	other_token := f.addManager("vijay", 1)
+	_, _, code = f.trajectory(other_token, stream_id, "frames.xtc", "")
+	assert.Equal(t, code, 400)
+}
+
+func TestStreamImport(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	p := f.peer("testPeer")
+	defer p.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"steps_per_frame": 1}}`)
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}, "tags": {"pdb": "a.pdb"}, "priority": 2, "max_frames": 10}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "`+strconv.Itoa(i)+`"}}`), 200)
+		assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt`+strconv.Itoa(i)+`"}, "frames": 0.234}`), 200)
+	}
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	assert.Equal(t, f.streamStop(auth_token, stream_id), 200)
+
+	archive, code := f.exportArchive(auth_token, stream_id, "?gzip=1")
+	assert.Equal(t, code, 200)
+	// the stream already exists here
+	_, code = f.importStream(auth_token, archive)
+	assert.Equal(t, code, 400)
+	_, code = p.importStream(auth_token, []byte("garbage"))
+	assert.Equal(t, code, 400)
+	_, code = p.importStream(auth_token, archive[:len(archive)/2])
+	assert.Equal(t, code, 400)
+	_, ok := p.app.Manager.streams[stream_id]
+	assert.False(t, ok)
+
+	// an import of the same id that is in progress is left alone
+	assert.Nil(t, p.app.Manager.ReserveStream(stream_id))
+	assert.Nil(t, p.app.Store.WriteSeed(stream_id, "system", []byte("s123")))
+	_, code = p.importStream(auth_token, archive)
+	assert.Equal(t, code, 400)
+	_, err := p.app.Store.Stat(stream_id, "files/system")
+	assert.Nil(t, err)
+	assert.Nil(t, p.app.Store.RemoveStream(stream_id))
+	p.app.Manager.ReleaseStream(stream_id)
+
+	imported_id, code := p.importStream(auth_token, archive)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, imported_id, stream_id)
+	stream, code := p.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.Frames, 3)
+	assert.Equal(t, stream.Priority, 2)
+	assert.Equal(t, stream.MaxFrames, 10)
+	assert.Equal(t, stream.MongoStatus, "disabled")
+	assert.Equal(t, p.download(auth_token, stream_id, "files/system"), []byte("s123"))
+	assert.Equal(t, p.download(auth_token, stream_id, "tags/pdb"), []byte("a.pdb"))
+	assert.Equal(t, p.download(auth_token, stream_id, "2/0/frames.xtc"), []byte("2"))
+	result := p.loadMongoStream(stream_id)
+	assert.Equal(t, result["frames"].(int), 3)
+	assert.Equal(t, result["status"].(string), "disabled")
+
+	// the imported stream resumes from its last checkpoint
+	assert.Equal(t, p.streamStart(auth_token, stream_id), 200)
+	token, code = p.activateStream(target_id, "some_engine", "some_donor", p.app.Config.Password)
+	assert.Equal(t, code, 200)
+	req, _ := http.NewRequest("GET", "/core/start", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	p.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	type Reply struct {
+		Files map[string]string `json:"files"`
+	}
+	rep := Reply{}
+	json.Unmarshal(w.Body.Bytes(), &rep)
+	assert.Equal(t, rep.Files["state"], "chkpt3")
+	assert.Equal(t, rep.Files["system"], "s123")
+	assert.Equal(t, p.coreStop(token, ""), 200)
+
+	// partial exports can be imported too
+	assert.Equal(t, p.deleteStream(auth_token, stream_id), 200)
+	p.app.Store.RemoveStream(stream_id)
+	time.Sleep(2 * time.Second)
+	archive, code = f.exportArchive(auth_token, stream_id, "?to=2")
+	assert.Equal(t, code, 200)
+	_, code = p.importStream(auth_token, archive)
+	assert.Equal(t, code, 200)
+	stream, _ = p.getStream(stream_id)
+	assert.Equal(t, stream.Frames, 2)
+}
+
+func TestStreamImportPendingDelete(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	p := f.peer("testPeer")
+	defer p.shutdown()
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	archive, code := f.exportArchive(auth_token, stream_id, "")
+	assert.Equal(t, code, 200)
+
+	// the stream was deleted from the peer, but Mongo has been failing since
+	p.app.deferred.Push(DeferredOp{Type: DEFERRED_STREAM_DELETE, StreamId: stream_id, Attempts: 5,
+		NextTry: time.Now().Add(time.Hour)})
+	_, code = p.importStream(auth_token, archive)
+	assert.Equal(t, code, 400)
+	_, err := p.app.Store.Stat(stream_id, "")
+	assert.NotNil(t, err)
+	assert.Nil(t, p.app.Manager.ReserveStream(stream_id))
+}
+
+func TestStreamTransferTimeouts(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	p := f.peer("testPeer")
+	defer p.shutdown()
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	// more than the connection buffers, so that the export waits on the client
+	big := bytes.Repeat([]byte("0123456789abcdef"), 2<<20)
+	assert.Nil(t, f.app.Store.WriteSeed(stream_id, "big", big))
+	servers := make([]*Server, 0)
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+	listen := func(app *Application) string {
+		server := NewServer("127.0.0.1:0", app.Router)
+		server.ReadTimeout = 200 * time.Millisecond
+		server.WriteTimeout = 200 * time.Millisecond
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		go server.Serve(l)
+		servers = append(servers, server)
+		return "http://" + l.Addr().String()
+	}
+
+	// the client reads the export slower than the server timeouts allow
+	req, _ := http.NewRequest("GET", listen(f.app)+"/streams/export/"+stream_id, nil)
+	req.Header.Add("Authorization", auth_token)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) == false {
+		return
+	}
+	time.Sleep(time.Second)
+	archive, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.True(t, len(archive) > len(big))
+
+	// and sends the import slower too
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < len(archive); i += len(archive) / 4 {
+			time.Sleep(100 * time.Millisecond)
+			end := i + len(archive)/4
+			if end > len(archive) {
+				end = len(archive)
+			}
+			pw.Write(archive[i:end])
+		}
+		pw.Close()
+	}()
+	req, _ = http.NewRequest("POST", listen(p.app)+"/streams/import", pr)
+	req.Header.Add("Authorization", auth_token)
+	resp, err = http.DefaultClient.Do(req)
+	if assert.Nil(t, err) == false {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, p.download(auth_token, stream_id, "files/big"), big)
+}
+
+func TestStreamMigrate(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	p := f.peer("testPeer")
+	defer p.shutdown()
+	// the peer has SSL configured, so it must be reached over https
+	ts := httptest.NewTLSServer(p.app.Router)
+	defer ts.Close()
+	p.app.Config.ExternalHost = ts.Listener.Addr().String()
+	p.app.Config.SSL = map[string]string{"Cert": "peer.crt", "Key": "peer.pem"}
+	p.app.RegisterSCV()
+	f.app.peerClient = ts.Client()
+
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	other_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s456", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc": "1"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	assert.Equal(t, f.migrateStream(auth_token, stream_id, "unknown"), 400)
+	assert.Equal(t, f.migrateStream(auth_token, stream_id, f.app.Config.Name), 400)
+	other_token := f.addManager("vijay", 1)
+	assert.Equal(t, f.migrateStream(other_token, stream_id, "testPeer"), 400)
+
+	assert.Equal(t, f.migrateStream(auth_token, stream_id, "testPeer"), 200)
+	_, code = f.getStream(stream_id)
+	assert.Equal(t, code, 400)
+	_, err := f.app.Store.Stat(stream_id, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, len(f.loadMongoStream(stream_id)), 0)
+	stream, code := p.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "enabled")
+	assert.Equal(t, p.download(auth_token, stream_id, "files/system"), []byte("s123"))
+	assert.Equal(t, p.loadMongoStream(stream_id)["status"].(string), "enabled")
+
+	// the peer already has the other stream, so it stays here and is enabled again
+	archive, code := f.exportArchive(auth_token, other_id, "")
+	assert.Equal(t, code, 200)
+	_, code = p.importStream(auth_token, archive)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.migrateStream(auth_token, other_id, "testPeer"), 400)
+	stream, code = f.getStream(other_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "enabled")
+	assert.Equal(t, f.app.Manager.targets[target_id].inactiveStreams.Len(), 1)
+}
+
+func TestStreamMigrateStartFails(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	p := f.peer("testPeer")
+	defer p.shutdown()
+	// the peer fails to start the first migrated stream once, and the second one every time
+	failures := map[string]int{}
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/streams/start/") {
+			streamId := strings.TrimPrefix(r.URL.Path, "/streams/start/")
+			mu.Lock()
+			fail := failures[streamId] > 0
+			failures[streamId] -= 1
+			mu.Unlock()
+			if fail {
+				http.Error(w, "try again", 400)
+				return
+			}
+		}
+		p.app.Router.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	p.app.Config.ExternalHost = ts.Listener.Addr().String()
+	p.app.RegisterSCV()
+
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	other_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s456", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	failures[stream_id] = 1
+	failures[other_id] = MIGRATE_START_ATTEMPTS
+
+	assert.Equal(t, f.migrateStream(auth_token, stream_id, "testPeer"), 200)
+	stream, code := p.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "enabled")
+
+	// the stream has moved all the same, but the client is told it is disabled
+	assert.Equal(t, f.migrateStream(auth_token, other_id, "testPeer"), 400)
+	_, code = f.getStream(other_id)
+	assert.Equal(t, code, 400)
+	stream, code = p.getStream(other_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "disabled")
+}
+
+func TestStreamMigrateHeld(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	p := f.peer("testPeer")
+	defer p.shutdown()
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	// while the peer imports the stream, nothing else may change it here. The reply of the peer is
+	// then tampered with, and it fails to delete the copy it received.
+	var startCode, truncateCode int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/streams/import":
+			startCode = f.streamStart(auth_token, stream_id)
+			_, truncateCode = f.truncateStream(auth_token, stream_id, `{"frames": 0}`)
+			rec := httptest.NewRecorder()
+			p.app.Router.ServeHTTP(rec, r)
+			w.Write(bytes.Replace(rec.Body.Bytes(), []byte(`"md5":"`), []byte(`"md5":"0`), 1))
+		case strings.HasPrefix(r.URL.Path, "/streams/delete/"):
+			http.Error(w, "cannot delete", 400)
+		default:
+			p.app.Router.ServeHTTP(w, r)
+		}
+	}))
+	defer ts.Close()
+	p.app.Config.ExternalHost = ts.Listener.Addr().String()
+	p.app.RegisterSCV()
+
+	req, _ := http.NewRequest("POST", "/streams/migrate/"+stream_id, bytes.NewBuffer([]byte(`{"scv": "testPeer"}`)))
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 400)
+	assert.Contains(t, w.Body.String(), "Checksum mismatch")
+	assert.Contains(t, w.Body.String(), "could not be deleted")
+	assert.Equal(t, startCode, 400)
+	assert.Equal(t, truncateCode, 400)
+	_, code = p.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	// the stream is released and enabled again here
+	stream, code := f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "enabled")
+	assert.Equal(t, f.app.Manager.targets["12345"].inactiveStreams.Len(), 1)
+	assert.Empty(t, f.app.Manager.targets["12345"].busyStreams)
+}
+
+func TestStreamFork(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	parent_id, code := f.postStream(auth_token, `{"target_id":"12345", "files": {"system": "s123", "state": "seed"}}`)
+	assert.Equal(t, code, 200)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "12345"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt1"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt2"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "67890"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"state": "chkpt3"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	// defaults to the last checkpoint
+	child_id, code := f.forkStream(auth_token, parent_id, `{}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.download(auth_token, child_id, "files/system"), []byte("s123"))
+	assert.Equal(t, f.download(auth_token, child_id, "files/state"), []byte("chkpt3"))
+	child, code := f.getStream(child_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, child.ParentId, parent_id)
+	assert.Equal(t, child.ParentPartition, 2)
+	assert.Equal(t, child.TargetId, target_id)
+	assert.Equal(t, child.Frames, 0)
+	result := f.loadMongoStream(child_id)
+	assert.Equal(t, result["parent_id"].(string), parent_id)
+	assert.Equal(t, result["parent_partition"].(int), 2)
+	assert.Equal(t, *child.ParentCheckpoint, 0)
+	assert.Equal(t, result["parent_checkpoint"].(int), 0)
+
+	child_id, code = f.forkStream(auth_token, parent_id, `{"partition": 1, "checkpoint": 1, "target_id": "54321"}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.download(auth_token, child_id, "files/state"), []byte("chkpt2"))
+	child, code = f.getStream(child_id)
+	assert.Equal(t, child.TargetId, "54321")
+	assert.Equal(t, *child.ParentCheckpoint, 1)
+
+	// checkpoint 0 is the first checkpoint of the partition, not the last
+	child_id, code = f.forkStream(auth_token, parent_id, `{"partition": 1, "checkpoint": 0}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.download(auth_token, child_id, "files/state"), []byte("chkpt1"))
+	child, code = f.getStream(child_id)
+	assert.Equal(t, *child.ParentCheckpoint, 0)
+	assert.Equal(t, f.loadMongoStream(child_id)["parent_checkpoint"].(int), 0)
+
+	child_id, code = f.forkStream(auth_token, parent_id, `{"partition": 0}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.download(auth_token, child_id, "files/state"), []byte("seed"))
+	child, code = f.getStream(child_id)
+	assert.Nil(t, child.ParentCheckpoint)
+	_, ok := f.loadMongoStream(child_id)["parent_checkpoint"]
+	assert.False(t, ok)
+
+	_, code = f.forkStream(auth_token, parent_id, `{"partition": 3}`)
+	assert.Equal(t, code, 400)
+	_, code = f.forkStream(auth_token, parent_id, `{"partition": 1, "checkpoint": 5}`)
+	assert.Equal(t, code, 400)
+	_, code = f.forkStream(auth_token, parent_id, `{"partition": 1, "checkpoint": -1}`)
+	assert.Equal(t, code, 400)
+	_, code = f.forkStream(auth_token, parent_id, `{"partition": 0, "checkpoint": 0}`)
+	assert.Equal(t, code, 400)
+	_, code = f.forkStream(auth_token, "bad_stream", `{}`)
+	assert.Equal(t, code, 400)
+	other_token := f.addManager("vijay", 1)
+	_, code = f.forkStream(other_token, parent_id, `{}`)
+	assert.Equal(t, code, 400)
+}
+
+func TestBadCoreStart(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	req, _ := http.NewRequest("GET", "/core/start", nil)
+	req.Header.Add("Authorization", "bad_token")
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 400)
+}
+
+func TestHammerTime(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+
+	auth_token := f.addManager("yutong", 1)
+
+	streams := make([]string, 0)
+	nTargets := 5
+	nStreams := 20
+	nActivations := 29
+	nCycles := 12
+
+	for j := 0; j < nTargets; j++ {
+		target_id := "target_" + strconv.Itoa(j)
+		jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+		f.addTarget(target_id, "yutong", `{"options": {"steps_per_frame": 1}}`)
+		for i := 0; i < nStreams; i++ {
+			stream_id, code := f.postStream(auth_token, jsonData)
+			assert.Equal(t, code, 200)
+			streams = append(streams, stream_id)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	frameCounts := make(map[string]int)
+	consecutiveCheckpoints := make(map[string]int)
+	for j := 0; j < nTargets; j++ {
+		target_id := "target_" + strconv.Itoa(j)
+		for i := 0; i < nStreams; i++ {
+			wg.Add(1)
+			go func() {
+				for j := 0; j < nActivations; j++ {
+					token, code := f.activateStream(target_id, "some_engine", "some_user", f.app.Config.Password)
+					assert.Equal(t, code, 200)
+					streamId, code := f.coreStart(token)
+					for i := 0; i < nCycles; i++ {
+						var concatBin string
+						fCount := rand.Intn(4)
+						for j := 0; j < fCount; j++ {
+							data := util.RandSeq(10)
+							concatBin += data
+							assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "`+data+`"}}`), 200)
+							time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+							assert.Equal(t, f.coreHeartbeat(token), 200)
+							time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+						}
+						mu.Lock()
+						frameCounts[streamId] += fCount
+						nFrames := frameCounts[streamId]
+						if fCount == 0 {
+							consecutiveCheckpoints[streamId] += 1
+						} else {
+							consecutiveCheckpoints[streamId] = 0
+						}
+						consChkpt := consecutiveCheckpoints[streamId]
+						mu.Unlock()
+						assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 200)
+
+						if fCount > 0 {
+							frameBin := f.downloadFrame(auth_token, streamId, "some_file", nFrames)
+							if concatBin != string(frameBin) {
+								fmt.Println(streamId, nFrames, "EXPECTED", concatBin, "GOT", string(frameBin))
+							}
+							assert.Equal(t, concatBin, string(frameBin))
+						}
+						url := strconv.Itoa(nFrames) + "/" + strconv.Itoa(consChkpt) + "/checkpoint_files/chkpt"
+						chkptBin := f.download(auth_token, streamId, url)
+						assert.Equal(t, "data", string(chkptBin))
+					}
+					assert.Equal(t, f.coreStop(token, ""), 200)
+				}
+				wg.Done()
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestStreamCheckpoint(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, code := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data1"}, "frames": 0.234}`), 200)
 	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data2"}, "frames": 0.234}`), 200)
 	chkptBin := f.download(auth_token, streamId, "0/1/checkpoint_files/chkpt")
 	assert.Equal(t, string(chkptBin), "data1")
@@ -811,6 +1909,38 @@ func TestStreamCheckpoint(t *testing.T) {
 	assert.Equal(t, string(chkptBin), "data2")
 }
 
+func TestStreamCheckpointPersisted(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, code := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "12345"}}`), 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "67890"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 200)
+	stream, code := f.getStream(streamId)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.Frames, 2)
+	assert.True(t, stream.LastCheckpoint > 0)
+
+	// the frame count reaches Mongo without deactivating the stream
+	time.Sleep(2 * time.Second)
+	mongoStream := f.loadMongoStream(streamId)
+	assert.Equal(t, mongoStream["frames"], 2)
+	assert.Equal(t, mongoStream["last_checkpoint"], stream.LastCheckpoint)
+	stream, code = f.getStream(streamId)
+	assert.Equal(t, stream.PersistedFrames, 2)
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "abcde"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 200)
+	stream, code = f.getStream(streamId)
+	assert.Equal(t, stream.Frames, 3)
+}
+
 func TestStreamStateActive(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
@@ -971,9 +2101,8 @@ func TestStreamCycle(t *testing.T) {
 	time.Sleep(time.Second * 1)
 
 	// check mongo stats
-	cursor := f.app.Mongo.DB("stats").C(target_id)
 	result := make(map[string]interface{})
-	cursor.Find(bson.M{"stream": stream_id}).One(&result)
+	f.app.DB.Stats.FindByStream(target_id, stream_id, &result)
 	assert.Equal(t, result["frames"].(float64), 0.234+0.123)
 	assert.Equal(t, result["engine"].(string), "some_engine")
 	assert.Equal(t, result["user"].(string), "some_donor")
@@ -981,9 +2110,7 @@ func TestStreamCycle(t *testing.T) {
 	assert.True(t, math.Abs(float64(result["end_time"].(int)-end_time)) < 1)
 
 	// check mongo stream
-	cursor = f.app.Mongo.DB("streams").C(f.app.Config.Name)
-	result = make(map[string]interface{})
-	cursor.Find(bson.M{"_id": stream_id}).One(&result)
+	result = f.loadMongoStream(stream_id)
 	assert.Equal(t, result["frames"].(int), 2)
 	assert.Equal(t, result["error_count"].(int), 0)
 	// assert.Equal(t, result["frames"].(int), 5)
@@ -1064,6 +2191,39 @@ func TestCoreStart(t *testing.T) {
 	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "some_data"}}`), 400)
 }
 
+type failingLastCheckpointStore struct {
+	StreamStore
+}
+
+func (s failingLastCheckpointStore) LastCheckpoint(streamId string, partition int) (int, error) {
+	return 0, errors.New("cannot list checkpoints of " + streamId)
+}
+
+func TestCoreStartMissingCheckpoint(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.postFrame(token, `{"files": {"some_file": "some_data"}}`), 200)
+	assert.Equal(t, f.postCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+
+	// a core is not started from the frames of checkpoint 0 when the checkpoint cannot be found
+	token, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	f.app.Store = failingLastCheckpointStore{f.app.Store}
+	_, code = f.coreStart(token)
+	assert.Equal(t, code, 400)
+	stream, _ := f.getStream(streamId)
+	assert.Equal(t, stream.Frames, 1)
+}
+
 func TestCoreExpiration(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
@@ -63,7 +63,8 @@ func NewServer(addr string, handler http.Handler) *Server {
 			},
 			MaxHeaderBytes: 4096,
 			ReadTimeout:    60e9, // These are absolute times which must be
-			WriteTimeout:   60e9, // longer than the longest {up,down}load.
+			WriteTimeout:   60e9, // longer than the longest {up,down}load,
+			// except for transfers of whole streams, which lift them.
 		},
 		ch:    ch,
 		conns: make(map[string]net.Conn),
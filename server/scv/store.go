@@ -0,0 +1,1165 @@
+package scv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+A StreamStore holds the files of every stream. Files are named by slash separated paths relative
+to their stream, and are laid out as follows:
+
+	files/{name}                          current seed files, possibly shared with other streams
+	seeds/{frames}/{name}                 seed files that were in use up to frames
+	tags/{name}                           tags
+	buffer_files/{name}                   frames appended since the last checkpoint
+	buffer_files/checkpoint_files/{name}  checkpoint being written
+	{frames}/{n}/...                      buffer committed as the n-th checkpoint of a partition
+	journal                               commit in progress
+
+Errors for files that do not exist satisfy os.IsNotExist. A store does no locking of its own
+beyond keeping itself consistent, callers are expected to hold the stream's lock.
+
+Appending a frame and committing a partition either happen completely or not at all. A commit is
+recorded in the journal until the buffer has been moved, so that Recover can roll it back if the
+SCV died in between. The buffer itself is never recovered, since it belongs to a core of the
+previous run.
+*/
+type StreamStore interface {
+	// Ids of every stream that has files in the store.
+	ListStreams() ([]string, error)
+	RemoveStream(streamId string) error
+	// Move the files of a stream out of the way without deleting them, and return where they went.
+	QuarantineStream(streamId string) (string, error)
+
+	WriteSeed(streamId, name string, data []byte) error
+	// Append a frame to the frame files of the buffer, by name. Either every file is appended to
+	// or none is.
+	AppendFrames(streamId string, files map[string][]byte) error
+	// Like AppendFrames, copying each file from a reader, eg. a frame uploaded to a temporary file.
+	AppendFramesFrom(streamId string, files map[string]io.Reader) error
+	// Write a checkpoint file into the buffer.
+	WriteCheckpoint(streamId, name string, data []byte) error
+	WriteCheckpointFrom(streamId, name string, r io.Reader) error
+	ClearBuffer(streamId string) error
+	// Move the buffer into a partition, as checkpoint 0 of a new partition or as the next
+	// checkpoint of an existing one. Partition 0 has no frames, its first checkpoint is 1.
+	CommitPartition(streamId string, partition int) error
+	// Roll back whatever a crash left half done in a stream, and clear its buffer. Returns a
+	// description of every change made.
+	Recover(streamId string) ([]string, error)
+	// Frame counts of the partitions of a stream, in increasing order.
+	ListPartitions(streamId string) ([]int, error)
+	LastCheckpoint(streamId string, partition int) (int, error)
+	ReadCheckpoint(streamId string, partition, checkpoint int) (map[string][]byte, error)
+
+	// Lower level access to the files of a stream. An empty name refers to the stream itself.
+	Stat(streamId, name string) (StoreFile, error)
+	// Names of the files and directories directly below dir, sorted. Empty if dir does not exist.
+	ListDir(streamId, dir string) ([]string, error)
+	// Regular files below dir, recursively, with names relative to the stream.
+	ListFiles(streamId, dir string) ([]StoreFile, error)
+	OpenFile(streamId, name string) (io.ReadCloser, error)
+	CreateFile(streamId, name string) (io.WriteCloser, error)
+	WriteFile(streamId, name string, data []byte) error
+	// Remove a file or a directory and everything below it. Missing files are not an error.
+	Remove(streamId, name string) error
+	// Rename a file or a directory, dst must not exist.
+	Rename(streamId, src, dst string) error
+}
+
+type StoreFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Returns the cleaned name, or an error if it points outside of the stream.
+func cleanName(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New("Invalid file path")
+	}
+	if clean == "." {
+		return "", nil
+	}
+	return clean, nil
+}
+
+// Frame files are named by cores and must stay directly in the buffer.
+func frameName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", errors.New("Invalid frame file " + name)
+	}
+	return "buffer_files/" + name, nil
+}
+
+func checkpointDir(partition, checkpoint int) string {
+	return strconv.Itoa(partition) + "/" + strconv.Itoa(checkpoint) + "/checkpoint_files"
+}
+
+// A commit in progress, see commitPartition.
+type storeJournal struct {
+	Partition  int `json:"partition"`
+	Checkpoint int `json:"checkpoint"`
+}
+
+// Move the buffer into the next checkpoint of a partition. The commit is recorded in the journal
+// first and is only complete once the journal is removed. Checkpoint 0 holds the frames that led
+// to a partition, so the checkpoints of partition 0, which has no frames, start at 1.
+func commitPartition(store StreamStore, streamId string, partition int) error {
+	checkpoint := 0
+	if partition == 0 {
+		checkpoint = 1
+	}
+	last, err := store.LastCheckpoint(streamId, partition)
+	if err == nil {
+		checkpoint = last + 1
+	} else if os.IsNotExist(err) == false {
+		return err
+	}
+	data, err := json.Marshal(storeJournal{Partition: partition, Checkpoint: checkpoint})
+	if err != nil {
+		return err
+	}
+	if err = store.WriteFile(streamId, "journal", data); err != nil {
+		return err
+	}
+	dst := strconv.Itoa(partition) + "/" + strconv.Itoa(checkpoint)
+	if err = store.Rename(streamId, "buffer_files", dst); err != nil {
+		store.Remove(streamId, "journal")
+		return err
+	}
+	return store.Remove(streamId, "journal")
+}
+
+// Roll back the commit recorded in the journal, if any, clear the buffer and remove what was left
+// behind by interrupted writes: temporary seed versions and checkpoints (see StreamReseedHandler),
+// and checkpoints or partitions that were never completed. Only the last partition can be
+// incomplete, since commits only ever go to the last partition or a new one.
+func recoverStream(store StreamStore, streamId string) ([]string, error) {
+	res := make([]string, 0)
+	reader, err := store.OpenFile(streamId, "journal")
+	if err == nil {
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		journal := storeJournal{}
+		if err = json.Unmarshal(data, &journal); err != nil {
+			return nil, errors.New("Corrupt journal: " + err.Error())
+		}
+		dir := strconv.Itoa(journal.Partition) + "/" + strconv.Itoa(journal.Checkpoint)
+		if _, err = store.Stat(streamId, dir); err == nil {
+			if err = store.Remove(streamId, dir); err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, "rolled back commit of checkpoint "+dir)
+		if err = store.Remove(streamId, "journal"); err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) == false {
+		return nil, err
+	}
+	if err = store.ClearBuffer(streamId); err != nil {
+		return nil, err
+	}
+	removeTemporary := func(dir string) ([]string, error) {
+		names, err := store.ListDir(streamId, dir)
+		if err != nil {
+			return nil, err
+		}
+		kept := make([]string, 0, len(names))
+		for _, name := range names {
+			if strings.HasSuffix(name, ".tmp") == false {
+				kept = append(kept, name)
+				continue
+			}
+			if err = store.Remove(streamId, dir+"/"+name); err != nil {
+				return nil, err
+			}
+			res = append(res, "removed "+dir+"/"+name)
+		}
+		return kept, nil
+	}
+	if _, err = removeTemporary("seeds"); err != nil {
+		return nil, err
+	}
+	partitions, err := store.ListPartitions(streamId)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(partitions) - 1; i >= 0; i-- {
+		dir := strconv.Itoa(partitions[i])
+		names, err := removeTemporary(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(numericNames(names, false)) > 0 {
+			break
+		}
+		if err = store.Remove(streamId, dir); err != nil {
+			return nil, err
+		}
+		res = append(res, "removed incomplete partition "+dir)
+	}
+	return res, nil
+}
+
+// Read every regular file directly below dir.
+func readFiles(store StreamStore, streamId, dir string) (map[string][]byte, error) {
+	files, err := store.ListFiles(streamId, dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string][]byte)
+	for _, file := range files {
+		rel := strings.TrimPrefix(file.Name, dir+"/")
+		if strings.Contains(rel, "/") {
+			continue
+		}
+		reader, err := store.OpenFile(streamId, file.Name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		res[rel] = data
+	}
+	return res, nil
+}
+
+// Parse the names that are integers, eg. partitions, and sort them. Only names above 0 are kept if
+// positive is set.
+func numericNames(names []string, positive bool) []int {
+	res := make([]int, 0)
+	for _, name := range names {
+		num, err := strconv.Atoi(name)
+		if err == nil && (num > 0 || (positive == false && num == 0)) {
+			res = append(res, num)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
+
+// The default store, with one directory per stream below root. Files are synced to disk before
+// any operation returns, and are written to {stream}/tmp first so that they only ever appear
+// complete.
+//
+// Seed files are content addressed: each distinct seed is kept once in seed_files/{sha256}, next to
+// the root, and hard linked into the streams that use it. The link count of a seed is its reference
+// count, seeds that are no longer linked from any stream are removed with the next stream. Since
+// files are never modified in place, a stream cannot change the seeds of another.
+type FileStore struct {
+	root string
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{root: root}
+}
+
+func (s *FileStore) path(streamId, name string) (string, error) {
+	if streamId == "" || filepath.Base(streamId) != streamId {
+		return "", errors.New("Invalid stream id")
+	}
+	clean, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, streamId, filepath.FromSlash(clean)), nil
+}
+
+func (s *FileStore) ListStreams() ([]string, error) {
+	files, err := ioutil.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return make([]string, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, file := range files {
+		if file.IsDir() {
+			res = append(res, file.Name())
+		}
+	}
+	return res, nil
+}
+
+func (s *FileStore) RemoveStream(streamId string) error {
+	return s.Remove(streamId, "")
+}
+
+// Quarantined streams go to quarantine/{stream_id}.{time}, next to the root of the store.
+func (s *FileStore) QuarantineStream(streamId string) (string, error) {
+	src, err := s.path(streamId, "")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(filepath.Dir(s.root), "quarantine")
+	if err = makeDir(dir); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, streamId+"."+time.Now().Format("20060102T150405.000000000"))
+	if err = os.Rename(src, dst); err != nil {
+		return "", err
+	}
+	if err = syncDir(dir); err != nil {
+		return "", err
+	}
+	return dst, syncDir(s.root)
+}
+
+func (s *FileStore) seedDir() string {
+	return filepath.Join(filepath.Dir(s.root), "seed_files")
+}
+
+// Return the shared copy of a seed, writing it if there is none yet.
+func (s *FileStore) sharedSeed(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	dir := s.seedDir()
+	seed := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	if info, err := os.Stat(seed); err == nil && info.Size() == int64(len(data)) {
+		return seed, nil
+	}
+	if err := makeDir(dir); err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(dir, "write")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// the seed is shared, so it must not be modified in place
+		err = os.Chmod(file.Name(), 0444)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), seed)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return seed, syncDir(dir)
+}
+
+// Link the shared copy of a seed into files/{name}, replacing what was there.
+func (s *FileStore) linkSeed(streamId, name string, data []byte) error {
+	filename, err := s.path(streamId, "files/"+name)
+	if err != nil {
+		return err
+	}
+	seed, err := s.sharedSeed(data)
+	if err != nil {
+		return err
+	}
+	tmpDir, _ := s.path(streamId, "tmp")
+	if err = makeDir(tmpDir); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(tmpDir, "link")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	os.Remove(file.Name())
+	err = os.Link(seed, file.Name())
+	if err == nil {
+		err = makeDir(filepath.Dir(filename))
+	}
+	replaced := s.seedsIn(filename)
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err = syncDir(filepath.Dir(filename)); err != nil {
+		return err
+	}
+	return s.releaseSeeds(replaced)
+}
+
+// Seeds are shared between streams when possible. If they cannot be, eg. because the shared copy
+// was just collected or the file system has no hard links, the stream gets a copy of its own.
+func (s *FileStore) WriteSeed(streamId, name string, data []byte) error {
+	if s.linkSeed(streamId, name, data) == nil {
+		return nil
+	}
+	return s.WriteFile(streamId, "files/"+name, data)
+}
+
+// The shared seeds that the files below filename link to. Only files with other links are read to
+// find their seed, which is at worst missed and then stays unused.
+func (s *FileStore) seedsIn(filename string) []string {
+	seeds := make([]string, 0)
+	filepath.Walk(filename, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode().IsRegular() == false {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok == false || uint64(stat.Nlink) < 2 {
+			return nil
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil
+		}
+		sum := sha256.Sum256(data)
+		seed := filepath.Join(s.seedDir(), hex.EncodeToString(sum[:]))
+		if seedInfo, err := os.Stat(seed); err == nil && os.SameFile(info, seedInfo) {
+			seeds = append(seeds, seed)
+		}
+		return nil
+	})
+	return seeds
+}
+
+// Remove those of seeds that no stream links to anymore, once the links found by seedsIn are gone.
+// A writer that was about to link one of them falls back to a copy.
+func (s *FileStore) releaseSeeds(seeds []string) error {
+	removed := false
+	for _, seed := range seeds {
+		info, err := os.Lstat(seed)
+		if err != nil {
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok == false || uint64(stat.Nlink) > 1 {
+			continue
+		}
+		if err = os.Remove(seed); err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+		removed = true
+	}
+	if removed {
+		return syncDir(s.seedDir())
+	}
+	return nil
+}
+
+// Sync a directory, so that files created, renamed or removed in it persist.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Create dir and its missing parents, syncing the directories they are created in.
+func makeDir(dir string) error {
+	existing := dir
+	for {
+		if _, err := os.Stat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	if existing == dir {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0776); err != nil {
+		return err
+	}
+	for parent := filepath.Dir(dir); ; parent = filepath.Dir(parent) {
+		if err := syncDir(parent); err != nil {
+			return err
+		}
+		if parent == existing {
+			return nil
+		}
+	}
+}
+
+func appendFile(filename string, r io.Reader) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *FileStore) AppendFrames(streamId string, files map[string][]byte) error {
+	readers := make(map[string]io.Reader)
+	for name, data := range files {
+		readers[name] = bytes.NewReader(data)
+	}
+	return s.AppendFramesFrom(streamId, readers)
+}
+
+// If an append fails, the files appended to so far are truncated back to their previous size, and
+// the ones that were created are removed.
+func (s *FileStore) AppendFramesFrom(streamId string, files map[string]io.Reader) error {
+	filenames := make(map[string]string)
+	sizes := make(map[string]int64)
+	for name := range files {
+		frame, err := frameName(name)
+		if err != nil {
+			return err
+		}
+		filename, err := s.path(streamId, frame)
+		if err != nil {
+			return err
+		}
+		filenames[name] = filename
+		if info, err := os.Stat(filename); err == nil {
+			sizes[name] = info.Size()
+		} else if os.IsNotExist(err) == false {
+			return err
+		}
+	}
+	bufferDir, _ := s.path(streamId, "buffer_files")
+	if err := makeDir(bufferDir); err != nil {
+		return err
+	}
+	appended := make([]string, 0, len(files))
+	var err error
+	for name, r := range files {
+		appended = append(appended, name)
+		if err = appendFile(filenames[name], r); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		// new files only persist once the directory is synced
+		if err = syncDir(bufferDir); err == nil {
+			return nil
+		}
+	}
+	for _, name := range appended {
+		if size, ok := sizes[name]; ok {
+			os.Truncate(filenames[name], size)
+		} else {
+			os.Remove(filenames[name])
+		}
+	}
+	return err
+}
+
+func (s *FileStore) WriteCheckpoint(streamId, name string, data []byte) error {
+	return s.WriteFile(streamId, "buffer_files/checkpoint_files/"+name, data)
+}
+
+func (s *FileStore) WriteCheckpointFrom(streamId, name string, r io.Reader) error {
+	return s.writeFrom(streamId, "buffer_files/checkpoint_files/"+name, r)
+}
+
+func (s *FileStore) ClearBuffer(streamId string) error {
+	return s.Remove(streamId, "buffer_files")
+}
+
+func (s *FileStore) CommitPartition(streamId string, partition int) error {
+	bufferDir, err := s.path(streamId, "buffer_files/checkpoint_files")
+	if err != nil {
+		return err
+	}
+	if err = makeDir(bufferDir); err != nil {
+		return err
+	}
+	return commitPartition(s, streamId, partition)
+}
+
+func (s *FileStore) Recover(streamId string) ([]string, error) {
+	if err := s.Remove(streamId, "tmp"); err != nil {
+		return nil, err
+	}
+	return recoverStream(s, streamId)
+}
+
+func (s *FileStore) ListPartitions(streamId string) ([]int, error) {
+	names, err := s.ListDir(streamId, "")
+	if err != nil {
+		return nil, err
+	}
+	return numericNames(names, true), nil
+}
+
+func (s *FileStore) LastCheckpoint(streamId string, partition int) (int, error) {
+	names, err := s.ListDir(streamId, strconv.Itoa(partition))
+	if err != nil {
+		return 0, err
+	}
+	checkpoints := numericNames(names, false)
+	if len(checkpoints) == 0 {
+		return 0, os.ErrNotExist
+	}
+	return checkpoints[len(checkpoints)-1], nil
+}
+
+func (s *FileStore) ReadCheckpoint(streamId string, partition, checkpoint int) (map[string][]byte, error) {
+	dir := checkpointDir(partition, checkpoint)
+	if _, err := s.Stat(streamId, dir); err != nil {
+		return nil, err
+	}
+	return readFiles(s, streamId, dir)
+}
+
+func (s *FileStore) Stat(streamId, name string) (StoreFile, error) {
+	filename, err := s.path(streamId, name)
+	if err != nil {
+		return StoreFile{}, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return StoreFile{}, err
+	}
+	clean, _ := cleanName(name)
+	return StoreFile{Name: clean, Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+func (s *FileStore) ListDir(streamId, dir string) ([]string, error) {
+	dirname, err := s.path(streamId, dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dirname)
+	if os.IsNotExist(err) {
+		return make([]string, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(files))
+	for _, file := range files {
+		res = append(res, file.Name())
+	}
+	return res, nil
+}
+
+func (s *FileStore) ListFiles(streamId, dir string) ([]StoreFile, error) {
+	streamDir, err := s.path(streamId, "")
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.path(streamId, dir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]StoreFile, 0)
+	if _, err = os.Stat(root); os.IsNotExist(err) {
+		return res, nil
+	}
+	err = filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() == false {
+			return nil
+		}
+		name, err := filepath.Rel(streamDir, filename)
+		if err != nil {
+			return err
+		}
+		res = append(res, StoreFile{
+			Name:    filepath.ToSlash(name),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return res, err
+}
+
+func (s *FileStore) OpenFile(streamId, name string) (io.ReadCloser, error) {
+	filename, err := s.path(streamId, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
+}
+
+// The file only appears under its name once the writer is closed, like the files of WriteFile.
+func (s *FileStore) CreateFile(streamId, name string) (io.WriteCloser, error) {
+	filename, err := s.path(streamId, name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.createTemp(streamId)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{file, s, filename}, nil
+}
+
+// Writer returned by FileStore.CreateFile.
+type fileWriter struct {
+	*os.File
+	store    *FileStore
+	filename string
+}
+
+func (w *fileWriter) Close() error {
+	return w.store.commitTemp(w.File, w.filename)
+}
+
+func (s *FileStore) WriteFile(streamId, name string, data []byte) error {
+	return s.writeFrom(streamId, name, bytes.NewReader(data))
+}
+
+func (s *FileStore) writeFrom(streamId, name string, r io.Reader) error {
+	filename, err := s.path(streamId, name)
+	if err != nil {
+		return err
+	}
+	file, err := s.createTemp(streamId)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	return s.commitTemp(file, filename)
+}
+
+// Create a file in the tmp directory of a stream, to be moved into place with commitTemp.
+func (s *FileStore) createTemp(streamId string) (*os.File, error) {
+	tmpDir, _ := s.path(streamId, "tmp")
+	if err := makeDir(tmpDir); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(tmpDir, "write")
+}
+
+// Sync and close a file made by createTemp, and rename it to filename. Since the file is renamed,
+// a shared seed that filename pointed to is never modified, only released.
+func (s *FileStore) commitTemp(file *os.File, filename string) error {
+	err := file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = makeDir(filepath.Dir(filename))
+	}
+	replaced := s.seedsIn(filename)
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err = syncDir(filepath.Dir(filename)); err != nil {
+		return err
+	}
+	return s.releaseSeeds(replaced)
+}
+
+func (s *FileStore) Remove(streamId, name string) error {
+	filename, err := s.path(streamId, name)
+	if err != nil {
+		return err
+	}
+	seeds := s.seedsIn(filename)
+	if err = os.RemoveAll(filename); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(filename)); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return s.releaseSeeds(seeds)
+}
+
+func (s *FileStore) Rename(streamId, src, dst string) error {
+	srcname, err := s.path(streamId, src)
+	if err != nil {
+		return err
+	}
+	dstname, err := s.path(streamId, dst)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dstname); err == nil {
+		return errors.New("Cannot rename " + src + ", " + dst + " already exists")
+	}
+	if err = makeDir(filepath.Dir(dstname)); err != nil {
+		return err
+	}
+	if err = os.Rename(srcname, dstname); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(dstname)); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(srcname))
+}
+
+// Keeps every file in memory, for tests.
+type MemoryStore struct {
+	sync.Mutex
+	streams     map[string]map[string]*memoryFile
+	quarantined map[string]map[string]*memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+	isDir   bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		streams:     make(map[string]map[string]*memoryFile),
+		quarantined: make(map[string]map[string]*memoryFile),
+	}
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	store    *MemoryStore
+	streamId string
+	name     string
+}
+
+func (w *memoryWriter) Close() error {
+	return w.store.WriteFile(w.streamId, w.name, w.Bytes())
+}
+
+// Returns the entries of a stream that are name or below it. Assumes the store is locked.
+func (s *MemoryStore) below(streamId, name string) map[string]*memoryFile {
+	res := make(map[string]*memoryFile)
+	for filename, file := range s.streams[streamId] {
+		if name == "" || filename == name || strings.HasPrefix(filename, name+"/") {
+			res[filename] = file
+		}
+	}
+	return res
+}
+
+// Create the stream and the directories leading to name. Assumes the store is locked.
+func (s *MemoryStore) mkdirs(streamId, name string) {
+	if s.streams[streamId] == nil {
+		s.streams[streamId] = make(map[string]*memoryFile)
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := s.streams[streamId][dir]; ok == false {
+			s.streams[streamId][dir] = &memoryFile{modTime: time.Now(), isDir: true}
+		}
+	}
+}
+
+func (s *MemoryStore) ListStreams() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	res := make([]string, 0, len(s.streams))
+	for streamId := range s.streams {
+		res = append(res, streamId)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s *MemoryStore) RemoveStream(streamId string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.streams, streamId)
+	return nil
+}
+
+func (s *MemoryStore) QuarantineStream(streamId string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	files, ok := s.streams[streamId]
+	if ok == false {
+		return "", os.ErrNotExist
+	}
+	name := streamId + "." + strconv.Itoa(len(s.quarantined))
+	s.quarantined[name] = files
+	delete(s.streams, streamId)
+	return "quarantine/" + name, nil
+}
+
+func (s *MemoryStore) WriteSeed(streamId, name string, data []byte) error {
+	return s.WriteFile(streamId, "files/"+name, data)
+}
+
+func (s *MemoryStore) AppendFrames(streamId string, files map[string][]byte) error {
+	cleanNames := make(map[string]string)
+	for name := range files {
+		clean, err := frameName(name)
+		if err != nil {
+			return err
+		}
+		cleanNames[name] = clean
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, clean := range cleanNames {
+		if file, ok := s.streams[streamId][clean]; ok && file.isDir {
+			return errors.New("Cannot append to directory " + clean)
+		}
+	}
+	for name, data := range files {
+		clean := cleanNames[name]
+		s.mkdirs(streamId, clean)
+		file, ok := s.streams[streamId][clean]
+		if ok == false {
+			file = &memoryFile{}
+			s.streams[streamId][clean] = file
+		}
+		file.data = append(file.data, data...)
+		file.modTime = time.Now()
+	}
+	return nil
+}
+
+func (s *MemoryStore) AppendFramesFrom(streamId string, files map[string]io.Reader) error {
+	data := make(map[string][]byte)
+	for name, r := range files {
+		frame, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		data[name] = frame
+	}
+	return s.AppendFrames(streamId, data)
+}
+
+func (s *MemoryStore) WriteCheckpoint(streamId, name string, data []byte) error {
+	return s.WriteFile(streamId, "buffer_files/checkpoint_files/"+name, data)
+}
+
+func (s *MemoryStore) WriteCheckpointFrom(streamId, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.WriteCheckpoint(streamId, name, data)
+}
+
+func (s *MemoryStore) ClearBuffer(streamId string) error {
+	return s.Remove(streamId, "buffer_files")
+}
+
+func (s *MemoryStore) CommitPartition(streamId string, partition int) error {
+	s.Lock()
+	s.mkdirs(streamId, "buffer_files/checkpoint_files/file")
+	s.Unlock()
+	return commitPartition(s, streamId, partition)
+}
+
+func (s *MemoryStore) Recover(streamId string) ([]string, error) {
+	return recoverStream(s, streamId)
+}
+
+func (s *MemoryStore) ListPartitions(streamId string) ([]int, error) {
+	names, err := s.ListDir(streamId, "")
+	if err != nil {
+		return nil, err
+	}
+	return numericNames(names, true), nil
+}
+
+func (s *MemoryStore) LastCheckpoint(streamId string, partition int) (int, error) {
+	names, err := s.ListDir(streamId, strconv.Itoa(partition))
+	if err != nil {
+		return 0, err
+	}
+	checkpoints := numericNames(names, false)
+	if len(checkpoints) == 0 {
+		return 0, os.ErrNotExist
+	}
+	return checkpoints[len(checkpoints)-1], nil
+}
+
+func (s *MemoryStore) ReadCheckpoint(streamId string, partition, checkpoint int) (map[string][]byte, error) {
+	dir := checkpointDir(partition, checkpoint)
+	if _, err := s.Stat(streamId, dir); err != nil {
+		return nil, err
+	}
+	return readFiles(s, streamId, dir)
+}
+
+func (s *MemoryStore) Stat(streamId, name string) (StoreFile, error) {
+	clean, err := cleanName(name)
+	if err != nil {
+		return StoreFile{}, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.streams[streamId]; ok == false {
+		return StoreFile{}, os.ErrNotExist
+	}
+	if clean == "" {
+		return StoreFile{IsDir: true}, nil
+	}
+	file, ok := s.streams[streamId][clean]
+	if ok == false {
+		return StoreFile{}, os.ErrNotExist
+	}
+	return StoreFile{Name: clean, Size: int64(len(file.data)), ModTime: file.modTime, IsDir: file.isDir}, nil
+}
+
+func (s *MemoryStore) ListDir(streamId, dir string) ([]string, error) {
+	clean, err := cleanName(dir)
+	if err != nil {
+		return nil, err
+	}
+	if clean == "" {
+		clean = "."
+	}
+	s.Lock()
+	defer s.Unlock()
+	res := make([]string, 0)
+	for filename := range s.streams[streamId] {
+		if path.Dir(filename) == clean {
+			res = append(res, path.Base(filename))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (s *MemoryStore) ListFiles(streamId, dir string) ([]StoreFile, error) {
+	clean, err := cleanName(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	res := make([]StoreFile, 0)
+	for filename, file := range s.below(streamId, clean) {
+		if file.isDir == false {
+			res = append(res, StoreFile{Name: filename, Size: int64(len(file.data)), ModTime: file.modTime})
+		}
+	}
+	sort.Sort(storeFilesByName(res))
+	return res, nil
+}
+
+type storeFilesByName []StoreFile
+
+func (f storeFilesByName) Len() int           { return len(f) }
+func (f storeFilesByName) Less(i, j int) bool { return f[i].Name < f[j].Name }
+func (f storeFilesByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+func (s *MemoryStore) OpenFile(streamId, name string) (io.ReadCloser, error) {
+	clean, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	file, ok := s.streams[streamId][clean]
+	if ok == false || file.isDir {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(file.data)), nil
+}
+
+func (s *MemoryStore) CreateFile(streamId, name string) (io.WriteCloser, error) {
+	clean, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	if clean == "" {
+		return nil, errors.New("Invalid file path")
+	}
+	return &memoryWriter{store: s, streamId: streamId, name: clean}, nil
+}
+
+func (s *MemoryStore) WriteFile(streamId, name string, data []byte) error {
+	clean, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if clean == "" {
+		return errors.New("Invalid file path")
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.mkdirs(streamId, clean)
+	s.streams[streamId][clean] = &memoryFile{data: append([]byte(nil), data...), modTime: time.Now()}
+	return nil
+}
+
+func (s *MemoryStore) Remove(streamId, name string) error {
+	clean, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if clean == "" {
+		return s.RemoveStream(streamId)
+	}
+	s.Lock()
+	defer s.Unlock()
+	for filename := range s.below(streamId, clean) {
+		delete(s.streams[streamId], filename)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Rename(streamId, src, dst string) error {
+	cleanSrc, err := cleanName(src)
+	if err != nil {
+		return err
+	}
+	cleanDst, err := cleanName(dst)
+	if err != nil {
+		return err
+	}
+	if cleanSrc == "" || cleanDst == "" {
+		return errors.New("Invalid file path")
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.streams[streamId][cleanDst]; ok {
+		return errors.New("Cannot rename " + src + ", " + dst + " already exists")
+	}
+	moved := s.below(streamId, cleanSrc)
+	if len(moved) == 0 {
+		return os.ErrNotExist
+	}
+	s.mkdirs(streamId, cleanDst)
+	for filename, file := range moved {
+		delete(s.streams[streamId], filename)
+		s.streams[streamId][cleanDst+strings.TrimPrefix(filename, cleanSrc)] = file
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package scv
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs the same checks against every StreamStore implementation.
+func storeTest(t *testing.T, check func(*testing.T, StreamStore)) {
+	root, err := ioutil.TempDir("", "store_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	t.Run("FileStore", func(t *testing.T) { check(t, NewFileStore(filepath.Join(root, "streams"))) })
+	t.Run("MemoryStore", func(t *testing.T) { check(t, NewMemoryStore()) })
+}
+
+func readStoreFile(t *testing.T, s StreamStore, streamId, name string) []byte {
+	file, err := s.OpenFile(streamId, name)
+	if assert.Nil(t, err) == false {
+		return nil
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	return data
+}
+
+func TestStoreSeeds(t *testing.T) {
+	storeTest(t, func(t *testing.T, s StreamStore) {
+		streams, err := s.ListStreams()
+		assert.Nil(t, err)
+		assert.Empty(t, streams)
+		_, err = s.Stat("a", "")
+		assert.True(t, os.IsNotExist(err))
+
+		assert.Nil(t, s.WriteSeed("a", "system.xml", []byte("system")))
+		assert.Nil(t, s.WriteSeed("a", "state.xml", []byte("state")))
+		assert.Nil(t, s.WriteSeed("b", "state.xml", []byte("other")))
+		streams, _ = s.ListStreams()
+		assert.Equal(t, streams, []string{"a", "b"})
+		names, err := s.ListDir("a", "files")
+		assert.Nil(t, err)
+		assert.Equal(t, names, []string{"state.xml", "system.xml"})
+		names, err = s.ListDir("a", "tags")
+		assert.Nil(t, err)
+		assert.Empty(t, names)
+		assert.Equal(t, readStoreFile(t, s, "a", "files/state.xml"), []byte("state"))
+		info, err := s.Stat("a", "files/state.xml")
+		assert.Nil(t, err)
+		assert.Equal(t, info.Name, "files/state.xml")
+		assert.Equal(t, info.Size, int64(5))
+		assert.False(t, info.IsDir)
+		info, _ = s.Stat("a", "files")
+		assert.True(t, info.IsDir)
+
+		assert.Nil(t, s.RemoveStream("a"))
+		streams, _ = s.ListStreams()
+		assert.Equal(t, streams, []string{"b"})
+		_, err = s.OpenFile("a", "files/state.xml")
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestStorePartitions(t *testing.T) {
+	storeTest(t, func(t *testing.T, s StreamStore) {
+		partitions, err := s.ListPartitions("a")
+		assert.Nil(t, err)
+		assert.Empty(t, partitions)
+
+		assert.Nil(t, s.AppendFrames("a", map[string][]byte{"frames.xtc": []byte("ab")}))
+		assert.Nil(t, s.AppendFrames("a", map[string][]byte{"frames.xtc": []byte("cd")}))
+		assert.Nil(t, s.WriteCheckpoint("a", "state.xml", []byte("s5")))
+		assert.Equal(t, readStoreFile(t, s, "a", "buffer_files/frames.xtc"), []byte("abcd"))
+		assert.Nil(t, s.CommitPartition("a", 5))
+		_, err = s.Stat("a", "buffer_files")
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, readStoreFile(t, s, "a", "5/0/frames.xtc"), []byte("abcd"))
+
+		// checkpoints made before the first frame
+		assert.Nil(t, s.WriteCheckpoint("b", "state.xml", []byte("s0")))
+		assert.Nil(t, s.CommitPartition("b", 0))
+		last, err := s.LastCheckpoint("b", 0)
+		assert.Nil(t, err)
+		assert.Equal(t, last, 1)
+
+		// a second commit to the same partition becomes its next checkpoint
+		assert.Nil(t, s.AppendFrames("a", map[string][]byte{"frames.xtc": []byte("ef")}))
+		assert.Nil(t, s.WriteCheckpoint("a", "state.xml", []byte("s5b")))
+		assert.Nil(t, s.CommitPartition("a", 5))
+		last, err = s.LastCheckpoint("a", 5)
+		assert.Nil(t, err)
+		assert.Equal(t, last, 1)
+		checkpoint, err := s.ReadCheckpoint("a", 5, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, checkpoint, map[string][]byte{"state.xml": []byte("s5b")})
+
+		// partitions are sorted numerically
+		assert.Nil(t, s.WriteCheckpoint("a", "state.xml", []byte("s12")))
+		assert.Nil(t, s.CommitPartition("a", 12))
+		partitions, _ = s.ListPartitions("a")
+		assert.Equal(t, partitions, []int{5, 12})
+		_, err = s.LastCheckpoint("a", 7)
+		assert.True(t, os.IsNotExist(err))
+		_, err = s.ReadCheckpoint("a", 12, 1)
+		assert.True(t, os.IsNotExist(err))
+
+		files, err := s.ListFiles("a", "5")
+		assert.Nil(t, err)
+		names := make([]string, 0)
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		assert.Equal(t, names, []string{
+			"5/0/checkpoint_files/state.xml",
+			"5/0/frames.xtc",
+			"5/1/checkpoint_files/state.xml",
+			"5/1/frames.xtc",
+		})
+
+		assert.Nil(t, s.AppendFrames("a", map[string][]byte{"frames.xtc": []byte("gh")}))
+		assert.Nil(t, s.ClearBuffer("a"))
+		_, err = s.Stat("a", "buffer_files")
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestStoreAppendFrames(t *testing.T) {
+	storeTest(t, func(t *testing.T, s StreamStore) {
+		frame := map[string][]byte{"frames.xtc": []byte("ab"), "log.txt": []byte("1")}
+		assert.Nil(t, s.AppendFrames("a", frame))
+		assert.Nil(t, s.AppendFrames("a", frame))
+		assert.Equal(t, readStoreFile(t, s, "a", "buffer_files/frames.xtc"), []byte("abab"))
+		assert.Equal(t, readStoreFile(t, s, "a", "buffer_files/log.txt"), []byte("11"))
+
+		// checkpoint_files is a directory, so nothing of this frame may be appended
+		assert.Nil(t, s.WriteCheckpoint("a", "state.xml", []byte("s")))
+		frame["checkpoint_files"] = []byte("x")
+		frame["new.txt"] = []byte("n")
+		assert.NotNil(t, s.AppendFrames("a", frame))
+		assert.Equal(t, readStoreFile(t, s, "a", "buffer_files/frames.xtc"), []byte("abab"))
+		assert.Equal(t, readStoreFile(t, s, "a", "buffer_files/log.txt"), []byte("11"))
+		_, err := s.Stat("a", "buffer_files/new.txt")
+		assert.True(t, os.IsNotExist(err))
+		assert.NotNil(t, s.AppendFrames("a", map[string][]byte{"../x": []byte("x")}))
+
+		// frames read from a failing upload are not appended either
+		failing := iotest.TimeoutReader(strings.NewReader("d"))
+		assert.NotNil(t, s.AppendFramesFrom("a", map[string]io.Reader{"frames.xtc": failing}))
+		assert.Equal(t, readStoreFile(t, s, "a", "buffer_files/frames.xtc"), []byte("abab"))
+		assert.Nil(t, s.AppendFramesFrom("a", map[string]io.Reader{"frames.xtc": strings.NewReader("c")}))
+		assert.Equal(t, readStoreFile(t, s, "a", "buffer_files/frames.xtc"), []byte("ababc"))
+		assert.Nil(t, s.WriteCheckpointFrom("a", "state.xml", strings.NewReader("t")))
+		assert.Equal(t, readStoreFile(t, s, "a", "buffer_files/checkpoint_files/state.xml"), []byte("t"))
+	})
+}
+
+func TestStoreRecover(t *testing.T) {
+	storeTest(t, func(t *testing.T, s StreamStore) {
+		assert.Nil(t, s.WriteSeed("a", "state.xml", []byte("s0")))
+		assert.Nil(t, s.AppendFrames("a", map[string][]byte{"frames.xtc": []byte("ab")}))
+		assert.Nil(t, s.WriteCheckpoint("a", "state.xml", []byte("s2")))
+		assert.Nil(t, s.CommitPartition("a", 2))
+		changes, err := s.Recover("a")
+		assert.Nil(t, err)
+		assert.Empty(t, changes)
+
+		// the SCV died after moving the buffer but before completing the commit
+		assert.Nil(t, s.AppendFrames("a", map[string][]byte{"frames.xtc": []byte("cd")}))
+		assert.Nil(t, s.WriteCheckpoint("a", "state.xml", []byte("s2b")))
+		data, _ := json.Marshal(storeJournal{Partition: 2, Checkpoint: 1})
+		assert.Nil(t, s.WriteFile("a", "journal", data))
+		assert.Nil(t, s.Rename("a", "buffer_files", "2/1"))
+		// and left a new buffer, a seed version and a checkpoint of a new partition half written
+		assert.Nil(t, s.AppendFrames("a", map[string][]byte{"frames.xtc": []byte("ef")}))
+		assert.Nil(t, s.WriteFile("a", "seeds/2.tmp/state.xml", []byte("s0")))
+		assert.Nil(t, s.WriteFile("a", "5/0.tmp/checkpoint_files/state.xml", []byte("s5")))
+
+		changes, err = s.Recover("a")
+		assert.Nil(t, err)
+		assert.Equal(t, len(changes), 4)
+		partitions, _ := s.ListPartitions("a")
+		assert.Equal(t, partitions, []int{2})
+		last, _ := s.LastCheckpoint("a", 2)
+		assert.Equal(t, last, 0)
+		for _, name := range []string{"journal", "buffer_files", "seeds/2.tmp", "2/1"} {
+			_, err = s.Stat("a", name)
+			assert.True(t, os.IsNotExist(err), name)
+		}
+		assert.Equal(t, readStoreFile(t, s, "a", "2/0/frames.xtc"), []byte("ab"))
+		assert.Equal(t, readStoreFile(t, s, "a", "files/state.xml"), []byte("s0"))
+		changes, _ = s.Recover("a")
+		assert.Empty(t, changes)
+	})
+}
+
+func TestStoreFiles(t *testing.T) {
+	storeTest(t, func(t *testing.T, s StreamStore) {
+		file, err := s.CreateFile("a", "seeds/3/state.xml")
+		assert.Nil(t, err)
+		file.Write([]byte("old"))
+		// created files only appear once they are complete
+		_, err = s.Stat("a", "seeds/3/state.xml")
+		assert.True(t, os.IsNotExist(err))
+		assert.Nil(t, file.Close())
+		assert.Equal(t, readStoreFile(t, s, "a", "seeds/3/state.xml"), []byte("old"))
+
+		assert.Nil(t, s.WriteFile("a", "seeds/5/state.xml", []byte("new")))
+		assert.NotNil(t, s.Rename("a", "seeds/3", "seeds/5"))
+		assert.Nil(t, s.Rename("a", "seeds/3", "seeds/4"))
+		names, _ := s.ListDir("a", "seeds")
+		assert.Equal(t, names, []string{"4", "5"})
+		assert.Equal(t, readStoreFile(t, s, "a", "seeds/4/state.xml"), []byte("old"))
+
+		assert.Nil(t, s.Remove("a", "seeds/4"))
+		assert.Nil(t, s.Remove("a", "seeds/4"))
+		names, _ = s.ListDir("a", "seeds")
+		assert.Equal(t, names, []string{"5"})
+
+		// names may not leave the stream
+		assert.NotNil(t, s.WriteFile("a", "../b/files/state.xml", []byte("x")))
+		assert.NotNil(t, s.WriteFile("a", "/files/state.xml", []byte("x")))
+		_, err = s.OpenFile("a", "seeds/../../b")
+		assert.NotNil(t, err)
+		streams, _ := s.ListStreams()
+		assert.Equal(t, streams, []string{"a"})
+	})
+}
+
+func TestStoreQuarantine(t *testing.T) {
+	storeTest(t, func(t *testing.T, s StreamStore) {
+		assert.Nil(t, s.WriteSeed("q", "system.xml", []byte("system")))
+		assert.Nil(t, s.WriteSeed("r", "system.xml", []byte("system")))
+		dst, err := s.QuarantineStream("q")
+		assert.Nil(t, err)
+		assert.NotEmpty(t, dst)
+		streams, err := s.ListStreams()
+		assert.Nil(t, err)
+		assert.Equal(t, streams, []string{"r"})
+		_, err = s.Stat("q", "")
+		assert.True(t, os.IsNotExist(err))
+		_, err = s.QuarantineStream("q")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestFileStoreSharedSeeds(t *testing.T) {
+	root, err := ioutil.TempDir("", "store_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	s := NewFileStore(filepath.Join(root, "streams"))
+	assert.Nil(t, s.WriteSeed("a", "system.xml", []byte("system")))
+	assert.Nil(t, s.WriteSeed("b", "system.xml", []byte("system")))
+	assert.Nil(t, s.WriteSeed("b", "state.xml", []byte("state")))
+	a, _ := os.Stat(filepath.Join(root, "streams", "a", "files", "system.xml"))
+	b, _ := os.Stat(filepath.Join(root, "streams", "b", "files", "system.xml"))
+	assert.True(t, os.SameFile(a, b))
+	seeds, _ := ioutil.ReadDir(filepath.Join(root, "seed_files"))
+	assert.Equal(t, len(seeds), 2)
+	names, _ := s.ListDir("b", "tmp")
+	assert.Empty(t, names)
+
+	// replacing a seed leaves the other streams alone
+	assert.Nil(t, s.WriteSeed("b", "system.xml", []byte("changed")))
+	assert.Equal(t, readStoreFile(t, s, "a", "files/system.xml"), []byte("system"))
+	w, err := s.CreateFile("a", "files/system.xml")
+	assert.Nil(t, err)
+	w.Write([]byte("created"))
+	w.Close()
+	assert.Equal(t, readStoreFile(t, s, "b", "files/system.xml"), []byte("changed"))
+
+	// seeds are read-only, and removed with the last file that links to them
+	info, err := os.Stat(filepath.Join(root, "streams", "b", "files", "system.xml"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0444))
+	info, err = os.Stat(filepath.Join(root, "streams", "a", "files", "system.xml"))
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0644))
+	// a was the last to use the original system.xml
+	seeds, _ = ioutil.ReadDir(filepath.Join(root, "seed_files"))
+	assert.Equal(t, len(seeds), 2)
+	assert.Nil(t, s.WriteSeed("c", "state.xml", []byte("state")))
+	assert.Nil(t, s.WriteSeed("c", "system.xml", []byte("changed")))
+	assert.Nil(t, s.Remove("c", "files/system.xml"))
+	assert.Nil(t, s.RemoveStream("a"))
+	seeds, _ = ioutil.ReadDir(filepath.Join(root, "seed_files"))
+	assert.Equal(t, len(seeds), 2)
+	assert.Nil(t, s.RemoveStream("b"))
+	seeds, _ = ioutil.ReadDir(filepath.Join(root, "seed_files"))
+	assert.Equal(t, len(seeds), 1)
+	assert.Equal(t, readStoreFile(t, s, "c", "files/state.xml"), []byte("state"))
+	assert.Nil(t, s.RemoveStream("c"))
+	seeds, _ = ioutil.ReadDir(filepath.Join(root, "seed_files"))
+	assert.Empty(t, seeds)
+}
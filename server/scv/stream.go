@@ -15,10 +15,30 @@ type Stream struct {
 	Frames       int `json:"frames" bson:"frames"`
 	ErrorCount   int `json:"error_count" bson:"error_count"`
 	CreationDate int `json:"creation_date" bson:"creation_date"`
+	// Streams with a higher priority are always activated before those with a lower one.
+	// Weight scales the odds of the stream under the weighted_random policy.
+	Priority int     `json:"priority" bson:"priority"`
+	Weight   float64 `json:"weight" bson:"weight"`
+	// Overrides the max_frames of the target if positive.
+	MaxFrames int `json:"max_frames" bson:"max_frames"`
+	// Engines the stream may run on, in the form of TargetOptions.Engines. Cores must meet both these
+	// and the requirements of the target.
+	Engines map[string]string `json:"engines,omitempty" bson:"engines,omitempty"` // constant
+	// Lineage of streams created with /streams/fork, the partition is the frame count of the parent.
+	// The checkpoint is nil if the stream was forked from the seed files of partition 0.
+	ParentId         string `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+	ParentPartition  int    `json:"parent_partition,omitempty" bson:"parent_partition,omitempty"`
+	ParentCheckpoint *int   `json:"parent_checkpoint,omitempty" bson:"parent_checkpoint,omitempty"`
 
 	MongoStatus string `json:"status" bson:"status"` // this value is really used for persistence purposes. Real status determined by target
+	// Time of the last checkpoint, in seconds since the epoch.
+	LastCheckpoint int `json:"last_checkpoint" bson:"last_checkpoint"`
+	// Frame count last written to Mongo, it lags behind Frames until the deferred writes are applied.
+	PersistedFrames int `json:"persisted_frames" bson:"-"`
 
-	activeStream *ActiveStream
+	activeStream  *ActiveStream
+	idleSince     int64 // time (ns) the stream last became inactive, used by oldest_idle
+	activationSeq int   // value of the target's activation counter when last activated
 }
 
 func NewStream(streamId, targetId, owner string,
@@ -30,6 +50,7 @@ func NewStream(streamId, targetId, owner string,
 		ErrorCount:   errorCount,
 		CreationDate: creationDate,
 		Owner:        owner,
+		Weight:       1,
 		MongoStatus:  "enabled", // by default is enabled because we can't
 	}
 	return stream
@@ -1,14 +1,138 @@
 package scv
 
+import (
+	"container/list"
+	"log"
+	"strconv"
+	"strings"
+)
+
 type Target struct {
 	// tokens          map[string]*Stream   // map of token to Stream
-	activeStreams   map[*Stream]struct{} // set of active streams
-	disabledStreams map[*Stream]struct{} // set of streams not eligible to be assigned
-	inactiveStreams *Set                 // queue of inactive streams
+	targetId          string
+	activeStreams     map[*Stream]struct{} // set of active streams
+	disabledStreams   map[*Stream]struct{} // set of streams not eligible to be assigned
+	completedStreams  map[*Stream]struct{} // set of streams that reached max_frames, never assigned again
+	busyStreams       map[*Stream]struct{} // set of streams TruncateStream or ModifyInactiveStream work on, see Manager.markBusy
+	inactiveStreams   *Set                 // queue of inactive streams, ordered by policy
+	policy            SchedulingPolicy     // decides which inactive stream is activated next
+	activations       int                  // number of activations so far, used by round_robin
+	restrictedStreams int                  // number of streams with engine requirements of their own
+	options           TargetOptions
+	waiters           *list.List // FIFO of *activationWaiter blocked in ActivateStreamWait
 	// timers          map[string]*time.Timer
 	// ExpirationTime  int // expiration time in seconds
 }
 
+// A caller of ActivateStreamWait that is waiting for a stream to become inactive.
+type activationWaiter struct {
+	user   string
+	engine string
+	ready  chan activation // receives the activated stream, or a zero value if the target was removed
+}
+
+type activation struct {
+	stream *Stream
+	token  string
+}
+
+// Per-target settings, read from the options document of the target in data.targets.
+// These are loaded when the target is created in the Manager, and again by Manager.ReloadTargetOptions.
+type TargetOptions struct {
+	Scheduling string `bson:"scheduling"` // name of the SchedulingPolicy, see NewSchedulingPolicy
+	// Map of engine name to the minimum engine version ("" allows any version). If empty,
+	// every engine is allowed.
+	Engines map[string]string `bson:"engines"`
+	// Streams are completed once they reach this many frames, 0 means never. Can be overridden per stream.
+	MaxFrames int `bson:"max_frames"`
+	// Share of the owner's allocation given to this target when activating without a target id.
+	Weight float64 `bson:"weight"`
+	// Which checkpoints are kept by the janitor, see RetentionOptions.
+	Retention RetentionOptions `bson:"retention"`
+	// Limits on the disk space used by the streams, see DiskUsage.
+	Quota QuotaOptions `bson:"quota"`
+	// Not part of the options document, these come from data.targets and users.managers.
+	Owner       string  `bson:"-"`
+	OwnerWeight float64 `bson:"-"`
+}
+
+// Splits an engine string of the form "name" or "name@version".
+func parseEngine(engine string) (name, version string) {
+	result := strings.SplitN(engine, "@", 2)
+	if len(result) < 2 {
+		return result[0], ""
+	}
+	return result[0], result[1]
+}
+
+// Compares two dotted version strings (eg. "6.2.1") component by component, numerically
+// when both components are numbers. Returns -1, 0 or 1.
+func compareVersions(v1, v2 string) int {
+	c1 := strings.Split(v1, ".")
+	c2 := strings.Split(v2, ".")
+	for i := 0; i < len(c1) || i < len(c2); i++ {
+		a, b := "0", "0"
+		if i < len(c1) {
+			a = c1[i]
+		}
+		if i < len(c2) {
+			b = c2[i]
+		}
+		n1, e1 := strconv.Atoi(a)
+		n2, e2 := strconv.Atoi(b)
+		if e1 == nil && e2 == nil {
+			if n1 != n2 {
+				if n1 < n2 {
+					return -1
+				}
+				return 1
+			}
+		} else if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Returns true if engine ("name" or "name@version") meets requirements, a map of engine name to the
+// minimum engine version as in TargetOptions.Engines. Empty requirements allow every engine.
+func meetsRequirements(requirements map[string]string, engine string) bool {
+	if len(requirements) == 0 {
+		return true
+	}
+	name, version := parseEngine(engine)
+	minVersion, ok := requirements[name]
+	if ok == false {
+		return false
+	}
+	if minVersion == "" {
+		return true
+	}
+	if version == "" {
+		return false
+	}
+	return compareVersions(version, minVersion) >= 0
+}
+
+// Returns true if a core running engine ("name" or "name@version") may work on this target.
+func (t *Target) acceptsEngine(engine string) bool {
+	return meetsRequirements(t.options.Engines, engine)
+}
+
+// Returns the inactive stream the policy picks among those that engine may run, or nil if there are
+// none. The requirements of the streams are only checked when some streams of the target have them.
+func (t *Target) nextStream(engine string) *Stream {
+	if t.restrictedStreams == 0 {
+		return t.policy.Next(t.inactiveStreams, nil)
+	}
+	return t.policy.Next(t.inactiveStreams, func(stream *Stream) bool {
+		return meetsRequirements(stream.Engines, engine)
+	})
+}
+
 func StreamComp(l, r interface{}) bool {
 	s1 := l.(*Stream)
 	s2 := r.(*Stream)
@@ -27,13 +151,52 @@ func StreamComp(l, r interface{}) bool {
 // 	t.inactiveStreams.Add(s)
 // }
 
-func NewTarget() *Target {
+// Number of active streams per unit of weight, used to pick targets in ActivateStream.
+func fairShare(active int, weight float64) float64 {
+	if weight <= 0 {
+		weight = 1
+	}
+	return float64(active) / weight
+}
+
+// The scheduling policy named in the options of a target, or the default one if it is unknown.
+func targetPolicy(targetId, name string) SchedulingPolicy {
+	policy, err := NewSchedulingPolicy(name)
+	if err != nil {
+		log.Printf("Warning: target %s has %s, using the default policy", targetId, err.Error())
+		policy, _ = NewSchedulingPolicy(DEFAULT_SCHEDULING_POLICY)
+	}
+	return policy
+}
+
+func NewTarget(targetId string, options TargetOptions) *Target {
+	policy := targetPolicy(targetId, options.Scheduling)
 	target := Target{
 		// tokens:          make(map[string]*Stream),
-		activeStreams:   make(map[*Stream]struct{}),
-		inactiveStreams: NewCustomSet(StreamComp),
-		disabledStreams: make(map[*Stream]struct{}),
+		targetId:         targetId,
+		activeStreams:    make(map[*Stream]struct{}),
+		inactiveStreams:  NewCustomSet(policyComp(policy)),
+		policy:           policy,
+		options:          options,
+		waiters:          list.New(),
+		disabledStreams:  make(map[*Stream]struct{}),
+		completedStreams: make(map[*Stream]struct{}),
+		busyStreams:      make(map[*Stream]struct{}),
 		// timers:          make(map[string]*time.Timer),
 	}
 	return &target
 }
+
+// Replace the options of the target. A change of scheduling policy reorders the inactive queue.
+// Assumes that the manager is locked.
+func (t *Target) setOptions(options TargetOptions) {
+	if options.Scheduling != t.options.Scheduling {
+		t.policy = targetPolicy(t.targetId, options.Scheduling)
+		queue := NewCustomSet(policyComp(t.policy))
+		for i := t.inactiveStreams.Iterator(); i.Next(); {
+			queue.Add(i.Key())
+		}
+		t.inactiveStreams = queue
+	}
+	t.options = options
+}
@@ -0,0 +1,93 @@
+package scv
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Stream the frame file of every partition in order, ie. one contiguous trajectory. The from and to
+// query parameters restrict the partitions to those with from <= frames <= to, and the partitions
+// used are listed in the X-Partitions header. Every partition must contain the frame file, since a
+// gap would silently misalign the trajectory. As with exports, the files are only listed while the
+// stream is locked.
+func (app *Application) StreamTrajectoryHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		file := mux.Vars(r)["file"]
+		if filepath.Base(file) != file || file == "checkpoint_files" {
+			return errors.New("Bad request: invalid frame file " + file)
+		}
+		from, err := parseRange(r, "from", 0)
+		if err != nil {
+			return err
+		}
+		to, err := parseRange(r, "to", int(^uint(0)>>1))
+		if err != nil {
+			return err
+		}
+		partitions := make([]string, 0)
+		entries := make([]StoreFile, 0)
+		var total int64
+		e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			if stream.Owner != user {
+				return errors.New("You do not own this stream.")
+			}
+			all, err := app.Store.ListPartitions(streamId)
+			if err != nil {
+				return err
+			}
+			for _, partition := range all {
+				if partition < from || partition > to {
+					continue
+				}
+				name := strconv.Itoa(partition) + "/0/" + file
+				info, err := app.Store.Stat(streamId, name)
+				if err != nil || info.IsDir {
+					return errors.New("Partition " + strconv.Itoa(partition) + " has no frame file " + file)
+				}
+				partitions = append(partitions, strconv.Itoa(partition))
+				entries = append(entries, info)
+				total += info.Size
+			}
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		if len(entries) == 0 {
+			return errors.New("No partitions in range")
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+		w.Header().Set("X-Partitions", strings.Join(partitions, ","))
+		for _, entry := range entries {
+			err = copyFile(w, app.Store, streamId, entry)
+			if err != nil {
+				log.Printf("Trajectory of stream %s failed: %s", streamId, err.Error())
+				panic(http.ErrAbortHandler)
+			}
+		}
+		return nil
+	}
+}
+
+func copyFile(w io.Writer, store StreamStore, streamId string, entry StoreFile) error {
+	file, err := store.OpenFile(streamId, entry.Name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(w, file, entry.Size)
+	return err
+}
@@ -0,0 +1,199 @@
+package scv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+Cores send frames and checkpoints either as JSON, with every file in a string, or as a binary
+upload: a multipart/form-data body with one part per file, named by the file. Each file part has
+the hex md5 of its body in a Content-MD5 header, and is gunzipped if it has Content-Encoding: gzip.
+A part named "frames" holds the number of frames, as in the JSON message.
+
+Parts are streamed to temporary files in {Name}_data/uploads as they arrive, and only copied into
+the stream once every checksum matched, so a large upload never sits in memory nor holds the lock
+of its stream. Since quotas are only checked once the upload is received, the files it holds are
+limited beforehand to what the quotas of the stream and the free disk space allow, see uploadLimit,
+and the upload is refused as soon as it goes past them, so that a gzip bomb cannot fill the disk.
+*/
+
+// Most bytes the files of an upload may hold once gunzipped, negative if unlimited, and the error
+// the upload is refused with past them.
+type uploadLimit struct {
+	bytes    int64
+	exceeded error
+}
+
+// The tighter of the two limits.
+func (l uploadLimit) min(bytes int64, exceeded error) uploadLimit {
+	if bytes >= 0 && (l.bytes < 0 || bytes < l.bytes) {
+		return uploadLimit{bytes, exceeded}
+	}
+	return l
+}
+
+// Files sent by a core with a frame or a checkpoint.
+type coreFiles struct {
+	data   map[string][]byte // decoded from JSON
+	paths  map[string]string // or received into temporary files
+	dir    string
+	opened []*os.File
+	size   int64
+	limit  uploadLimit
+	frames float64
+	// identifies a frame, so that the same frame POSTed twice is only appended once
+	hash string
+}
+
+func isUpload(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+func (app *Application) uploadDir() string {
+	return filepath.Join(app.Config.Name+"_data", "uploads")
+}
+
+// Receive a binary upload, frames is the default number of frames.
+func (app *Application) receiveUpload(r *http.Request, frames float64, limit uploadLimit) (*coreFiles, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New("Bad request: " + err.Error())
+	}
+	if err = makeDir(app.uploadDir()); err != nil {
+		return nil, errors.New("Cannot receive upload")
+	}
+	dir, err := ioutil.TempDir(app.uploadDir(), "upload")
+	if err != nil {
+		return nil, errors.New("Cannot receive upload")
+	}
+	files := &coreFiles{paths: make(map[string]string), dir: dir, frames: frames, limit: limit}
+	// the boundary changes when an upload is sent again, so only the parts identify it
+	digest := md5.New()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			files.Close()
+			return nil, errors.New("Bad request: cannot read upload")
+		}
+		err = files.receive(part, digest)
+		part.Close()
+		if err != nil {
+			files.Close()
+			return nil, err
+		}
+	}
+	files.hash = hex.EncodeToString(digest.Sum(nil))
+	return files, nil
+}
+
+func (f *coreFiles) receive(part *multipart.Part, digest hash.Hash) error {
+	name := part.FormName()
+	if name == "frames" {
+		value, err := ioutil.ReadAll(io.LimitReader(part, 64))
+		if err == nil {
+			f.frames, err = strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+		}
+		if err != nil {
+			return errors.New("Bad request: invalid frames")
+		}
+		return nil
+	}
+	if name == "" {
+		return errors.New("Bad request: upload has a part without a name")
+	}
+	if _, ok := f.paths[name]; ok {
+		return errors.New("Bad request: " + name + " appears twice")
+	}
+	md5String := strings.ToLower(part.Header.Get("Content-MD5"))
+	if md5String == "" {
+		return errors.New("Bad request: " + name + " has no Content-MD5")
+	}
+	h := md5.New()
+	raw := io.TeeReader(part, h)
+	var src io.Reader = raw
+	if part.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(raw)
+		if err != nil {
+			return errors.New("Bad request: " + name + " is not gzipped")
+		}
+		defer gz.Close()
+		src = gz
+	}
+	if f.limit.bytes >= 0 {
+		// one more byte than allowed tells an upload past the limit from one right at it
+		src = io.LimitReader(src, f.limit.bytes-f.size+1)
+	}
+	file, err := ioutil.TempFile(f.dir, "part")
+	if err != nil {
+		return errors.New("Cannot receive upload")
+	}
+	size, err := io.Copy(file, src)
+	if err == nil && f.limit.bytes >= 0 && f.size+size > f.limit.bytes {
+		file.Close()
+		return f.limit.exceeded
+	}
+	if err == nil {
+		// the checksum covers anything after the gzip stream too
+		_, err = io.Copy(ioutil.Discard, raw)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New("Bad request: cannot read " + name)
+	}
+	sum := h.Sum(nil)
+	if md5String != hex.EncodeToString(sum) {
+		return errors.New("MD5 mismatch for " + name)
+	}
+	f.paths[name] = file.Name()
+	f.size += size
+	io.WriteString(digest, name)
+	digest.Write(sum)
+	return nil
+}
+
+// Readers for every file, closed with the files.
+func (f *coreFiles) readers() (map[string]io.Reader, error) {
+	res := make(map[string]io.Reader)
+	for name, data := range f.data {
+		res[name] = bytes.NewReader(data)
+	}
+	for name, path := range f.paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		f.opened = append(f.opened, file)
+		res[name] = file
+	}
+	return res, nil
+}
+
+// Close the readers and remove the temporary files, if any.
+func (f *coreFiles) Close() {
+	for _, file := range f.opened {
+		file.Close()
+	}
+	f.opened = nil
+	if f.dir != "" {
+		os.RemoveAll(f.dir)
+	}
+}
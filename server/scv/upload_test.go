@@ -0,0 +1,145 @@
+package scv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type uploadPart struct {
+	name string
+	data []byte
+	gzip bool
+	md5  string // computed if empty
+}
+
+// POST a binary upload to path, eg. /core/frame.
+func (f *Fixture) upload(token, path string, parts []uploadPart) (code int) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, part := range parts {
+		data := part.data
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="`+part.name+`"`)
+		if part.gzip {
+			compressed := &bytes.Buffer{}
+			gz := gzip.NewWriter(compressed)
+			gz.Write(data)
+			gz.Close()
+			data = compressed.Bytes()
+			header.Set("Content-Encoding", "gzip")
+		}
+		if part.md5 == "" {
+			sum := md5.Sum(data)
+			part.md5 = hex.EncodeToString(sum[:])
+		}
+		if part.name != "frames" {
+			header.Set("Content-MD5", part.md5)
+		}
+		w, _ := writer.CreatePart(header)
+		w.Write(data)
+	}
+	writer.Close()
+	req, _ := http.NewRequest("POST", path, body)
+	req.Header.Add("Authorization", token)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestUploadFrames(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	streamId, _ := f.postStream(auth_token, `{"target_id":"`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+
+	frame := []uploadPart{
+		{name: "frames.xtc", data: []byte{0, 1, 2, 255}},
+		{name: "log.txt", data: []byte("step 1\n"), gzip: true},
+	}
+	assert.Equal(t, f.upload(token, "/core/frame", frame), 200)
+	// the same frame sent again, with another boundary
+	assert.Equal(t, f.upload(token, "/core/frame", frame), 400)
+	assert.Equal(t, f.upload("bad_token", "/core/frame", frame), 400)
+	bad := []uploadPart{
+		{name: "frames.xtc", data: []byte{3}},
+		{name: "log.txt", data: []byte("step 2\n"), md5: "0123456789abcdef0123456789abcdef"},
+	}
+	assert.Equal(t, f.upload(token, "/core/frame", bad), 400)
+	// older cores keep using JSON
+	assert.Equal(t, f.postFrame(token, `{"files": {"frames.xtc.b64": "Aw==", "log.txt": "step 2\n"}}`), 200)
+	assert.Equal(t, f.upload(token, "/core/checkpoint", []uploadPart{
+		{name: "state.xml", data: []byte("state")},
+		{name: "frames", data: []byte("0.5")},
+	}), 200)
+
+	assert.Equal(t, f.downloadFrame(auth_token, streamId, "frames.xtc", 2), []byte{0, 1, 2, 255, 3})
+	assert.Equal(t, string(f.downloadFrame(auth_token, streamId, "log.txt", 2)), "step 1\nstep 2\n")
+	assert.Equal(t, string(f.download(auth_token, streamId, "2/0/checkpoint_files/state.xml")), "state")
+	f.app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+		assert.Equal(t, stream.activeStream.donorFrames, 0.5)
+		return nil
+	})
+	// temporary files are removed once the upload is done
+	uploads, _ := ioutil.ReadDir(f.app.uploadDir())
+	assert.Empty(t, uploads)
+}
+
+func TestUploadLimit(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", `{"options": {"quota": {"stream": 1000}}}`)
+	auth_token := f.addManager("yutong", 1)
+	streamId, code := f.postStream(auth_token, `{"target_id":"`+target_id+`", "files": {"openmm": "0123456789"}}`)
+	assert.Equal(t, code, 200)
+	usage, _ := f.getUsage(auth_token)
+	seedSize := usage.Streams[streamId].Bytes
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+
+	// checkpoints are not limited by the quota
+	assert.Equal(t, f.upload(token, "/core/checkpoint", []uploadPart{
+		{name: "state.xml", data: bytes.Repeat([]byte("s"), 2000)},
+	}), 200)
+	usage, _ = f.getUsage(auth_token)
+	assert.Equal(t, usage.Streams[streamId].Bytes, seedSize+2000)
+
+	// a frame that only goes past the quota once gunzipped is refused, and the stream paused
+	assert.Equal(t, f.upload(token, "/core/frame", []uploadPart{
+		{name: "frames.xtc", data: make([]byte, 1<<20), gzip: true},
+	}), 400)
+	usage, _ = f.getUsage(auth_token)
+	assert.Equal(t, usage.Streams[streamId].Bytes, seedSize+2000)
+	assert.Equal(t, len(f.app.Manager.targets[target_id].disabledStreams), 1)
+	uploads, _ := ioutil.ReadDir(f.app.uploadDir())
+	assert.Empty(t, uploads)
+
+	// but checkpoints are limited by the free disk space
+	assert.Equal(t, f.streamStart(auth_token, streamId), 200)
+	token, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	f.app.disk.thresholds = DiskThresholds{Frames: 1000}
+	f.setFreeSpace(1500)
+	assert.Equal(t, f.upload(token, "/core/checkpoint", []uploadPart{
+		{name: "state.xml", data: bytes.Repeat([]byte("s"), 600), gzip: true},
+	}), 503)
+	assert.Equal(t, f.upload(token, "/core/checkpoint", []uploadPart{
+		{name: "state.xml", data: bytes.Repeat([]byte("s"), 500), gzip: true},
+	}), 200)
+	uploads, _ = ioutil.ReadDir(f.app.uploadDir())
+	assert.Empty(t, uploads)
+}